@@ -0,0 +1,67 @@
+package anidbtest
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/yureien/anihash/anidb"
+	"gopkg.in/yaml.v3"
+)
+
+// Fixtures are the canned data served by a [Server].
+type Fixtures struct {
+	Users []User   `yaml:"users"`
+	Files []Record `yaml:"files"`
+	Anime []Record `yaml:"anime"`
+	// Faults are injected from the start.
+	Faults Faults `yaml:"faults"`
+}
+
+// A User is an account that can log in to a [Server].
+type User struct {
+	Name     string `yaml:"user"`
+	Password string `yaml:"password"`
+	// APIKey enables encryption for the user.
+	APIKey string `yaml:"api_key"`
+}
+
+// A Record is a canned FILE or ANIME record.
+type Record struct {
+	// ID is the file ID or anime ID.
+	ID uint32 `yaml:"id"`
+	// Fields are the raw field values by the names in
+	// [anidb.FileFmaskFields], [anidb.FileAmaskFields] or
+	// [anidb.AnimeAmaskFields], encoded as AniDB sends them, e.g.
+	// with lists separated by apostrophes.
+	// Fields that are not set are sent empty.
+	Fields map[string]string `yaml:"fields"`
+}
+
+// Faults are failures injected by a [Server].
+type Faults struct {
+	// Delay delays every response.
+	Delay time.Duration `yaml:"delay"`
+	// DropRate is the share of requests, between 0 and 1, that are
+	// not answered.
+	DropRate float64 `yaml:"drop_rate"`
+	// Compress compresses every response.
+	Compress bool `yaml:"compress"`
+	// Codes answers commands with a return code instead of the
+	// canned data, such as SERVER_BUSY for FILE.
+	Codes map[string]anidb.ReturnCode `yaml:"codes"`
+}
+
+// LoadFixtures loads fixtures from a YAML or JSON file.
+func LoadFixtures(path string) (*Fixtures, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("anidbtest LoadFixtures: %w", err)
+	}
+	// YAML is a superset of JSON.
+	var f Fixtures
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("anidbtest LoadFixtures: %w", err)
+	}
+	return &f, nil
+}
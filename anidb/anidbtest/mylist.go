@@ -0,0 +1,193 @@
+package anidbtest
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yureien/anihash/anidb"
+)
+
+// A myListEntry is an entry in the MyList of a fake user.
+type myListEntry struct {
+	lid      int
+	file     Record
+	added    int64
+	state    string
+	viewDate int64
+	storage  string
+	source   string
+	other    string
+}
+
+// row returns the entry as a MYLIST response row.
+func (e *myListEntry) row() string {
+	return strings.Join(fieldValues(Record{Fields: map[string]string{
+		"lid":      strconv.Itoa(e.lid),
+		"fid":      strconv.FormatUint(uint64(e.file.ID), 10),
+		"eid":      e.file.Fields["eid"],
+		"aid":      e.file.Fields["aid"],
+		"gid":      e.file.Fields["gid"],
+		"date":     strconv.FormatInt(e.added, 10),
+		"state":    e.state,
+		"viewdate": strconv.FormatInt(e.viewDate, 10),
+		"storage":  e.storage,
+		"source":   e.source,
+		"other":    e.other,
+	}}, []string{"lid", "fid", "eid", "aid", "gid", "date", "state", "viewdate", "storage", "source", "other", "filestate"}), "|")
+}
+
+// set sets the fields of a MYLISTADD request.
+func (e *myListEntry) set(args url.Values) {
+	if args.Has("state") {
+		e.state = args.Get("state")
+	}
+	if args.Has("viewed") {
+		e.viewDate = 0
+		if args.Get("viewed") == "1" {
+			e.viewDate = time.Now().Unix()
+			if d, err := strconv.ParseInt(args.Get("viewdate"), 10, 64); err == nil {
+				e.viewDate = d
+			}
+		}
+	}
+	if args.Has("storage") {
+		e.storage = args.Get("storage")
+	}
+	if args.Has("source") {
+		e.source = args.Get("source")
+	}
+	if args.Has("other") {
+		e.other = args.Get("other")
+	}
+}
+
+// myListEntries returns the MyList entries of user selected by the
+// arguments of a MyList request.
+// s.mu must be held.
+func (s *Server) myListEntries(user string, args url.Values) []*myListEntry {
+	var matches []*myListEntry
+	for _, e := range s.mylists[user] {
+		switch {
+		case args.Has("lid"):
+			if strconv.Itoa(e.lid) != args.Get("lid") {
+				continue
+			}
+		case args.Has("fid"):
+			if strconv.FormatUint(uint64(e.file.ID), 10) != args.Get("fid") {
+				continue
+			}
+		case args.Has("ed2k"):
+			if e.file.Fields["size"] != args.Get("size") || e.file.Fields["ed2k"] != args.Get("ed2k") {
+				continue
+			}
+		default:
+			continue
+		}
+		matches = append(matches, e)
+	}
+	return matches
+}
+
+func (s *Server) myListAdd(user string, args url.Values) string {
+	entries := s.myListEntries(user, args)
+	if args.Get("edit") == "1" {
+		if len(entries) == 0 {
+			return codeResponse(anidb.NO_SUCH_MYLIST_ENTRY)
+		}
+		for _, e := range entries {
+			e.set(args)
+		}
+		if len(entries) == 1 {
+			return codeResponse(anidb.MYLIST_ENTRY_EDITED)
+		}
+		return fmt.Sprintf("%s\n%d", codeResponse(anidb.MYLIST_ENTRY_EDITED), len(entries))
+	}
+	if len(entries) > 0 {
+		return codeResponse(anidb.FILE_ALREADY_IN_MYLIST) + "\n" + entries[0].row()
+	}
+
+	var file Record
+	found := false
+	for _, r := range s.fixtures.Files {
+		switch {
+		case args.Has("fid"):
+			found = strconv.FormatUint(uint64(r.ID), 10) == args.Get("fid")
+		case args.Has("ed2k"):
+			found = r.Fields["size"] == args.Get("size") && r.Fields["ed2k"] == args.Get("ed2k")
+		default:
+			return codeResponse(anidb.ILLEGAL_INPUT_OR_ACCESS_DENIED)
+		}
+		if found {
+			file = r
+			break
+		}
+	}
+	if !found {
+		return codeResponse(anidb.NO_SUCH_FILE)
+	}
+	s.lastListID++
+	e := &myListEntry{
+		lid:   s.lastListID,
+		file:  file,
+		added: time.Now().Unix(),
+		state: "0",
+	}
+	e.set(args)
+	s.mylists[user] = append(s.mylists[user], e)
+	return fmt.Sprintf("%s\n%d", codeResponse(anidb.MYLIST_ENTRY_ADDED), e.lid)
+}
+
+func (s *Server) myListDel(user string, args url.Values) string {
+	entries := s.myListEntries(user, args)
+	if len(entries) == 0 {
+		return codeResponse(anidb.NO_SUCH_MYLIST_ENTRY)
+	}
+	kept := s.mylists[user][:0]
+	for _, e := range s.mylists[user] {
+		deleted := false
+		for _, d := range entries {
+			deleted = deleted || e == d
+		}
+		if !deleted {
+			kept = append(kept, e)
+		}
+	}
+	s.mylists[user] = kept
+	return fmt.Sprintf("%s\n%d", codeResponse(anidb.MYLIST_ENTRY_DELETED), len(entries))
+}
+
+func (s *Server) myList(user string, args url.Values) string {
+	entries := s.myListEntries(user, args)
+	if len(entries) == 0 {
+		return codeResponse(anidb.NO_SUCH_ENTRY)
+	}
+	return codeResponse(anidb.MYLIST) + "\n" + entries[0].row()
+}
+
+// myListStats answers MYLISTSTATS with the counts of the user's MyList;
+// the other statistics are zero.
+func (s *Server) myListStats(user string) string {
+	anime := make(map[string]bool)
+	episodes := make(map[string]bool)
+	viewed := 0
+	for _, e := range s.mylists[user] {
+		anime[e.file.Fields["aid"]] = true
+		episodes[e.file.Fields["eid"]] = true
+		if e.viewDate != 0 {
+			viewed++
+		}
+	}
+	n := len(s.mylists[user])
+	stats := []int{len(anime), len(episodes), n, 0, len(anime), len(episodes), n, 0, 0, 0, 0, 0, 0, viewed, 0, 0, 0}
+	if n > 0 {
+		stats[12] = viewed * 100 / n
+	}
+	fields := make([]string, len(stats))
+	for i, v := range stats {
+		fields[i] = strconv.Itoa(v)
+	}
+	return codeResponse(anidb.MYLIST_STATS) + "\n" + strings.Join(fields, "|")
+}
@@ -0,0 +1,482 @@
+// Package anidbtest provides a fake AniDB UDP API server for tests and
+// offline development.
+package anidbtest
+
+import (
+	"bytes"
+	"cmp"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	mrand "math/rand/v2"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yureien/anihash/anidb"
+)
+
+// A Server is a fake AniDB UDP API server.
+// It supports the AUTH, LOGOUT, ENCRYPT, ENCODING, PING, UPTIME, FILE,
+// ANIME, MYLIST, MYLISTADD, MYLISTDEL and MYLISTSTATS commands with canned data from
+// [Fixtures]. MyLists start empty.
+// Only the UTF-8 encoding is supported.
+// Other commands are answered with UNKNOWN_COMMAND.
+type Server struct {
+	pc      net.PacketConn
+	logger  *slog.Logger
+	started time.Time
+	wg      sync.WaitGroup
+
+	mu       sync.Mutex
+	fixtures *Fixtures
+	faults   Faults
+	// sessions maps session keys to user names.
+	sessions map[string]string
+	// blocks holds the encryption of each client address.
+	blocks map[string]cipher.Block
+	// mylists holds the MyList of each user.
+	mylists    map[string][]*myListEntry
+	lastListID int
+	requests   []string
+}
+
+// NewServer starts a fake AniDB server listening on addr, such as
+// "127.0.0.1:0" for a random port.
+func NewServer(addr string, f *Fixtures, l *slog.Logger) (*Server, error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("anidbtest NewServer: %w", err)
+	}
+	s := &Server{
+		pc:       pc,
+		logger:   l.With("component", "anidbtest"),
+		started:  time.Now(),
+		fixtures: f,
+		faults:   f.Faults,
+		sessions: make(map[string]string),
+		blocks:   make(map[string]cipher.Block),
+		mylists:  make(map[string][]*myListEntry),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the address the server is listening on.
+func (s *Server) Addr() string {
+	return s.pc.LocalAddr().String()
+}
+
+// Close stops the server.
+func (s *Server) Close() {
+	_ = s.pc.Close()
+	s.wg.Wait()
+}
+
+// SetFaults sets the failures injected for future requests.
+func (s *Server) SetFaults(f Faults) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = f
+}
+
+// Requests returns the commands received so far, in order.
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	buf := make([]byte, 1400)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.logger.Error("failed to read request", "error", err)
+			}
+			return
+		}
+		resp, delay, ok := s.handlePacket(addr, bytes.Clone(buf[:n]))
+		if !ok {
+			continue
+		}
+		if delay == 0 {
+			s.write(resp, addr)
+			continue
+		}
+		s.wg.Add(1)
+		time.AfterFunc(delay, func() {
+			defer s.wg.Done()
+			s.write(resp, addr)
+		})
+	}
+}
+
+func (s *Server) write(resp []byte, addr net.Addr) {
+	if _, err := s.pc.WriteTo(resp, addr); err != nil && !errors.Is(err, net.ErrClosed) {
+		s.logger.Error("failed to write response", "error", err)
+	}
+}
+
+// handlePacket returns the encoded response to a request packet, the
+// delay before sending it and whether to send it at all.
+func (s *Server) handlePacket(addr net.Addr, data []byte) ([]byte, time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	block := s.blocks[addr.String()]
+	req := string(data)
+	if block != nil {
+		if plain, err := decrypt(block, bytes.Clone(data)); err == nil {
+			req = string(plain)
+		}
+	}
+	cmd, query, _ := strings.Cut(req, " ")
+	args, err := url.ParseQuery(query)
+	if err != nil {
+		s.logger.Warn("invalid request", "request", req, "error", err)
+		return nil, 0, false
+	}
+	s.requests = append(s.requests, cmd)
+	if s.faults.DropRate > 0 && mrand.Float64() < s.faults.DropRate {
+		return nil, 0, false
+	}
+
+	var resp string
+	if code, ok := s.faults.Codes[cmd]; ok {
+		resp = codeResponse(code)
+	} else {
+		resp = s.handle(addr, cmd, args)
+	}
+	out := []byte(resp)
+	if tag := args.Get("tag"); tag != "" {
+		out = []byte(tag + " " + resp)
+	}
+	if s.faults.Compress {
+		out = compress(out)
+	}
+	// ENCRYPT is answered in plain text. Other responses use the
+	// encryption in effect when the request arrived, so LOGOUT is
+	// still answered encrypted.
+	if block != nil && cmd != "ENCRYPT" {
+		out = encrypt(block, out)
+	}
+	return out, s.faults.Delay, true
+}
+
+// handle answers a request.
+// s.mu must be held.
+func (s *Server) handle(addr net.Addr, cmd string, args url.Values) string {
+	switch cmd {
+	case "PING":
+		if args.Get("nat") == "1" {
+			_, port, _ := net.SplitHostPort(addr.String())
+			return "300 PONG\n" + port
+		}
+		return "300 PONG"
+	case "ENCRYPT":
+		return s.encrypt(addr, args)
+	case "AUTH":
+		return s.auth(addr, args)
+	case "ENCODING":
+		// Fixtures are UTF-8, so only UTF-8 is supported.
+		switch strings.ToUpper(args.Get("name")) {
+		case "UTF8", "UTF-8":
+			return codeResponse(anidb.ENCODING_CHANGED)
+		default:
+			return codeResponse(anidb.ENCODING_NOT_SUPPORTED)
+		}
+	}
+
+	user, code := s.session(args)
+	if code != 0 {
+		return codeResponse(code)
+	}
+	switch cmd {
+	case "LOGOUT":
+		for key, u := range s.sessions {
+			if u == user && key == args.Get("s") {
+				delete(s.sessions, key)
+			}
+		}
+		delete(s.blocks, addr.String())
+		return "203 LOGGED OUT"
+	case "UPTIME":
+		return fmt.Sprintf("208 UPTIME\n%d", time.Since(s.started).Milliseconds())
+	case "FILE":
+		return s.file(args)
+	case "ANIME":
+		return s.anime(args)
+	case "UPDATED":
+		return s.updated(args)
+	case "MYLISTADD":
+		return s.myListAdd(user, args)
+	case "MYLISTDEL":
+		return s.myListDel(user, args)
+	case "MYLIST":
+		return s.myList(user, args)
+	case "MYLISTSTATS":
+		return s.myListStats(user)
+	default:
+		return codeResponse(anidb.UNKNOWN_COMMAND)
+	}
+}
+
+func (s *Server) user(name string) (User, bool) {
+	for _, u := range s.fixtures.Users {
+		if u.Name == name {
+			return u, true
+		}
+	}
+	return User{}, false
+}
+
+func (s *Server) encrypt(addr net.Addr, args url.Values) string {
+	if args.Get("type") != "1" {
+		return codeResponse(anidb.NO_SUCH_ENCRYPTION_TYPE)
+	}
+	u, ok := s.user(args.Get("user"))
+	if !ok || u.APIKey == "" {
+		return codeResponse(anidb.API_PASSWORD_NOT_DEFINED)
+	}
+	salt := randomString(8)
+	sum := md5.Sum([]byte(u.APIKey + salt))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		panic(err)
+	}
+	s.blocks[addr.String()] = block
+	return fmt.Sprintf("209 %s ENCRYPTION ENABLED", salt)
+}
+
+func (s *Server) auth(addr net.Addr, args url.Values) string {
+	u, ok := s.user(args.Get("user"))
+	if !ok || u.Password != args.Get("pass") {
+		return codeResponse(anidb.LOGIN_FAILED)
+	}
+	key := randomString(5)
+	s.sessions[key] = u.Name
+	if args.Get("nat") == "1" {
+		return fmt.Sprintf("200 %s %s LOGIN ACCEPTED", key, addr)
+	}
+	return fmt.Sprintf("200 %s LOGIN ACCEPTED", key)
+}
+
+// session returns the user of the request's session, or the return
+// code for a missing or invalid session.
+func (s *Server) session(args url.Values) (string, anidb.ReturnCode) {
+	key := args.Get("s")
+	if key == "" {
+		return "", anidb.LOGIN_FIRST
+	}
+	user, ok := s.sessions[key]
+	if !ok {
+		return "", anidb.INVALID_SESSION
+	}
+	return user, 0
+}
+
+func (s *Server) file(args url.Values) string {
+	var fmask anidb.FileFmask
+	var amask anidb.FileAmask
+	if !parseMask(fmask[:], args.Get("fmask")) || !parseMask(amask[:], args.Get("amask")) {
+		return codeResponse(anidb.ILLEGAL_INPUT_OR_ACCESS_DENIED)
+	}
+
+	var matches []Record
+	for _, r := range s.fixtures.Files {
+		switch {
+		case args.Has("fid"):
+			if strconv.FormatUint(uint64(r.ID), 10) == args.Get("fid") {
+				matches = append(matches, r)
+			}
+		case args.Has("ed2k"):
+			if r.Fields["size"] == args.Get("size") && r.Fields["ed2k"] == args.Get("ed2k") {
+				matches = append(matches, r)
+			}
+		case args.Has("aid"):
+			if r.Fields["aid"] == args.Get("aid") && r.Fields["gid"] == args.Get("gid") && r.Fields["epno"] == args.Get("epno") {
+				matches = append(matches, r)
+			}
+		default:
+			return codeResponse(anidb.ILLEGAL_INPUT_OR_ACCESS_DENIED)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return codeResponse(anidb.NO_SUCH_FILE)
+	case 1:
+		row := []string{strconv.FormatUint(uint64(matches[0].ID), 10)}
+		row = append(row, fieldValues(matches[0], fmask.Fields())...)
+		row = append(row, fieldValues(matches[0], amask.Fields())...)
+		return "220 FILE\n" + strings.Join(row, "|")
+	default:
+		fids := make([]string, len(matches))
+		for i, r := range matches {
+			fids[i] = strconv.FormatUint(uint64(r.ID), 10)
+		}
+		return "322 MULTIPLE FILES FOUND\n" + strings.Join(fids, "|")
+	}
+}
+
+func (s *Server) anime(args url.Values) string {
+	var amask anidb.AnimeAmask
+	if !parseMask(amask[:], args.Get("amask")) {
+		return codeResponse(anidb.ILLEGAL_INPUT_OR_ACCESS_DENIED)
+	}
+	for _, r := range s.fixtures.Anime {
+		if strconv.FormatUint(uint64(r.ID), 10) != args.Get("aid") {
+			continue
+		}
+		if _, ok := r.Fields["aid"]; !ok {
+			r.Fields = mapWith(r.Fields, "aid", args.Get("aid"))
+		}
+		return "230 ANIME\n" + strings.Join(fieldValues(r, amask.Fields()), "|")
+	}
+	return codeResponse(anidb.NO_SUCH_ANIME)
+}
+
+// updated lists the anime whose record update date, from the anime
+// or file fixtures, is not before the requested time.
+func (s *Server) updated(args url.Values) string {
+	if args.Get("entity") != "1" {
+		return codeResponse(anidb.ILLEGAL_INPUT_OR_ACCESS_DENIED)
+	}
+	since, err := strconv.ParseInt(args.Get("time"), 10, 64)
+	if err != nil {
+		return codeResponse(anidb.ILLEGAL_INPUT_OR_ACCESS_DENIED)
+	}
+	updated := make(map[string]int64)
+	add := func(aid, date string) {
+		d, err := strconv.ParseInt(date, 10, 64)
+		if err != nil || d < since || aid == "" {
+			return
+		}
+		updated[aid] = max(updated[aid], d)
+	}
+	for _, r := range s.fixtures.Anime {
+		add(strconv.FormatUint(uint64(r.ID), 10), r.Fields["date record updated"])
+	}
+	for _, r := range s.fixtures.Files {
+		add(r.Fields["aid"], r.Fields["date aid record updated"])
+	}
+	if len(updated) == 0 {
+		return codeResponse(anidb.NO_SUCH_UPDATES)
+	}
+	var aids []string
+	var last int64
+	for aid, d := range updated {
+		aids = append(aids, aid)
+		last = max(last, d)
+	}
+	slices.SortFunc(aids, func(a, b string) int {
+		return cmp.Or(cmp.Compare(len(a), len(b)), strings.Compare(a, b))
+	})
+	return fmt.Sprintf("243 UPDATED\n1|%d|%d|%s", len(aids), last, strings.Join(aids, ","))
+}
+
+// fieldValues returns the escaped values of the named fields of r.
+func fieldValues(r Record, names []string) []string {
+	values := make([]string, len(names))
+	for i, name := range names {
+		v := r.Fields[name]
+		v = strings.ReplaceAll(v, "|", "/")
+		v = strings.ReplaceAll(v, "\n", "<br />")
+		values[i] = v
+	}
+	return values
+}
+
+func mapWith(m map[string]string, k, v string) map[string]string {
+	m2 := make(map[string]string, len(m)+1)
+	for k, v := range m {
+		m2[k] = v
+	}
+	m2[k] = v
+	return m2
+}
+
+// parseMask decodes a hex mask into m.
+func parseMask(m []byte, s string) bool {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) > len(m) {
+		return false
+	}
+	copy(m, b)
+	return true
+}
+
+// codeResponse returns a response with only a return code, such as
+// "602 SERVER BUSY".
+func codeResponse(c anidb.ReturnCode) string {
+	return fmt.Sprintf("%d %s", int(c), strings.ReplaceAll(c.String(), "_", " "))
+}
+
+func randomString(n int) string {
+	const chars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	for i := range b {
+		b[i] = chars[int(b[i])%len(chars)]
+	}
+	return string(b)
+}
+
+// compress compresses a response like AniDB does, with two zero bytes
+// followed by DEFLATE data.
+func compress(b []byte) []byte {
+	var buf bytes.Buffer
+	buf.Write([]byte{0, 0})
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		panic(err)
+	}
+	if _, err := w.Write(b); err != nil {
+		panic(err)
+	}
+	if err := w.Close(); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+// encrypt encrypts with AES in ECB mode and PKCS#5 padding, like
+// AniDB.
+func encrypt(c cipher.Block, b []byte) []byte {
+	bs := c.BlockSize()
+	gap := bs - len(b)%bs
+	b = append(b, bytes.Repeat([]byte{byte(gap)}, gap)...)
+	for i := 0; i < len(b); i += bs {
+		c.Encrypt(b[i:], b[i:])
+	}
+	return b
+}
+
+func decrypt(c cipher.Block, b []byte) ([]byte, error) {
+	bs := c.BlockSize()
+	if len(b) == 0 || len(b)%bs != 0 {
+		return nil, errors.New("incomplete blocks")
+	}
+	for i := 0; i < len(b); i += bs {
+		c.Decrypt(b[i:], b[i:])
+	}
+	pad := int(b[len(b)-1])
+	if pad == 0 || pad > bs {
+		return nil, errors.New("invalid padding")
+	}
+	return b[:len(b)-pad], nil
+}
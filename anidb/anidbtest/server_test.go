@@ -0,0 +1,219 @@
+package anidbtest
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/yureien/anihash/anidb"
+)
+
+func TestServer_file(t *testing.T) {
+	t.Parallel()
+	ctx := testContext(t)
+	s := newTestServer(t)
+	c := newTestClient(t, s, anidb.UserInfo{UserName: "test", UserPassword: "test"})
+	got, err := c.FileByHash(ctx, 734003200, "0123456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.FileID != 12345 || got.GroupName != "Frostii" || got.EpNum != "01" {
+		t.Errorf("Got file %+v", got)
+	}
+	wantTracks := []anidb.AudioTrack{
+		{Codec: "AAC", Bitrate: 128, Language: "japanese"},
+		{Codec: "AC3", Bitrate: 384, Language: "english"},
+	}
+	if !reflect.DeepEqual(got.AudioTracks, wantTracks) {
+		t.Errorf("Got audio tracks %+v; want %+v", got.AudioTracks, wantTracks)
+	}
+}
+
+func TestServer_multipleFiles(t *testing.T) {
+	t.Parallel()
+	ctx := testContext(t)
+	s := newTestServer(t)
+	c := newTestClient(t, s, anidb.UserInfo{UserName: "test", UserPassword: "test"})
+	_, err := c.FileByEpisode(ctx, 1, 7, "02")
+	var multiErr *anidb.MultipleFilesError
+	if !errors.As(err, &multiErr) {
+		t.Fatalf("Got error %v; want MultipleFilesError", err)
+	}
+	if want := []uint32{12346, 12347}; !reflect.DeepEqual(multiErr.FileIDs, want) {
+		t.Errorf("Got file IDs %v; want %v", multiErr.FileIDs, want)
+	}
+}
+
+func TestServer_encryptedCompressedAnime(t *testing.T) {
+	t.Parallel()
+	ctx := testContext(t)
+	s := newTestServer(t)
+	s.SetFaults(Faults{Compress: true})
+	c := newTestClient(t, s, anidb.UserInfo{UserName: "secure", UserPassword: "secure", APIKey: "hunter2"})
+	got, err := c.Anime(ctx, 1, anidb.DefaultAnimeAmask)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.AnimeID != 1 || got.RomajiName != "Seikai no Monshou" || got.Rating != 853 {
+		t.Errorf("Got anime %+v", got)
+	}
+	if want := []string{"ENCRYPT", "AUTH", "ANIME"}; !reflect.DeepEqual(s.Requests(), want) {
+		t.Errorf("Got requests %q; want %q", s.Requests(), want)
+	}
+}
+
+func TestServer_myList(t *testing.T) {
+	t.Parallel()
+	ctx := testContext(t)
+	s := newTestServer(t)
+	c := newTestClient(t, s, anidb.UserInfo{UserName: "test", UserPassword: "test"})
+	fields := anidb.MyListFields{State: anidb.MyListStateInternal, Storage: "nas"}
+	lid, err := c.MyListAdd(ctx, anidb.MyListKey{Size: 734003200, Ed2K: "0123456789abcdef0123456789abcdef"}, fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.MyListAdd(ctx, anidb.MyListKey{FileID: 12345}, fields)
+	var exists *anidb.MyListExistsError
+	if !errors.As(err, &exists) {
+		t.Fatalf("Got error %v; want MyListExistsError", err)
+	}
+	if e := exists.Entry; e.ListID != lid || e.FileID != 12345 || e.AnimeID != 1 || e.State != anidb.MyListStateInternal || e.Storage != "nas" {
+		t.Errorf("Got entry %+v", e)
+	}
+	if n, err := c.MyListEdit(ctx, anidb.MyListKey{ListID: lid}, anidb.MyListFields{Other: "note"}); err != nil || n != 1 {
+		t.Errorf("Got edit %d, %v; want 1 entry edited", n, err)
+	}
+	viewed := true
+	if _, err := c.MyListEdit(ctx, anidb.MyListKey{FileID: 12345}, anidb.MyListFields{Viewed: &viewed}); err != nil {
+		t.Fatal(err)
+	}
+	e, err := c.MyList(ctx, anidb.MyListKey{ListID: lid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !e.Viewed() || e.Other != "note" {
+		t.Errorf("Got entry %+v; want viewed with other note", e)
+	}
+	stats, err := c.MyListStats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Files != 1 || stats.ViewedEpisodes != 1 {
+		t.Errorf("Got stats %+v; want 1 viewed file", stats)
+	}
+	if n, err := c.MyListDel(ctx, anidb.MyListKey{FileID: 12345}); err != nil || n != 1 {
+		t.Errorf("Got delete %d, %v; want 1 entry deleted", n, err)
+	}
+	if _, err := c.MyListDel(ctx, anidb.MyListKey{ListID: lid}); !errors.Is(err, anidb.NO_SUCH_MYLIST_ENTRY) {
+		t.Errorf("Got error %v; want %v", err, anidb.NO_SUCH_MYLIST_ENTRY)
+	}
+	if _, err := c.MyListAdd(ctx, anidb.MyListKey{FileID: 1}, fields); !errors.Is(err, anidb.NO_SUCH_FILE) {
+		t.Errorf("Got error %v; want %v", err, anidb.NO_SUCH_FILE)
+	}
+}
+
+func TestServer_updated(t *testing.T) {
+	t.Parallel()
+	ctx := testContext(t)
+	s := newTestServer(t)
+	c := newTestClient(t, s, anidb.UserInfo{UserName: "test", UserPassword: "test"})
+	got, err := c.Updated(ctx, time.Unix(1600000000, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := anidb.Updated{
+		Count:      1,
+		LastUpdate: time.Unix(1700000000, 0).UTC(),
+		AnimeIDs:   []uint32{1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+	}
+
+	got, err = c.Updated(ctx, time.Unix(1700000001, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, anidb.Updated{}) {
+		t.Errorf("Got %+v; want no updates", got)
+	}
+}
+
+func TestServer_faults(t *testing.T) {
+	t.Parallel()
+	ctx := testContext(t)
+	s := newTestServer(t)
+	c := newTestClient(t, s, anidb.UserInfo{UserName: "test", UserPassword: "test"})
+	s.SetFaults(Faults{Codes: map[string]anidb.ReturnCode{"FILE": anidb.SERVER_BUSY}})
+	if _, err := c.FileByID(ctx, 12345); !errors.Is(err, anidb.SERVER_BUSY) {
+		t.Errorf("Got error %v; want %v", err, anidb.SERVER_BUSY)
+	}
+	s.SetFaults(Faults{DropRate: 1})
+	if _, err := c.FileByID(ctx, 12345); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Got error %v; want %v", err, context.DeadlineExceeded)
+	}
+	if n := len(slices.DeleteFunc(s.Requests(), func(cmd string) bool { return cmd != "FILE" })); n != 2 {
+		t.Errorf("Got %d FILE requests; want 2", n)
+	}
+}
+
+func TestServer_loginFailed(t *testing.T) {
+	t.Parallel()
+	s := newTestServer(t)
+	cfg := anidb.AniDBConfig{Address: s.Addr(), User: "test", Password: "wrong", KeepaliveInterval: -1}
+	if _, _, err := anidb.NewAuthenticatedClient(nullLogger, &cfg, nil); !errors.Is(err, anidb.LOGIN_FAILED) {
+		t.Errorf("Got error %v; want %v", err, anidb.LOGIN_FAILED)
+	}
+}
+
+var nullLogger = slog.New(slog.DiscardHandler)
+
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	f, err := LoadFixtures("testdata/fixtures.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer("127.0.0.1:0", f, nullLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+// newTestClient returns a client logged in to s.
+// Requests are not retried and time out quickly.
+func newTestClient(t *testing.T, s *Server, u anidb.UserInfo) *anidb.Client {
+	t.Helper()
+	cfg := anidb.AniDBConfig{
+		Address:           s.Addr(),
+		User:              u.UserName,
+		Password:          u.UserPassword,
+		APIKey:            u.APIKey,
+		Timeout:           200 * time.Millisecond,
+		Retries:           -1,
+		KeepaliveInterval: -1,
+		RateLimit: anidb.RateLimitConfig{
+			ShortInterval: time.Millisecond,
+			LongInterval:  time.Millisecond,
+			LongBurst:     1,
+		},
+	}
+	c, _, err := anidb.NewAuthenticatedClient(nullLogger, &cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cf := context.WithTimeout(context.Background(), 30*time.Second)
+	t.Cleanup(cf)
+	return ctx
+}
@@ -0,0 +1,197 @@
+package anidb
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// An Anime is the data returned by the ANIME command.
+// Fields not requested in the mask are left as zero values.
+type Anime struct {
+	AnimeID   uint32
+	DateFlags int
+	Year      string
+	Type      string
+
+	Related []RelatedAnime
+
+	RomajiName  string
+	KanjiName   string
+	EnglishName string
+	OtherName   string
+	ShortNames  []string
+	Synonyms    []string
+
+	Episodes        int
+	HighestEpisode  int
+	SpecialEpisodes int
+	AirDate         time.Time
+	EndDate         time.Time
+	URL             string
+	Picname         string
+
+	// Ratings are multiplied by 100, so 853 is a rating of 8.53.
+	Rating        int
+	VoteCount     int
+	TempRating    int
+	TempVoteCount int
+	ReviewRating  int
+	ReviewCount   int
+	Restricted    bool
+	RecordUpdated time.Time
+	SpecialsCount int
+	CreditsCount  int
+	OtherCount    int
+	TrailerCount  int
+	ParodyCount   int
+}
+
+// DefaultAnimeAmask requests the anime data that anihash caches.
+var DefaultAnimeAmask = func() AnimeAmask {
+	var m AnimeAmask
+	m.Set("aid", "dateflags", "year", "type", "related aid list", "related aid type",
+		"romaji name", "kanji name", "english name", "other name", "short name list", "synonym list",
+		"episodes", "highest episode number", "special ep count", "air date", "end date", "url", "picname",
+		"rating", "vote count", "temp rating", "temp vote count", "average review rating", "review count", "is 18+ restricted",
+		"date record updated",
+		"specials count", "credits count", "other count", "trailer count", "parody count")
+	return m
+}()
+
+// Anime calls the ANIME command by anime ID.
+// The returned error wraps a [ReturnCode] if applicable, such as
+// [NO_SUCH_ANIME].
+func (c *Client) Anime(ctx context.Context, aid uint32, mask AnimeAmask) (Anime, error) {
+	v := make(url.Values)
+	v.Set("aid", strconv.FormatUint(uint64(aid), 10))
+	v.Set("amask", formatMask(mask[:]))
+	resp, err := c.sessionRequest(ctx, "ANIME", v)
+	if err != nil {
+		return Anime{}, fmt.Errorf("udpapi Anime: %w", err)
+	}
+	if resp.Code != ANIME {
+		return Anime{}, fmt.Errorf("udpapi Anime: got bad return code %w", resp.Code)
+	}
+	if n := len(resp.Rows); n != 1 {
+		return Anime{}, fmt.Errorf("udpapi Anime: got unexpected number of rows %d", n)
+	}
+	values, err := decodeMaskFields(resp.Rows[0], mask[:], AnimeAmaskFields)
+	if err != nil {
+		return Anime{}, fmt.Errorf("udpapi Anime: %s", err)
+	}
+	a := newAnime(values)
+	if a.AnimeID == 0 {
+		a.AnimeID = aid
+	}
+	return a, nil
+}
+
+func newAnime(v fieldValues) Anime {
+	a := Anime{
+		AnimeID:   uint32(v.int("aid")),
+		DateFlags: int(v.int("dateflags")),
+		Year:      v.str("year"),
+		Type:      v.str("type"),
+
+		RomajiName:  v.str("romaji name"),
+		KanjiName:   v.str("kanji name"),
+		EnglishName: v.str("english name"),
+		OtherName:   v.str("other name"),
+		ShortNames:  v.strs("short name list"),
+		Synonyms:    v.strs("synonym list"),
+
+		Episodes:        int(v.int("episodes")),
+		HighestEpisode:  int(v.int("highest episode number")),
+		SpecialEpisodes: int(v.int("special ep count")),
+		AirDate:         v.date("air date"),
+		EndDate:         v.date("end date"),
+		URL:             v.str("url"),
+		Picname:         v.str("picname"),
+
+		Rating:        int(v.int("rating")),
+		VoteCount:     int(v.int("vote count")),
+		TempRating:    int(v.int("temp rating")),
+		TempVoteCount: int(v.int("temp vote count")),
+		ReviewRating:  int(v.int("average review rating")),
+		ReviewCount:   int(v.int("review count")),
+		Restricted:    v.bool("is 18+ restricted"),
+		RecordUpdated: v.date("date record updated"),
+		SpecialsCount: int(v.int("specials count")),
+		CreditsCount:  int(v.int("credits count")),
+		OtherCount:    int(v.int("other count")),
+		TrailerCount:  int(v.int("trailer count")),
+		ParodyCount:   int(v.int("parody count")),
+	}
+	a.Related = relatedAnime(v)
+	return a
+}
+
+// relatedAnime decodes the related aid list and type fields.
+func relatedAnime(v fieldValues) []RelatedAnime {
+	var related []RelatedAnime
+	types := v.ints("related aid type")
+	for i, id := range v.ints("related aid list") {
+		r := RelatedAnime{AnimeID: uint32(id)}
+		if i < len(types) {
+			r.Relation = Relation(types[i])
+		}
+		related = append(related, r)
+	}
+	return related
+}
+
+// A RelatedAnime is an anime related to another anime.
+type RelatedAnime struct {
+	AnimeID  uint32
+	Relation Relation
+}
+
+// A Relation is the type of relation between two anime.
+type Relation int
+
+const (
+	RelationSequel             Relation = 1
+	RelationPrequel            Relation = 2
+	RelationSameSetting        Relation = 11
+	RelationAlternativeSetting Relation = 12
+	RelationAlternativeVersion Relation = 32
+	RelationMusicVideo         Relation = 41
+	RelationCharacter          Relation = 42
+	RelationSideStory          Relation = 51
+	RelationParentStory        Relation = 52
+	RelationSummary            Relation = 61
+	RelationFullStory          Relation = 62
+	RelationOther              Relation = 100
+)
+
+func (r Relation) String() string {
+	switch r {
+	case RelationSequel:
+		return "sequel"
+	case RelationPrequel:
+		return "prequel"
+	case RelationSameSetting:
+		return "same setting"
+	case RelationAlternativeSetting:
+		return "alternative setting"
+	case RelationAlternativeVersion:
+		return "alternative version"
+	case RelationMusicVideo:
+		return "music video"
+	case RelationCharacter:
+		return "character"
+	case RelationSideStory:
+		return "side story"
+	case RelationParentStory:
+		return "parent story"
+	case RelationSummary:
+		return "summary"
+	case RelationFullStory:
+		return "full story"
+	default:
+		return "other"
+	}
+}
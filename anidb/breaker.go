@@ -0,0 +1,179 @@
+package anidb
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBanBackoff = 30 * time.Minute
+	maxBanBackoff     = 24 * time.Hour
+
+	breakerStateKey = "anidb.breaker"
+)
+
+// A StateStore persists client state across restarts.
+type StateStore interface {
+	// LoadState returns the value saved for key.
+	// It returns nil and no error if nothing was saved.
+	LoadState(key string) ([]byte, error)
+	// SaveState saves the value for key.
+	SaveState(key string, value []byte) error
+}
+
+// A BreakerState describes the state of the client circuit breaker,
+// which stops all requests after AniDB bans the client.
+type BreakerState struct {
+	// Until is when requests are allowed again.
+	// The breaker is tripped if Until is in the future.
+	Until time.Time `json:"until"`
+	// Code is the return code that tripped the breaker.
+	Code ReturnCode `json:"code"`
+	// Reason is the reason given by AniDB, if any.
+	Reason string `json:"reason"`
+	// Trips is the number of consecutive trips, used to increase
+	// the backoff for repeated bans.
+	Trips int `json:"trips"`
+}
+
+// Tripped reports whether requests are blocked at time now.
+func (s BreakerState) Tripped(now time.Time) bool {
+	return now.Before(s.Until)
+}
+
+// A BannedError is returned for requests refused by the client
+// because the circuit breaker is tripped.
+// It wraps the [ReturnCode] that tripped the breaker.
+type BannedError struct {
+	State BreakerState
+}
+
+func (e *BannedError) Error() string {
+	msg := fmt.Sprintf("anidb requests paused until %s after %s", e.State.Until.Format(time.RFC3339), e.State.Code)
+	if e.State.Reason != "" {
+		msg += ": " + e.State.Reason
+	}
+	return msg
+}
+
+func (e *BannedError) Unwrap() error {
+	return e.State.Code
+}
+
+// isBanCode reports whether c means that the client must stop sending
+// requests for a while.
+func isBanCode(c ReturnCode) bool {
+	switch c {
+	case BANNED, CLIENT_BANNED, API_VIOLATION:
+		return true
+	default:
+		return false
+	}
+}
+
+// A breaker is a circuit breaker that blocks all requests for a
+// backoff period after a ban.
+// This is concurrent safe.
+type breaker struct {
+	mu      sync.Mutex
+	state   BreakerState
+	backoff time.Duration
+	store   StateStore // may be nil
+	logger  *slog.Logger
+}
+
+func newBreaker(l *slog.Logger) *breaker {
+	return &breaker{
+		backoff: defaultBanBackoff,
+		logger:  l,
+	}
+}
+
+// load restores the state saved in store, and saves future state to it.
+func (b *breaker) load(store StateStore) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.store = store
+	data, err := store.LoadState(breakerStateKey)
+	if err != nil {
+		return fmt.Errorf("load breaker state: %w", err)
+	}
+	if data == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, &b.state); err != nil {
+		return fmt.Errorf("load breaker state: %w", err)
+	}
+	return nil
+}
+
+// get returns the current state.
+func (b *breaker) get() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// check returns a [*BannedError] if requests are blocked.
+func (b *breaker) check() error {
+	s := b.get()
+	if s.Tripped(time.Now()) {
+		return &BannedError{State: s}
+	}
+	return nil
+}
+
+// observe updates the breaker with the response to a request.
+func (b *breaker) observe(resp Response) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !isBanCode(resp.Code) {
+		if b.state.Trips > 0 && !b.state.Tripped(time.Now()) {
+			b.state = BreakerState{}
+			b.save()
+		}
+		return
+	}
+	d := b.backoff
+	for i := 0; i < b.state.Trips && d < maxBanBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, maxBanBackoff)
+	b.state = BreakerState{
+		Until:  time.Now().Add(d),
+		Code:   resp.Code,
+		Reason: banReason(resp),
+		Trips:  b.state.Trips + 1,
+	}
+	b.logger.Error("anidb refused requests, pausing all requests",
+		"code", resp.Code,
+		"reason", b.state.Reason,
+		"until", b.state.Until)
+	b.save()
+}
+
+// save saves the state to the store.
+// The caller must hold the lock.
+func (b *breaker) save() {
+	if b.store == nil {
+		return
+	}
+	data, err := json.Marshal(b.state)
+	if err == nil {
+		err = b.store.SaveState(breakerStateKey, data)
+	}
+	if err != nil {
+		b.logger.Error("failed to save breaker state", "error", err)
+	}
+}
+
+// banReason returns the reason for a ban response.
+func banReason(resp Response) string {
+	if len(resp.Rows) > 0 && len(resp.Rows[0]) > 0 {
+		return resp.Rows[0][0]
+	}
+	return resp.Header
+}
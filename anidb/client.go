@@ -9,8 +9,11 @@ import (
 	"log/slog"
 	"net"
 	"net/url"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
@@ -22,18 +25,38 @@ const (
 // A Client is an AniDB UDP API client.
 //
 // The client handles rate limiting.
-// The client does not handle retries.
-// The client does not handle keepalive.
+// Requests are scheduled by the [Priority] set with [WithPriority].
+// The client logs in again when the server reports that the session
+// has expired.
+// The client retries requests that fail with transient errors,
+// see [RetryPolicy].
+// The client does not handle keepalive unless [Client.StartMonitor]
+// is called.
 type Client struct {
 	conn    net.Conn
 	m       *Mux
 	limiter *limiter
+	breaker *breaker
 	logger  *slog.Logger
 
 	sessionKey syncVar[string]
+	user       syncVar[UserInfo]
+	// authMu serializes logins so that concurrent requests hitting an
+	// expired session only log in once.
+	authMu sync.Mutex
+	// natPort is the port of the client as seen by AniDB.
+	natPort syncVar[string]
+	// encoding is the session encoding requested on login.
+	encoding      syncVar[string]
+	lastResponse  syncVar[time.Time]
+	monitorStatus syncVar[SessionStatus]
+
+	fileFmask FileFmask
+	fileAmask FileAmask
 
 	ClientName    string
 	ClientVersion int32
+	Retry         RetryPolicy
 }
 
 // NewAuthenticatedClient creates a new authenticated AniDB client.
@@ -42,25 +65,96 @@ type Client struct {
 // The function to logout will return an error if the logout fails.
 // The client will be closed when the function to logout is called.
 // The client will be authenticated with the given configuration.
-// The client will be connected to the given address.
-func NewAuthenticatedClient(l *slog.Logger, cfg *AniDBConfig) (*Client, func() error, error) {
-	client, err := Dial(cfg.Address, l, clientName, clientVersion)
+// The client will be connected to the given address, unless
+// cfg.Replay is set.
+// The client state is persisted in store, which may be nil.
+// If the client is still banned from a previous run, the client logs
+// in once the ban is over.
+func NewAuthenticatedClient(l *slog.Logger, cfg *AniDBConfig, store StateStore) (*Client, func() error, error) {
+	client, err := dialConfig(l, cfg)
 	if err != nil {
-		client.Close()
 		return nil, nil, fmt.Errorf("udpapi NewAuthenticatedClient: %w", err)
 	}
+	var recording *os.File
+	if cfg.Record != "" {
+		recording, err = os.OpenFile(cfg.Record, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			client.Close()
+			return nil, nil, fmt.Errorf("udpapi NewAuthenticatedClient: %w", err)
+		}
+		l.Warn("recording anidb traffic", "path", cfg.Record)
+		client.m.SetRecorder(NewRecorder(recording))
+	}
+	closeClient := func() {
+		client.Close()
+		if recording != nil {
+			_ = recording.Close()
+		}
+	}
+	client.Retry = cfg.retryPolicy()
+	if cfg.Timeout > 0 {
+		client.m.SetTimeout(cfg.Timeout)
+	}
+	if cfg.BanBackoff > 0 {
+		client.breaker.backoff = cfg.BanBackoff
+	}
+	client.limiter = newLimiter(cfg.RateLimit, client.logger)
+	if cfg.BulkRateShare > 0 {
+		client.limiter.setBulkShare(cfg.BulkRateShare)
+	}
+	if cfg.Encoding != "" {
+		if _, err := lookupEncoding(cfg.Encoding); err != nil {
+			closeClient()
+			return nil, nil, fmt.Errorf("udpapi NewAuthenticatedClient: %w", err)
+		}
+		client.encoding.set(cfg.Encoding)
+	}
+	if len(cfg.FileFields) > 0 {
+		if err := client.SetFileFields(cfg.FileFields...); err != nil {
+			closeClient()
+			return nil, nil, fmt.Errorf("udpapi NewAuthenticatedClient: %w", err)
+		}
+	}
+	if store != nil {
+		if err := client.breaker.load(store); err != nil {
+			closeClient()
+			return nil, nil, fmt.Errorf("udpapi NewAuthenticatedClient: %w", err)
+		}
+		if err := client.limiter.load(store); err != nil {
+			closeClient()
+			return nil, nil, fmt.Errorf("udpapi NewAuthenticatedClient: %w", err)
+		}
+	}
 
-	_, err = client.Auth(context.Background(), UserInfo{
+	u := UserInfo{
 		UserName:     cfg.User,
 		UserPassword: cfg.Password,
-	})
-	if err != nil {
-		client.Close()
+		APIKey:       cfg.APIKey,
+	}
+	if cfg.Replay != "" {
+		// Recordings are decrypted.
+		u.APIKey = ""
+	}
+	if state := client.BreakerState(); state.Tripped(time.Now()) {
+		l.Warn("anidb client is banned, delaying login", "until", state.Until, "code", state.Code)
+		client.user.set(u)
+	} else if _, err := client.Auth(context.Background(), u); err != nil {
+		closeClient()
 		return nil, nil, fmt.Errorf("udpapi NewAuthenticatedClient: %w", err)
 	}
 
+	interval := cfg.KeepaliveInterval
+	if interval == 0 {
+		interval = DefaultKeepaliveInterval
+	}
+	stopMonitor := func() {}
+	if interval > 0 {
+		stopMonitor = client.StartMonitor(interval)
+	}
+
 	closeFunc := func() error {
-		defer client.Close()
+		defer closeClient()
+		stopMonitor()
 
 		err := client.Logout(context.Background())
 		if err != nil {
@@ -72,6 +166,25 @@ func NewAuthenticatedClient(l *slog.Logger, cfg *AniDBConfig) (*Client, func() e
 	return client, closeFunc, nil
 }
 
+// dialConfig returns a client for the configured address, or one
+// replaying the configured recording.
+func dialConfig(l *slog.Logger, cfg *AniDBConfig) (*Client, error) {
+	if cfg.Replay == "" {
+		return Dial(cfg.Address, l, clientName, clientVersion)
+	}
+	f, err := os.Open(cfg.Replay)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	exchanges, err := ReadExchanges(f)
+	if err != nil {
+		return nil, err
+	}
+	l.Warn("replaying recorded anidb traffic", "path", cfg.Replay, "exchanges", len(exchanges))
+	return DialReplay(exchanges, l, clientName, clientVersion), nil
+}
+
 // Dial connects to an AniDB UDP API server.
 // The caller should call [Client.SetLogger] as the client may produce
 // asynchronous errors.
@@ -80,16 +193,27 @@ func Dial(addr string, l *slog.Logger, name string, version int32) (*Client, err
 	if err != nil {
 		return nil, fmt.Errorf("udpapi NewClient: %w", err)
 	}
+	return newClient(conn, l, name, version), nil
+}
+
+// newClient returns a Client using conn.
+func newClient(conn net.Conn, l *slog.Logger, name string, version int32) *Client {
 	l = l.With("package", "go.felesatra.moe/anidb/udpapi", "component", "client")
 	c := &Client{
 		conn:          conn,
 		m:             NewMux(conn, l),
-		limiter:       newLimiter(),
+		limiter:       newLimiter(DefaultRateLimit, l),
+		breaker:       newBreaker(l),
 		logger:        l,
 		ClientName:    name,
 		ClientVersion: version,
+		Retry:         DefaultRetryPolicy,
+	}
+	if err := c.SetFileFields(DefaultFileFields...); err != nil {
+		panic(err)
 	}
-	return c, nil
+	c.encoding.set(DefaultEncoding)
+	return c
 }
 
 // LocalPort returns the local port for the client connection.
@@ -103,6 +227,25 @@ func (c *Client) LocalPort() string {
 	return port
 }
 
+// BreakerState returns the state of the circuit breaker, which stops
+// all requests for a while after AniDB bans the client.
+func (c *Client) BreakerState() BreakerState {
+	return c.breaker.get()
+}
+
+// LimiterStats returns a snapshot of the rate limiter state, for
+// metrics.
+func (c *Client) LimiterStats() LimiterStats {
+	return c.limiter.snapshot()
+}
+
+// BulkDelay returns how long a request with [PriorityBulk] would
+// currently wait for its share of the rate budget.
+// Schedulers can use this to serve other work in the meantime.
+func (c *Client) BulkDelay() time.Duration {
+	return c.limiter.bulkDelay()
+}
+
 // Close closes the Client.
 // This does not call LOGOUT, so you should try to LOGOUT first.
 // The underlying connection is closed.
@@ -120,20 +263,26 @@ type UserInfo struct {
 	APIKey       string // required for encryption, optional otherwise
 }
 
-// Encrypt calls the ENCRYPT command.
+// Encrypt calls the ENCRYPT command and enables encryption for
+// future requests and responses.
+// Encryption is negotiated in plain text, so any previous encryption
+// is disabled first.
+// The returned error wraps a [ReturnCode] if applicable, such as
+// [API_PASSWORD_NOT_DEFINED] or [NO_SUCH_ENCRYPTION_TYPE].
 func (c *Client) Encrypt(ctx context.Context, u UserInfo) error {
 	if u.APIKey == "" {
-		return errors.New("udpapi encrypt: APIKey required for encryption")
+		return errors.New("udpapi Encrypt: APIKey required for encryption")
 	}
+	c.m.SetBlock(nil)
 	v := url.Values{}
 	v.Set("user", u.UserName)
 	v.Set("type", "1")
 	resp, err := c.request(ctx, "ENCRYPT", v)
 	if err != nil {
-		return fmt.Errorf("udpapi Encrypt: %s", err)
+		return fmt.Errorf("udpapi Encrypt: %w", err)
 	}
 	switch resp.Code {
-	case 209:
+	case ENCRYPTION_ENABLED:
 		parts := strings.SplitN(resp.Header, " ", 2)
 		salt := parts[0]
 		sum := md5.Sum([]byte(u.APIKey + salt))
@@ -143,13 +292,24 @@ func (c *Client) Encrypt(ctx context.Context, u UserInfo) error {
 		}
 		c.m.SetBlock(b)
 		return nil
+	case API_PASSWORD_NOT_DEFINED:
+		return fmt.Errorf("udpapi Encrypt: no UDP API key set in the AniDB profile of %s: %w", u.UserName, resp.Code)
+	case NO_SUCH_ENCRYPTION_TYPE:
+		return fmt.Errorf("udpapi Encrypt: AES encryption not supported by the server: %w", resp.Code)
 	default:
-		return fmt.Errorf("udpapi Encrypt: bad code %d %q", resp.Code, resp.Header)
+		return fmt.Errorf("udpapi Encrypt: bad code %w %q", resp.Code, resp.Header)
 	}
 }
 
 // Auth calls the AUTH command.
+// If u has an APIKey, encryption is enabled with [Client.Encrypt]
+// first, so the password is not sent in plain text.
 func (c *Client) Auth(ctx context.Context, u UserInfo) (port string, _ error) {
+	if u.APIKey != "" {
+		if err := c.Encrypt(ctx, u); err != nil {
+			return "", fmt.Errorf("udpapi Auth: %w", err)
+		}
+	}
 	v := url.Values{}
 	v.Set("user", u.UserName)
 	v.Set("pass", u.UserPassword)
@@ -158,6 +318,12 @@ func (c *Client) Auth(ctx context.Context, u UserInfo) (port string, _ error) {
 	v.Set("clientver", strconv.Itoa(int(c.ClientVersion)))
 	v.Set("nat", "1")
 	v.Set("comp", "1")
+	enc := c.encoding.get()
+	e, err := lookupEncoding(enc)
+	if err != nil {
+		return "", fmt.Errorf("udpapi Auth: %w", err)
+	}
+	v.Set("enc", enc)
 	resp, err := c.request(ctx, "AUTH", v)
 	if err != nil {
 		return "", fmt.Errorf("udpapi Auth: %s", err)
@@ -172,9 +338,14 @@ func (c *Client) Auth(ctx context.Context, u UserInfo) (port string, _ error) {
 			return "", fmt.Errorf("udpapi Auth: invalid response header %q", resp.Header)
 		}
 		c.sessionKey.set(parts[0])
+		c.user.set(u)
+		c.m.SetEncoding(e)
+		if _, port, err := net.SplitHostPort(parts[1]); err == nil {
+			c.natPort.set(port)
+		}
 		return parts[1], nil
 	default:
-		return "", fmt.Errorf("udpapi Auth: bad code %d %q", resp.Code, resp.Header)
+		return "", fmt.Errorf("udpapi Auth: bad code %w %q", resp.Code, resp.Header)
 	}
 }
 
@@ -189,7 +360,9 @@ func (c *Client) Logout(ctx context.Context) error {
 		return fmt.Errorf("udpapi Logout: %s", err)
 	}
 	c.m.SetBlock(nil)
+	c.m.SetEncoding(nil)
 	c.sessionKey.set("")
+	c.user.set(UserInfo{})
 	switch resp.Code {
 	case 203:
 		return nil
@@ -198,129 +371,6 @@ func (c *Client) Logout(ctx context.Context) error {
 	}
 }
 
-func (c *Client) FileByHash(ctx context.Context, size int64, hash string) (File, error) {
-	// See https://wiki.anidb.net/UDP_API_Definition#FILE:_Retrieve_File_Data for more information
-	// _, aid, eid, gid, ___, state | size, ed2k, md5, sha1, crc, ___
-	// | quality, source, audio codec list, audio bitrate list, video codec, video bitrate, video resolution, extension
-	// | ________ | ________
-	fmask := FileFmask{0b0111_0001, 0b1111_1000, 0b1111_1111, 0b0000_0000, 0b0000_0000}
-	// __, year, type, ____ | romaji name, _, english name, _, ____
-	// | ep no, ep name, ep romaji name, __, ____ | group name, ___, ____
-	amask := FileAmask{0b0011_0000, 0b1010_0000, 0b1110_0000, 0b1000_0000}
-
-	data, err := c.fileByHash(ctx, size, hash, fmask, amask)
-	if err != nil {
-		return File{}, err
-	}
-
-	if len(data) != 26 {
-		return File{}, fmt.Errorf("expected 26 fields, got %d, raw: %v", len(data), data)
-	}
-
-	var file File
-	var n uint64
-	var i int64
-
-	// File ID is always present.
-	n, err = strconv.ParseUint(data[0], 10, 32)
-	if err != nil {
-		return File{}, fmt.Errorf("invalid file ID %q: %w", data[0], err)
-	}
-	file.FileID = uint32(n)
-
-	// FMASK data
-	n, err = strconv.ParseUint(data[1], 10, 32)
-	if err != nil {
-		return File{}, fmt.Errorf("invalid anime ID %q: %w", data[1], err)
-	}
-	file.AnimeID = uint32(n)
-
-	n, err = strconv.ParseUint(data[2], 10, 32)
-	if err != nil {
-		return File{}, fmt.Errorf("invalid episode ID %q: %w", data[2], err)
-	}
-	file.EpisodeID = uint32(n)
-
-	n, err = strconv.ParseUint(data[3], 10, 32)
-	if err != nil {
-		return File{}, fmt.Errorf("invalid group ID %q: %w", data[3], err)
-	}
-	file.GroupID = uint32(n)
-
-	n, err = strconv.ParseUint(data[4], 10, 16)
-	if err != nil {
-		return File{}, fmt.Errorf("invalid state %q: %w", data[4], err)
-	}
-	file.State = uint16(n)
-
-	i, err = strconv.ParseInt(data[5], 10, 64)
-	if err != nil {
-		return File{}, fmt.Errorf("invalid size %q: %w", data[5], err)
-	}
-	file.Size = int(i)
-
-	file.Ed2K = data[6]
-	file.MD5 = data[7]
-	file.SHA1 = data[8]
-	file.CRC = data[9]
-	file.Quality = data[10]
-	file.Source = data[11]
-	file.AudioCodec = data[12]
-
-	n, err = strconv.ParseUint(data[13], 10, 32)
-	if err != nil {
-		return File{}, fmt.Errorf("invalid audio bitrate %q: %w", data[13], err)
-	}
-	file.AudioBitrate = uint32(n)
-
-	file.VideoCodec = data[14]
-
-	n, err = strconv.ParseUint(data[15], 10, 32)
-	if err != nil {
-		return File{}, fmt.Errorf("invalid video bitrate %q: %w", data[15], err)
-	}
-	file.VideoBitrate = uint32(n)
-
-	file.VideoResolution = data[16]
-	file.Extension = data[17]
-
-	// AMASK data
-	file.Year = data[18]
-	file.Type = data[19]
-	file.RomajiName = data[20]
-	file.EnglishName = data[21]
-	file.EpNum = data[22]
-	file.EpName = data[23]
-	file.EpRomajiName = data[24]
-	file.GroupName = data[25]
-
-	return file, nil
-}
-
-// FileByHash calls the FILE command by size+ed2k hash.
-// The returned error wraps a [codes.ReturnCode] if applicable.
-func (c *Client) fileByHash(ctx context.Context, size int64, hash string, fmask FileFmask, amask FileAmask) ([]string, error) {
-	v, err := c.sessionValues()
-	if err != nil {
-		return nil, fmt.Errorf("udpapi FileByHash: %s", err)
-	}
-	v.Set("size", fmt.Sprintf("%d", size))
-	v.Set("ed2k", hash)
-	v.Set("fmask", formatMask(fmask[:]))
-	v.Set("amask", formatMask(amask[:]))
-	resp, err := c.request(ctx, "FILE", v)
-	if err != nil {
-		return nil, fmt.Errorf("udpapi FileByHash: %s", err)
-	}
-	if resp.Code != 220 {
-		return nil, fmt.Errorf("udpapi FileByHash: got bad return code %w", resp.Code)
-	}
-	if n := len(resp.Rows); n != 1 {
-		return nil, fmt.Errorf("udpapi FileByHash: got unexpected number of rows %d", n)
-	}
-	return resp.Rows[0], nil
-}
-
 // Ping calls the PING command with nat=1 and returns the port.
 func (c *Client) Ping(ctx context.Context) (port string, _ error) {
 	v := make(url.Values)
@@ -330,7 +380,7 @@ func (c *Client) Ping(ctx context.Context) (port string, _ error) {
 		return "", fmt.Errorf("udpapi Ping: %s", err)
 	}
 	if resp.Code != 300 {
-		return "", fmt.Errorf("udpapi Ping: got bad return code %s", resp.Code)
+		return "", fmt.Errorf("udpapi Ping: got bad return code %w", resp.Code)
 	}
 	if n := len(resp.Rows); n != 1 {
 		return "", fmt.Errorf("udpapi Ping: got unexpected number of rows %d", n)
@@ -343,16 +393,12 @@ func (c *Client) Ping(ctx context.Context) (port string, _ error) {
 
 // Uptime calls the UPTIME command and returns server uptime in milliseconds.
 func (c *Client) Uptime(ctx context.Context) (uptime int, _ error) {
-	v, err := c.sessionValues()
-	if err != nil {
-		return 0, fmt.Errorf("udpapi Uptime: %s", err)
-	}
-	resp, err := c.request(ctx, "UPTIME", v)
+	resp, err := c.sessionRequest(ctx, "UPTIME", make(url.Values))
 	if err != nil {
 		return 0, fmt.Errorf("udpapi Uptime: %s", err)
 	}
 	if resp.Code != 208 {
-		return 0, fmt.Errorf("udpapi Uptime: got bad return code %s", resp.Code)
+		return 0, fmt.Errorf("udpapi Uptime: got bad return code %w", resp.Code)
 	}
 	if n := len(resp.Rows); n != 1 {
 		return 0, fmt.Errorf("udpapi Uptime: got unexpected number of rows %d", n)
@@ -367,12 +413,81 @@ func (c *Client) Uptime(ctx context.Context) (uptime int, _ error) {
 	return time, nil
 }
 
-// request sends a request to the underlying mux, with rate limiting.
+// request sends a request to the underlying mux, with rate limiting
+// and retries.
+// Requests fail with a [*BannedError] while the circuit breaker is
+// tripped.
 func (c *Client) request(ctx context.Context, cmd string, args url.Values) (Response, error) {
-	if err := c.limiter.Wait(ctx); err != nil {
+	for retry := 0; ; retry++ {
+		if err := c.breaker.check(); err != nil {
+			return Response{}, err
+		}
+		if err := c.limiter.Wait(ctx); err != nil {
+			return Response{}, err
+		}
+		resp, err := c.m.Request(ctx, cmd, args)
+		if err == nil {
+			c.lastResponse.set(time.Now())
+			c.breaker.observe(resp)
+		}
+		if retry >= c.Retry.MaxRetries || !shouldRetry(ctx, cmd, args, resp, err) {
+			return resp, err
+		}
+		d := c.Retry.delay(retry)
+		c.logger.Warn("retrying request", "cmd", cmd, "code", resp.Code, "error", err, "retry", retry+1, "delay", d)
+		if err := sleepContext(ctx, d); err != nil {
+			return Response{}, err
+		}
+	}
+}
+
+// sessionRequest sends a request that requires a session.
+// The session key is added to args.
+//
+// If the server reports that the session has expired
+// ([LOGIN_FIRST] or [INVALID_SESSION]), the client logs in again
+// with the credentials of the last successful [Client.Auth] and
+// replays the request once.
+func (c *Client) sessionRequest(ctx context.Context, cmd string, args url.Values) (Response, error) {
+	key := c.sessionKey.get()
+	if key == "" {
+		// The initial login may have been delayed by a ban.
+		if err := c.relogin(ctx, ""); err != nil {
+			return Response{}, fmt.Errorf("no session key (log in with AUTH first): %w", err)
+		}
+		key = c.sessionKey.get()
+	}
+	args.Set("s", key)
+	resp, err := c.request(ctx, cmd, args)
+	if err != nil {
 		return Response{}, err
 	}
-	return c.m.Request(ctx, cmd, args)
+	if resp.Code != LOGIN_FIRST && resp.Code != INVALID_SESSION {
+		return resp, nil
+	}
+
+	c.logger.Info("session expired, logging in again", "cmd", cmd, "code", resp.Code)
+	if err := c.relogin(ctx, key); err != nil {
+		return Response{}, fmt.Errorf("relogin after %w: %w", resp.Code, err)
+	}
+	args.Set("s", c.sessionKey.get())
+	return c.request(ctx, cmd, args)
+}
+
+// relogin logs in again after the session with the key stale expired.
+// If another caller has already logged in again, this does nothing.
+func (c *Client) relogin(ctx context.Context, stale string) error {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+	if key := c.sessionKey.get(); key != "" && key != stale {
+		return nil
+	}
+	u := c.user.get()
+	if u.UserName == "" {
+		return errors.New("no credentials to log in with")
+	}
+	_, err := c.Auth(ctx, u)
+	return err
 }
 
 // sessionValues returns the values to use for the current session.
@@ -0,0 +1,570 @@
+package anidb
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/time/rate"
+)
+
+func TestClient_relogin(t *testing.T) {
+	t.Parallel()
+	ctx := testContext(t, 5*time.Second)
+	var mu sync.Mutex
+	sessions := 0
+	c := newTestClient(t, func(cmd string, v url.Values) string {
+		mu.Lock()
+		defer mu.Unlock()
+		switch cmd {
+		case "AUTH":
+			sessions++
+			return fmt.Sprintf("200 sess%d 1.2.3.4:5678 LOGIN ACCEPTED", sessions)
+		case "UPTIME":
+			if v.Get("s") != fmt.Sprintf("sess%d", sessions) || sessions < 2 {
+				return "506 INVALID SESSION"
+			}
+			return "208 UPTIME\n1234"
+		default:
+			return "598 UNKNOWN COMMAND"
+		}
+	})
+	if _, err := c.Auth(ctx, UserInfo{UserName: "user", UserPassword: "pass"}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.Uptime(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 1234 {
+		t.Errorf("Got uptime %d; want 1234", got)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if sessions != 2 {
+		t.Errorf("Got %d logins; want 2", sessions)
+	}
+}
+
+func TestClient_retry(t *testing.T) {
+	t.Parallel()
+	ctx := testContext(t, 5*time.Second)
+	var mu sync.Mutex
+	attempts := 0
+	c := newTestClient(t, func(cmd string, v url.Values) string {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		switch attempts {
+		case 1:
+			return "602 SERVER BUSY"
+		case 2:
+			// Drop the packet.
+			return ""
+		default:
+			return "208 UPTIME\n1234"
+		}
+	})
+	c.m.SetTimeout(100 * time.Millisecond)
+	c.sessionKey.set("sess")
+	if _, err := c.Uptime(ctx); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts != 3 {
+		t.Errorf("Got %d attempts; want 3", attempts)
+	}
+}
+
+func TestClient_retry_terminal(t *testing.T) {
+	t.Parallel()
+	ctx := testContext(t, 5*time.Second)
+	var mu sync.Mutex
+	attempts := 0
+	c := newTestClient(t, func(cmd string, v url.Values) string {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		return "320 NO SUCH FILE"
+	})
+	c.sessionKey.set("sess")
+	_, err := c.FileByHash(ctx, 1234, "abcd")
+	if !errors.Is(err, NO_SUCH_FILE) {
+		t.Errorf("Got error %v; want %v", err, NO_SUCH_FILE)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts != 1 {
+		t.Errorf("Got %d attempts; want 1", attempts)
+	}
+}
+
+func TestClient_retry_unsafe(t *testing.T) {
+	t.Parallel()
+	ctx := testContext(t, 5*time.Second)
+	var mu sync.Mutex
+	attempts := map[string]int{}
+	c := newTestClient(t, func(cmd string, v url.Values) string {
+		mu.Lock()
+		defer mu.Unlock()
+		key := cmd
+		if v.Get("edit") == "1" {
+			key += " edit"
+		}
+		attempts[key]++
+		// Drop every packet.
+		return ""
+	})
+	c.m.SetTimeout(50 * time.Millisecond)
+	c.sessionKey.set("sess")
+	if _, err := c.MyListAdd(ctx, MyListKey{FileID: 12}, MyListFields{}); err == nil {
+		t.Error("Got no error from MyListAdd")
+	}
+	if _, err := c.MyListEdit(ctx, MyListKey{FileID: 12}, MyListFields{}); err == nil {
+		t.Error("Got no error from MyListEdit")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := map[string]int{
+		"MYLISTADD":      1,
+		"MYLISTADD edit": c.Retry.MaxRetries + 1,
+	}
+	if !reflect.DeepEqual(attempts, want) {
+		t.Errorf("Got attempts %v; want %v", attempts, want)
+	}
+}
+
+func TestClient_multipleFiles(t *testing.T) {
+	t.Parallel()
+	ctx := testContext(t, 5*time.Second)
+	c := newTestClient(t, func(cmd string, v url.Values) string {
+		return "322 MULTIPLE FILES FOUND\n12|34|56"
+	})
+	c.sessionKey.set("sess")
+	_, err := c.FileByEpisode(ctx, 1, 2, "1")
+	var multiErr *MultipleFilesError
+	if !errors.As(err, &multiErr) {
+		t.Fatalf("Got error %v; want MultipleFilesError", err)
+	}
+	if !errors.Is(err, MULTIPLE_FILES_FOUND) {
+		t.Errorf("Got error %v; want %v", err, MULTIPLE_FILES_FOUND)
+	}
+	want := []uint32{12, 34, 56}
+	if !reflect.DeepEqual(multiErr.FileIDs, want) {
+		t.Errorf("Got file IDs %v; want %v", multiErr.FileIDs, want)
+	}
+}
+
+func TestClient_encryption(t *testing.T) {
+	t.Parallel()
+	ctx := testContext(t, 5*time.Second)
+	pc, conn := newUDPPipe(t, 5*time.Second)
+	c := newClient(conn, nullLogger, clientName, clientVersion)
+	unlimit(c)
+	t.Cleanup(c.Close)
+
+	const apiKey = "hunter2"
+	var mu sync.Mutex
+	encrypts, sessions := 0, 0
+	errc := make(chan error, 1)
+	go func() {
+		errc <- serveEncryptedRequests(pc, apiKey, func(cmd string, v url.Values) (string, bool) {
+			mu.Lock()
+			defer mu.Unlock()
+			switch cmd {
+			case "ENCRYPT":
+				encrypts++
+				return fmt.Sprintf("209 salt%d ENCRYPTION ENABLED", encrypts), true
+			case "AUTH":
+				if v.Get("pass") != "pass" {
+					return "500 LOGIN FAILED", true
+				}
+				sessions++
+				return fmt.Sprintf("200 sess%d 1.2.3.4:5678 LOGIN ACCEPTED", sessions), true
+			case "UPTIME":
+				if sessions < 2 {
+					// The server forgets the key along with the session.
+					return "506 INVALID SESSION", false
+				}
+				return "208 UPTIME\n1234", true
+			default:
+				return "598 UNKNOWN COMMAND", true
+			}
+		})
+	}()
+
+	u := UserInfo{UserName: "user", UserPassword: "pass", APIKey: apiKey}
+	if _, err := c.Auth(ctx, u); err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.Uptime(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 1234 {
+		t.Errorf("Got uptime %d; want 1234", got)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if encrypts != 2 || sessions != 2 {
+		t.Errorf("Got %d encryptions and %d logins; want 2 each", encrypts, sessions)
+	}
+	select {
+	case err := <-errc:
+		t.Error(err)
+	default:
+	}
+}
+
+func TestClient_encryption_undefined(t *testing.T) {
+	t.Parallel()
+	ctx := testContext(t, 5*time.Second)
+	var mu sync.Mutex
+	logins := 0
+	c := newTestClient(t, func(cmd string, v url.Values) string {
+		mu.Lock()
+		defer mu.Unlock()
+		switch cmd {
+		case "ENCRYPT":
+			return "309 API PASSWORD NOT DEFINED"
+		case "AUTH":
+			logins++
+			return "200 sess 1.2.3.4:5678 LOGIN ACCEPTED"
+		default:
+			return "598 UNKNOWN COMMAND"
+		}
+	})
+	_, err := c.Auth(ctx, UserInfo{UserName: "user", UserPassword: "pass", APIKey: "hunter2"})
+	if !errors.Is(err, API_PASSWORD_NOT_DEFINED) {
+		t.Errorf("Got error %v; want %v", err, API_PASSWORD_NOT_DEFINED)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if logins != 0 {
+		t.Errorf("Got %d logins; want 0", logins)
+	}
+}
+
+func TestClient_encoding(t *testing.T) {
+	t.Parallel()
+	ctx := testContext(t, 5*time.Second)
+	const name = "アニメ"
+	sjisName, err := japanese.ShiftJIS.NewEncoder().String(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var enc string
+	c := newTestClient(t, func(cmd string, v url.Values) string {
+		mu.Lock()
+		defer mu.Unlock()
+		switch cmd {
+		case "AUTH":
+			enc = v.Get("enc")
+			return "200 sess 1.2.3.4:5678 LOGIN ACCEPTED"
+		case "ENCODING":
+			if v.Get("name") != "Shift_JIS" {
+				return "519 ENCODING NOT SUPPORTED"
+			}
+			return "219 ENCODING CHANGED"
+		case "NAME":
+			return "200 " + sjisName
+		default:
+			return "598 UNKNOWN COMMAND"
+		}
+	})
+	if _, err := c.Auth(ctx, UserInfo{UserName: "user", UserPassword: "pass"}); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if enc != DefaultEncoding {
+		t.Errorf("Got enc %q on login; want %q", enc, DefaultEncoding)
+	}
+	mu.Unlock()
+
+	if err := c.SetEncoding(ctx, "EUC-JP"); !errors.Is(err, ENCODING_NOT_SUPPORTED) {
+		t.Errorf("Got error %v; want %v", err, ENCODING_NOT_SUPPORTED)
+	}
+	if err := c.SetEncoding(ctx, "Shift_JIS"); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.request(ctx, "NAME", url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Header != name {
+		t.Errorf("Got name %q; want %q", resp.Header, name)
+	}
+
+	if _, err := c.Auth(ctx, UserInfo{UserName: "user", UserPassword: "pass"}); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if enc != "Shift_JIS" {
+		t.Errorf("Got enc %q on relogin; want Shift_JIS", enc)
+	}
+}
+
+func TestLookupEncoding(t *testing.T) {
+	t.Parallel()
+	for _, name := range []string{"UTF8", "UTF-8", "utf8"} {
+		if e, err := lookupEncoding(name); e != nil || err != nil {
+			t.Errorf("lookupEncoding(%q) = %v, %v; want nil, nil", name, e, err)
+		}
+	}
+	if e, err := lookupEncoding("Shift_JIS"); e == nil || err != nil {
+		t.Errorf("lookupEncoding(Shift_JIS) = %v, %v; want encoding", e, err)
+	}
+	for _, name := range []string{"UTF-16", "nonsense"} {
+		if _, err := lookupEncoding(name); err == nil {
+			t.Errorf("lookupEncoding(%q) returned no error", name)
+		}
+	}
+}
+
+func TestClient_keepalive(t *testing.T) {
+	t.Parallel()
+	ctx := testContext(t, 5*time.Second)
+	var mu sync.Mutex
+	logins := 0
+	c := newTestClient(t, func(cmd string, v url.Values) string {
+		mu.Lock()
+		defer mu.Unlock()
+		switch cmd {
+		case "AUTH":
+			logins++
+			return fmt.Sprintf("200 sess%d 1.2.3.4:%d000 LOGIN ACCEPTED", logins, logins)
+		case "PING":
+			// The NAT mapping changed since the login.
+			return "300 PONG\n2000"
+		case "UPTIME":
+			return "208 UPTIME\n1234"
+		default:
+			return "598 UNKNOWN COMMAND"
+		}
+	})
+	if _, err := c.Auth(ctx, UserInfo{UserName: "user", UserPassword: "pass"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.keepalive(ctx); err != nil {
+		t.Fatal(err)
+	}
+	s := c.SessionStatus()
+	if !s.LoggedIn || s.Port != "2000" || s.Uptime != 1234*time.Millisecond || s.LastResponse.IsZero() {
+		t.Errorf("Got status %+v", s)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if logins != 2 {
+		t.Errorf("Got %d logins; want 2", logins)
+	}
+}
+
+func TestIsTemporary(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{err: fmt.Errorf("FILE: %w", SERVER_BUSY), want: true},
+		{err: fmt.Errorf("FILE: %w", NO_SUCH_FILE), want: false},
+		{err: fmt.Errorf("FILE: %w", ILLEGAL_INPUT_OR_ACCESS_DENIED), want: false},
+		{err: fmt.Errorf("FILE: %w", context.DeadlineExceeded), want: true},
+		{err: &BannedError{State: BreakerState{Code: BANNED}}, want: true},
+		{err: errors.New("parse error"), want: false},
+	}
+	for _, c := range cases {
+		if got := IsTemporary(c.err); got != c.want {
+			t.Errorf("IsTemporary(%v) = %t; want %t", c.err, got, c.want)
+		}
+	}
+}
+
+func TestRetryPolicy_delay(t *testing.T) {
+	t.Parallel()
+	p := RetryPolicy{MaxRetries: 10, Backoff: time.Second}
+	cases := []struct {
+		retry int
+		want  time.Duration
+	}{
+		{retry: 0, want: time.Second},
+		{retry: 1, want: 2 * time.Second},
+		{retry: 3, want: 8 * time.Second},
+		{retry: 9, want: maxRetryBackoff},
+	}
+	for _, c := range cases {
+		if got := p.delay(c.retry); got != c.want {
+			t.Errorf("delay(%d) = %s; want %s", c.retry, got, c.want)
+		}
+	}
+}
+
+func TestClient_breaker(t *testing.T) {
+	t.Parallel()
+	ctx := testContext(t, 5*time.Second)
+	var mu sync.Mutex
+	attempts := 0
+	c := newTestClient(t, func(cmd string, v url.Values) string {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		return "555 BANNED\nflooding"
+	})
+	store := mapStore{}
+	if err := c.breaker.load(store); err != nil {
+		t.Fatal(err)
+	}
+	c.sessionKey.set("sess")
+	if _, err := c.Uptime(ctx); err == nil {
+		t.Fatal("Expected error")
+	}
+	_, err := c.FileByHash(ctx, 1234, "abcd")
+	var bannedErr *BannedError
+	if !errors.As(err, &bannedErr) {
+		t.Fatalf("Got error %v; want BannedError", err)
+	}
+	if !errors.Is(err, BANNED) {
+		t.Errorf("Got error %v; want %v", err, BANNED)
+	}
+	if got := bannedErr.State.Reason; got != "flooding" {
+		t.Errorf("Got reason %q; want %q", got, "flooding")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts != 1 {
+		t.Errorf("Got %d attempts; want 1", attempts)
+	}
+
+	b := newBreaker(nullLogger)
+	if err := b.load(store); err != nil {
+		t.Fatal(err)
+	}
+	if !b.get().Tripped(time.Now()) {
+		t.Errorf("Loaded breaker not tripped")
+	}
+}
+
+type mapStore map[string][]byte
+
+func (s mapStore) LoadState(key string) ([]byte, error) {
+	return s[key], nil
+}
+
+func (s mapStore) SaveState(key string, value []byte) error {
+	s[key] = value
+	return nil
+}
+
+// A testHandler answers a test request with a response without the tag.
+type testHandler func(cmd string, v url.Values) string
+
+// newTestClient returns a Client talking to a local UDP server that
+// answers requests with h.
+// The client is not rate limited.
+func newTestClient(t *testing.T, h testHandler) *Client {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go serveTestRequests(pc, h)
+	c, err := Dial(pc.LocalAddr().String(), nullLogger, clientName, clientVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlimit(c)
+	t.Cleanup(c.Close)
+	return c
+}
+
+// unlimit removes the rate limits and retry delays of c for tests.
+func unlimit(c *Client) {
+	c.limiter.short = rate.NewLimiter(rate.Inf, 1)
+	c.limiter.long = rate.NewLimiter(rate.Inf, 1)
+	c.limiter.setBulkShare(1)
+	c.Retry.Backoff = time.Millisecond
+}
+
+func serveTestRequests(pc net.PacketConn, h testHandler) {
+	buf := make([]byte, 1400)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		cmd, query, _ := strings.Cut(string(buf[:n]), " ")
+		v, err := url.ParseQuery(query)
+		if err != nil {
+			continue
+		}
+		resp := h(cmd, v)
+		if resp == "" {
+			continue
+		}
+		if _, err := pc.WriteTo([]byte(v.Get("tag")+" "+resp), addr); err != nil {
+			return
+		}
+	}
+}
+
+// An encryptedHandler answers a test request like a testHandler.
+// It also reports whether encryption stays enabled after the response.
+type encryptedHandler func(cmd string, v url.Values) (resp string, encrypted bool)
+
+// serveEncryptedRequests answers requests with h, enabling encryption
+// with apiKey and the salt of successful ENCRYPT responses.
+func serveEncryptedRequests(pc net.PacketConn, apiKey string, h encryptedHandler) error {
+	var block cipher.Block
+	buf := make([]byte, 1400)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		data := buf[:n]
+		if block != nil {
+			if data, err = decrypt(block, data); err != nil {
+				return fmt.Errorf("request not encrypted: %s", err)
+			}
+		}
+		cmd, query, _ := strings.Cut(string(data), " ")
+		v, err := url.ParseQuery(query)
+		if err != nil {
+			return err
+		}
+		resp, encrypted := h(cmd, v)
+		out := []byte(v.Get("tag") + " " + resp)
+		switch {
+		case cmd == "ENCRYPT" && strings.HasPrefix(resp, "209 "):
+			salt, _, _ := strings.Cut(strings.TrimPrefix(resp, "209 "), " ")
+			sum := md5.Sum([]byte(apiKey + salt))
+			if block, err = aes.NewCipher(sum[:]); err != nil {
+				return err
+			}
+		case !encrypted:
+			block = nil
+		case block != nil:
+			out = encrypt(block, out)
+		}
+		if _, err := pc.WriteTo(out, addr); err != nil {
+			return err
+		}
+	}
+}
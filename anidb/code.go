@@ -1,5 +1,11 @@
 package anidb
 
+import (
+	"context"
+	"errors"
+	"net"
+)
+
 // A ReturnCode is an AniDB UDP API return code.
 // Note that even though ReturnCode implements error, not all
 // ReturnCode values should be considered errors.
@@ -163,3 +169,35 @@ const (
 func (c ReturnCode) Error() string {
 	return c.String()
 }
+
+// IsTemporary reports whether err is a transient failure, after which
+// the request may succeed if it is sent again later.
+// This includes lost packets, return codes for which
+// [ReturnCode.Temporary] is true, expired sessions that could not be
+// renewed and requests refused while the client is banned.
+func IsTemporary(err error) bool {
+	var bannedErr *BannedError
+	if errors.As(err, &bannedErr) {
+		return true
+	}
+	var code ReturnCode
+	if errors.As(err, &code) {
+		return code.Temporary() || code == LOGIN_FIRST || code == INVALID_SESSION
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// Temporary reports whether a request that failed with c may succeed
+// if it is sent again later.
+func (c ReturnCode) Temporary() bool {
+	switch c {
+	case ANIDB_OUT_OF_SERVICE, SERVER_BUSY, TIMEOUT:
+		return true
+	default:
+		return false
+	}
+}
@@ -1,7 +1,88 @@
 package anidb
 
+import "time"
+
 type AniDBConfig struct {
 	User     string `yaml:"user"`
 	Password string `yaml:"password"`
 	Address  string `yaml:"address" default:"api.anidb.net:9000"`
+	// APIKey is the UDP API key set in the AniDB profile. If set,
+	// requests are encrypted, including the password sent on login.
+	APIKey string `yaml:"api_key"`
+
+	// Encoding is the session encoding, such as UTF8 or Shift_JIS.
+	// See [DefaultEncoding].
+	Encoding string `yaml:"encoding" default:"UTF8"`
+
+	// Timeout is how long to wait for a response before a request
+	// is considered lost.
+	Timeout time.Duration `yaml:"timeout" default:"5s"`
+	// Retries is the number of times a request failing with a
+	// transient error is retried. A negative value disables retries.
+	Retries int `yaml:"retries" default:"3"`
+	// RetryBackoff is the delay before the first retry, doubled on
+	// every following retry.
+	RetryBackoff time.Duration `yaml:"retry_backoff" default:"2s"`
+	// BanBackoff is how long all requests are paused after AniDB
+	// bans the client, doubled on every consecutive ban.
+	BanBackoff time.Duration `yaml:"ban_backoff" default:"30m"`
+	// BulkRateShare is the share of the request rate, between 0 and
+	// 1, that bulk work such as library scans may use.
+	BulkRateShare float64 `yaml:"bulk_rate_share" default:"0.5"`
+	// KeepaliveInterval is how often the session monitor pings AniDB
+	// to keep the NAT mapping alive and check the session. A
+	// negative value disables the monitor.
+	KeepaliveInterval time.Duration `yaml:"keepalive_interval" default:"5m"`
+	// Record is the path of a file to append all AniDB traffic to,
+	// for debugging. See [Recorder].
+	Record string `yaml:"record"`
+	// Replay is the path of a file recorded with Record. If set,
+	// AniDB is not contacted and requests are answered with the
+	// recorded responses. See [DialReplay].
+	Replay string `yaml:"replay"`
+	// RateLimit is the request rate. Defaults to [DefaultRateLimit].
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+	// FileFields are the fields fetched for files, see
+	// [FileFmaskFields] and [FileAmaskFields]. Defaults to
+	// [DefaultFileFields].
+	FileFields []string `yaml:"file_fields"`
+}
+
+// retryPolicy returns the retry policy for the configuration.
+func (cfg *AniDBConfig) retryPolicy() RetryPolicy {
+	p := DefaultRetryPolicy
+	switch {
+	case cfg.Retries < 0:
+		p.MaxRetries = 0
+	case cfg.Retries > 0:
+		p.MaxRetries = cfg.Retries
+	}
+	if cfg.RetryBackoff > 0 {
+		p.Backoff = cfg.RetryBackoff
+	}
+	return p
+}
+
+// A RateLimitConfig configures the request rate.
+// Requests are sent at most every ShortInterval, and on average every
+// LongInterval after a burst of LongBurst requests.
+type RateLimitConfig struct {
+	ShortInterval time.Duration `yaml:"short_interval" default:"2s"`
+	LongInterval  time.Duration `yaml:"long_interval" default:"4s"`
+	LongBurst     int           `yaml:"long_burst" default:"30"`
+}
+
+// withDefaults returns the configuration with unset fields set to
+// [DefaultRateLimit].
+func (cfg RateLimitConfig) withDefaults() RateLimitConfig {
+	if cfg.ShortInterval <= 0 {
+		cfg.ShortInterval = DefaultRateLimit.ShortInterval
+	}
+	if cfg.LongInterval <= 0 {
+		cfg.LongInterval = DefaultRateLimit.LongInterval
+	}
+	if cfg.LongBurst <= 0 {
+		cfg.LongBurst = DefaultRateLimit.LongBurst
+	}
+	return cfg
 }
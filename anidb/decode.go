@@ -0,0 +1,143 @@
+package anidb
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maskFields returns the names of the fields set in mask, in the order
+// the fields appear in a response: by byte, then from the highest bit
+// to the lowest.
+func maskFields(mask []byte, specs map[string]bitSpec) []string {
+	var names []string
+	for name, s := range specs {
+		if int(s.byte) < len(mask) && mask[s.byte]&(1<<s.bit) != 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := specs[names[i]], specs[names[j]]
+		if a.byte != b.byte {
+			return a.byte < b.byte
+		}
+		return a.bit > b.bit
+	})
+	return names
+}
+
+// decodeMaskFields decodes the fields of a response row for mask.
+// The values are typed according to each [bitSpec.typ]; see
+// [decodeField].
+func decodeMaskFields(row []string, mask []byte, specs map[string]bitSpec) (map[string]any, error) {
+	names := maskFields(mask, specs)
+	if len(row) != len(names) {
+		return nil, fmt.Errorf("expected %d fields, got %d, raw: %v", len(names), len(row), row)
+	}
+	values := make(map[string]any, len(names))
+	for i, name := range names {
+		v, err := decodeField(specs[name].typ, row[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %w", name, row[i], err)
+		}
+		values[name] = v
+	}
+	return values, nil
+}
+
+// decodeField decodes a response field of the given type:
+//
+//	int2, int4, int8: int64
+//	str: string
+//	bool: bool
+//	date: time.Time from a Unix timestamp, zero if unknown
+//	strlist: []string, split on apostrophes
+//	intlist: []int64, split on apostrophes or commas
+func decodeField(typ string, s string) (any, error) {
+	switch typ {
+	case "int2", "int4", "int8":
+		if s == "" {
+			return int64(0), nil
+		}
+		return strconv.ParseInt(s, 10, 64)
+	case "str":
+		return s, nil
+	case "bool":
+		switch s {
+		case "1", "true":
+			return true, nil
+		case "0", "false", "":
+			return false, nil
+		default:
+			return nil, fmt.Errorf("invalid bool")
+		}
+	case "date":
+		if s == "" {
+			return time.Time{}, nil
+		}
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n == 0 {
+			return time.Time{}, err
+		}
+		return time.Unix(n, 0).UTC(), nil
+	case "strlist":
+		return splitList(s, "'"), nil
+	case "intlist":
+		parts := splitList(strings.ReplaceAll(s, ",", "'"), "'")
+		ns := make([]int64, len(parts))
+		for i, p := range parts {
+			n, err := strconv.ParseInt(p, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			ns[i] = n
+		}
+		return ns, nil
+	default:
+		panic(fmt.Sprintf("unknown field type %q", typ))
+	}
+}
+
+// splitList splits a list field, returning nil for an empty field.
+func splitList(s, sep string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, sep)
+}
+
+// A fieldValues holds decoded response fields by name, with typed
+// accessors that return the zero value for unset fields.
+type fieldValues map[string]any
+
+func (v fieldValues) int(name string) int64 {
+	n, _ := v[name].(int64)
+	return n
+}
+
+func (v fieldValues) str(name string) string {
+	s, _ := v[name].(string)
+	return s
+}
+
+func (v fieldValues) bool(name string) bool {
+	b, _ := v[name].(bool)
+	return b
+}
+
+func (v fieldValues) date(name string) time.Time {
+	t, _ := v[name].(time.Time)
+	return t
+}
+
+func (v fieldValues) strs(name string) []string {
+	s, _ := v[name].([]string)
+	return s
+}
+
+func (v fieldValues) ints(name string) []int64 {
+	n, _ := v[name].([]int64)
+	return n
+}
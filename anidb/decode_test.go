@@ -0,0 +1,188 @@
+package anidb
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMaskFields(t *testing.T) {
+	t.Parallel()
+	var m AnimeAmask
+	m.Set("english name", "aid", "episodes", "year")
+	got := maskFields(m[:], AnimeAmaskFields)
+	want := []string{"aid", "year", "english name", "episodes"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %q; want %q", got, want)
+	}
+}
+
+func TestNewAnime(t *testing.T) {
+	t.Parallel()
+	var m AnimeAmask
+	m.Set("aid", "year", "type", "related aid list", "related aid type",
+		"romaji name", "synonym list", "episodes", "air date", "rating", "is 18+ restricted")
+	row := []string{"1", "1999-1999", "TV Series", "2'3", "1'2",
+		"Seikai no Monshou", "Crest of the Stars'CotS", "13", "915148800", "853", "0"}
+	v, err := decodeMaskFields(row, m[:], AnimeAmaskFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := newAnime(v)
+	want := Anime{
+		AnimeID:    1,
+		Year:       "1999-1999",
+		Type:       "TV Series",
+		Related:    []RelatedAnime{{AnimeID: 2, Relation: RelationSequel}, {AnimeID: 3, Relation: RelationPrequel}},
+		RomajiName: "Seikai no Monshou",
+		Synonyms:   []string{"Crest of the Stars", "CotS"},
+		Episodes:   13,
+		AirDate:    time.Date(1999, 1, 1, 0, 0, 0, 0, time.UTC),
+		Rating:     853,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %#v; want %#v", got, want)
+	}
+}
+
+func TestDecodeMaskFields_count(t *testing.T) {
+	t.Parallel()
+	var m AnimeAmask
+	m.Set("aid", "year")
+	if _, err := decodeMaskFields([]string{"1"}, m[:], AnimeAmaskFields); err == nil {
+		t.Errorf("Expected error")
+	}
+}
+
+func TestParseEpisode(t *testing.T) {
+	t.Parallel()
+	row := []string{"2", "1", "25", "712", "30", "S1", "Special", "Tokubetsu", "", "0", "2"}
+	got, err := parseEpisode(row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Episode{
+		EpisodeID:   2,
+		AnimeID:     1,
+		Length:      25,
+		Rating:      712,
+		Votes:       30,
+		EpNum:       "S1",
+		EnglishName: "Special",
+		RomajiName:  "Tokubetsu",
+		Type:        EpisodeSpecial,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %#v; want %#v", got, want)
+	}
+}
+
+func TestParseGroup(t *testing.T) {
+	t.Parallel()
+	row := []string{"7", "720", "100", "50", "400", "Frostii", "Frostii", "#frostii", "irc.rizon.net",
+		"http://frostii.com", "", "1230768000", "0", "0", "0", "0", "8,1'9,2"}
+	got, err := parseGroup(row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Group{
+		GroupID:     7,
+		Rating:      720,
+		Votes:       100,
+		AnimeCount:  50,
+		FileCount:   400,
+		Name:        "Frostii",
+		ShortName:   "Frostii",
+		IRCChannel:  "#frostii",
+		IRCServer:   "irc.rizon.net",
+		URL:         "http://frostii.com",
+		FoundedDate: time.Date(2009, 1, 1, 0, 0, 0, 0, time.UTC),
+		Relations:   []GroupRelation{{GroupID: 8, Type: 1}, {GroupID: 9, Type: 2}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %#v; want %#v", got, want)
+	}
+}
+
+func TestFileMasks(t *testing.T) {
+	t.Parallel()
+	fmask, amask, err := FileMasks("aid", "eid", "gid", "state",
+		"size", "ed2k", "md5", "sha1", "crc",
+		"quality", "source", "audio codec", "audio bitrate", "video codec", "video bitrate", "video res", "video extension",
+		"year", "type", "romaji name", "english name",
+		"epno", "ep name", "ep romaji name", "group name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantF := FileFmask{0b0111_0001, 0b1111_1000, 0b1111_1111, 0b0000_0000, 0b0000_0000}
+	wantA := FileAmask{0b0011_0000, 0b1010_0000, 0b1110_0000, 0b1000_0000}
+	if fmask != wantF {
+		t.Errorf("Got fmask %08b; want %08b", fmask, wantF)
+	}
+	if amask != wantA {
+		t.Errorf("Got amask %08b; want %08b", amask, wantA)
+	}
+	if _, _, err := FileMasks("aid", "no such field"); err == nil {
+		t.Errorf("Expected error")
+	}
+}
+
+func TestDecodeFile(t *testing.T) {
+	t.Parallel()
+	fmask, amask, err := FileMasks("aid", "size", "ed2k", "crc", "video res", "epno", "group name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	row := []string{"12345", "1", "734003200", "0123456789abcdef0123456789abcdef", "deadbeef", "1920x1080", "01", "Frostii"}
+	got, err := decodeFile(row, fmask, amask)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := File{
+		FileID:          12345,
+		AnimeID:         1,
+		Size:            734003200,
+		Ed2K:            "0123456789abcdef0123456789abcdef",
+		CRC:             "deadbeef",
+		VideoResolution: "1920x1080",
+		EpNum:           "01",
+		GroupName:       "Frostii",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %#v; want %#v", got, want)
+	}
+	if _, err := decodeFile(row[:7], fmask, amask); err == nil {
+		t.Errorf("Expected error")
+	}
+}
+
+func TestDecodeFile_lists(t *testing.T) {
+	t.Parallel()
+	fmask, amask, err := FileMasks("other episodes", "audio codec", "audio bitrate", "dub language", "sub language",
+		"length in seconds", "aired date", "anidb file name", "group short name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	row := []string{"12345", "2,50'3,50", "AAC'AC3", "128'384", "japanese'english", "english",
+		"1440", "915148800", "Seikai no Monshou - 01 [Frostii].mkv", "Frostii"}
+	got, err := decodeFile(row, fmask, amask)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := File{
+		FileID:        12345,
+		OtherEpisodes: []OtherEpisode{{EpisodeID: 2, Percentage: 50}, {EpisodeID: 3, Percentage: 50}},
+		AudioTracks: []AudioTrack{
+			{Codec: "AAC", Bitrate: 128, Language: "japanese"},
+			{Codec: "AC3", Bitrate: 384, Language: "english"},
+		},
+		SubtitleTracks:  []SubtitleTrack{{Language: "english"}},
+		LengthInSeconds: 1440,
+		AiredDate:       time.Date(1999, 1, 1, 0, 0, 0, 0, time.UTC),
+		AniDBFileName:   "Seikai no Monshou - 01 [Frostii].mkv",
+		GroupShortName:  "Frostii",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %#v; want %#v", got, want)
+	}
+}
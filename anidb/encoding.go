@@ -0,0 +1,61 @@
+package anidb
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// DefaultEncoding is the session encoding requested on login unless
+// configured otherwise.
+// Without it, AniDB uses its default encoding, which garbles names
+// that are not Latin.
+const DefaultEncoding = "UTF8"
+
+// lookupEncoding returns the text encoding for an AniDB encoding name,
+// such as UTF8 or Shift_JIS.
+// It returns nil for UTF-8, which needs no conversion.
+// Encodings that are not ASCII compatible are not supported, as the
+// response tags and codes must stay readable.
+func lookupEncoding(name string) (encoding.Encoding, error) {
+	e, err := htmlindex.Get(name)
+	if err != nil {
+		return nil, fmt.Errorf("lookup encoding %q: %w", name, err)
+	}
+	canonical, _ := htmlindex.Name(e)
+	switch canonical {
+	case "utf-8":
+		return nil, nil
+	case "utf-16be", "utf-16le", "replacement":
+		return nil, fmt.Errorf("lookup encoding %q: not ASCII compatible", name)
+	}
+	return e, nil
+}
+
+// SetEncoding calls the ENCODING command to change the encoding of the
+// session, and requests it on future logins.
+// The returned error wraps a [ReturnCode] if applicable, such as
+// [ENCODING_NOT_SUPPORTED].
+func (c *Client) SetEncoding(ctx context.Context, name string) error {
+	e, err := lookupEncoding(name)
+	if err != nil {
+		return fmt.Errorf("udpapi SetEncoding: %w", err)
+	}
+	v := url.Values{}
+	v.Set("name", name)
+	resp, err := c.request(ctx, "ENCODING", v)
+	if err != nil {
+		return fmt.Errorf("udpapi SetEncoding: %w", err)
+	}
+	switch resp.Code {
+	case ENCODING_CHANGED:
+		c.encoding.set(name)
+		c.m.SetEncoding(e)
+		return nil
+	default:
+		return fmt.Errorf("udpapi SetEncoding: bad code %w %q", resp.Code, resp.Header)
+	}
+}
@@ -0,0 +1,168 @@
+package anidb
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// An Episode is the data returned by the EPISODE command.
+type Episode struct {
+	EpisodeID uint32
+	AnimeID   uint32
+	// Length is the length in minutes.
+	Length int
+	// Rating is multiplied by 100, so 853 is a rating of 8.53.
+	Rating int
+	Votes  int
+	// EpNum is the episode number, with a prefix for types other than
+	// regular episodes, such as "S1" for the first special.
+	EpNum       string
+	EnglishName string
+	RomajiName  string
+	KanjiName   string
+	AirDate     time.Time
+	Type        EpisodeType
+}
+
+// An EpisodeType is the type of an episode.
+type EpisodeType int
+
+const (
+	EpisodeRegular EpisodeType = 1
+	EpisodeSpecial EpisodeType = 2
+	EpisodeCredit  EpisodeType = 3
+	EpisodeTrailer EpisodeType = 4
+	EpisodeParody  EpisodeType = 5
+	EpisodeOther   EpisodeType = 6
+)
+
+func (t EpisodeType) String() string {
+	switch t {
+	case EpisodeRegular:
+		return "regular"
+	case EpisodeSpecial:
+		return "special"
+	case EpisodeCredit:
+		return "credit"
+	case EpisodeTrailer:
+		return "trailer"
+	case EpisodeParody:
+		return "parody"
+	default:
+		return "other"
+	}
+}
+
+// Episode calls the EPISODE command by episode ID.
+// The returned error wraps a [ReturnCode] if applicable, such as
+// [NO_SUCH_EPISODE].
+func (c *Client) Episode(ctx context.Context, eid uint32) (Episode, error) {
+	v := make(url.Values)
+	v.Set("eid", strconv.FormatUint(uint64(eid), 10))
+	return c.episode(ctx, v)
+}
+
+// EpisodeByNumber calls the EPISODE command by anime ID and episode
+// number, such as "1" or "S1".
+// The returned error wraps a [ReturnCode] if applicable, such as
+// [NO_SUCH_EPISODE].
+func (c *Client) EpisodeByNumber(ctx context.Context, aid uint32, epno string) (Episode, error) {
+	v := make(url.Values)
+	v.Set("aid", strconv.FormatUint(uint64(aid), 10))
+	v.Set("epno", epno)
+	return c.episode(ctx, v)
+}
+
+func (c *Client) episode(ctx context.Context, v url.Values) (Episode, error) {
+	resp, err := c.sessionRequest(ctx, "EPISODE", v)
+	if err != nil {
+		return Episode{}, fmt.Errorf("udpapi Episode: %w", err)
+	}
+	if resp.Code != EPISODE {
+		return Episode{}, fmt.Errorf("udpapi Episode: got bad return code %w", resp.Code)
+	}
+	if n := len(resp.Rows); n != 1 {
+		return Episode{}, fmt.Errorf("udpapi Episode: got unexpected number of rows %d", n)
+	}
+	e, err := parseEpisode(resp.Rows[0])
+	if err != nil {
+		return Episode{}, fmt.Errorf("udpapi Episode: %s", err)
+	}
+	return e, nil
+}
+
+// episodeFields describes the fields of an EPISODE response, in order.
+var episodeFields = []struct {
+	name string
+	typ  string
+}{
+	{"eid", "int4"},
+	{"aid", "int4"},
+	{"length", "int4"},
+	{"rating", "int4"},
+	{"votes", "int4"},
+	{"epno", "str"},
+	{"eng", "str"},
+	{"romaji", "str"},
+	{"kanji", "str"},
+	{"aired", "date"},
+	{"type", "int4"},
+}
+
+func parseEpisode(row []string) (Episode, error) {
+	// Older API versions don't return the type.
+	if len(row) != len(episodeFields) && len(row) != len(episodeFields)-1 {
+		return Episode{}, fmt.Errorf("expected %d fields, got %d, raw: %v", len(episodeFields), len(row), row)
+	}
+	v := make(fieldValues, len(row))
+	for i, raw := range row {
+		f := episodeFields[i]
+		val, err := decodeField(f.typ, raw)
+		if err != nil {
+			return Episode{}, fmt.Errorf("invalid %s %q: %w", f.name, raw, err)
+		}
+		v[f.name] = val
+	}
+	e := Episode{
+		EpisodeID:   uint32(v.int("eid")),
+		AnimeID:     uint32(v.int("aid")),
+		Length:      int(v.int("length")),
+		Rating:      int(v.int("rating")),
+		Votes:       int(v.int("votes")),
+		EpNum:       v.str("epno"),
+		EnglishName: v.str("eng"),
+		RomajiName:  v.str("romaji"),
+		KanjiName:   v.str("kanji"),
+		AirDate:     v.date("aired"),
+		Type:        EpisodeType(v.int("type")),
+	}
+	if e.Type == 0 {
+		e.Type = episodeTypeFromNumber(e.EpNum)
+	}
+	return e, nil
+}
+
+// episodeTypeFromNumber returns the episode type for an episode number
+// prefix.
+func episodeTypeFromNumber(epno string) EpisodeType {
+	if epno == "" {
+		return EpisodeOther
+	}
+	switch epno[0] {
+	case 'S':
+		return EpisodeSpecial
+	case 'C':
+		return EpisodeCredit
+	case 'T':
+		return EpisodeTrailer
+	case 'P':
+		return EpisodeParody
+	case 'O':
+		return EpisodeOther
+	default:
+		return EpisodeRegular
+	}
+}
@@ -1,33 +1,363 @@
 package anidb
 
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A File is the data returned by the FILE command.
+// Fields not requested are left as zero values.
 type File struct {
 	// FMASK DATA
 	FileID          uint32
 	AnimeID         uint32
 	EpisodeID       uint32
 	GroupID         uint32
+	MyListID        uint32
+	OtherEpisodes   []OtherEpisode
+	Deprecated      bool
 	State           uint16
 	Size            int
 	Ed2K            string
 	MD5             string
 	SHA1            string
 	CRC             string
+	ColourDepth     string
 	Quality         string
 	Source          string
-	AudioCodec      string
-	AudioBitrate    uint32
+	AudioTracks     []AudioTrack
 	VideoCodec      string
 	VideoBitrate    uint32
 	VideoResolution string
 	Extension       string
+	SubtitleTracks  []SubtitleTrack
+	LengthInSeconds int
+	Description     string
+	AiredDate       time.Time
+	AniDBFileName   string
+
+	// MyList data of the logged in user.
+	MyListState     int
+	MyListFileState int
+	MyListViewed    bool
+	MyListViewDate  time.Time
+	MyListStorage   string
+	MyListSource    string
+	MyListOther     string
 
 	// AMASK DATA
-	Year         string
-	Type         string
-	RomajiName   string
-	EnglishName  string
-	EpNum        string
-	EpName       string
-	EpRomajiName string
-	GroupName    string
+	TotalEpisodes      int
+	HighestEpisode     int
+	Year               string
+	Type               string
+	Related            []RelatedAnime
+	Categories         []string
+	RomajiName         string
+	KanjiName          string
+	EnglishName        string
+	OtherName          string
+	ShortNames         []string
+	Synonyms           []string
+	EpNum              string
+	EpName             string
+	EpRomajiName       string
+	EpKanjiName        string
+	EpRating           int
+	EpVoteCount        int
+	GroupName          string
+	GroupShortName     string
+	AnimeRecordUpdated time.Time
+}
+
+// An AudioTrack is an audio track of a file.
+type AudioTrack struct {
+	Codec   string
+	Bitrate uint32
+	// Language is the dub language, such as "japanese".
+	Language string
+}
+
+// A SubtitleTrack is a subtitle track of a file.
+type SubtitleTrack struct {
+	Language string
+}
+
+// An OtherEpisode is another episode a file covers, for files
+// spanning several episodes.
+type OtherEpisode struct {
+	EpisodeID uint32
+	// Percentage is how much of the episode the file covers.
+	Percentage int
+}
+
+// DefaultFileFields are the fields requested by FILE lookups unless
+// changed with [Client.SetFileFields].
+// Long text fields and the MyList fields are not requested by default.
+// See https://wiki.anidb.net/UDP_API_Definition#FILE:_Retrieve_File_Data for more information
+var DefaultFileFields = []string{
+	"aid", "eid", "gid", "other episodes", "deprecated", "state",
+	"size", "ed2k", "md5", "sha1", "crc", "video colour depth",
+	"quality", "source", "audio codec", "audio bitrate", "video codec", "video bitrate", "video res", "video extension",
+	"dub language", "sub language", "length in seconds", "aired date", "anidb file name",
+	"anime total episodes", "highest episode number", "year", "type",
+	"romaji name", "kanji name", "english name",
+	"epno", "ep name", "ep romaji name", "ep kanji name",
+	"group name", "group short name",
+}
+
+// requiredFileFields are always requested, as files are identified by
+// their size and ed2k hash.
+var requiredFileFields = []string{"size", "ed2k"}
+
+// SetFileFields sets the fields requested by FILE lookups.
+// See [FileFmaskFields] and [FileAmaskFields] for the field names.
+// The size and ed2k fields are always requested.
+// Fields that are not requested are left as zero values.
+// This should be called before making any requests.
+func (c *Client) SetFileFields(fields ...string) error {
+	fields = append(append([]string(nil), requiredFileFields...), fields...)
+	fmask, amask, err := FileMasks(fields...)
+	if err != nil {
+		return fmt.Errorf("udpapi SetFileFields: %w", err)
+	}
+	c.fileFmask = fmask
+	c.fileAmask = amask
+	return nil
+}
+
+// A MultipleFilesError is returned by FILE lookups that match more
+// than one file.
+// It wraps [MULTIPLE_FILES_FOUND].
+type MultipleFilesError struct {
+	// FileIDs are the IDs of the candidate files.
+	FileIDs []uint32
+}
+
+func (e *MultipleFilesError) Error() string {
+	return fmt.Sprintf("%s: %d candidate files %v", MULTIPLE_FILES_FOUND, len(e.FileIDs), e.FileIDs)
+}
+
+func (e *MultipleFilesError) Unwrap() error {
+	return MULTIPLE_FILES_FOUND
+}
+
+// parseMultipleFiles parses the file IDs of a MULTIPLE_FILES_FOUND
+// response.
+func parseMultipleFiles(rows [][]string) (*MultipleFilesError, error) {
+	e := &MultipleFilesError{}
+	for _, row := range rows {
+		for _, f := range row {
+			if f == "" {
+				continue
+			}
+			n, err := strconv.ParseUint(f, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid file ID %q: %w", f, err)
+			}
+			e.FileIDs = append(e.FileIDs, uint32(n))
+		}
+	}
+	return e, nil
+}
+
+// FileByHash calls the FILE command by size+ed2k hash.
+// The returned error wraps a [ReturnCode] if applicable, or is a
+// [*MultipleFilesError] if the lookup is ambiguous.
+func (c *Client) FileByHash(ctx context.Context, size int64, hash string) (File, error) {
+	v := make(url.Values)
+	v.Set("size", fmt.Sprintf("%d", size))
+	v.Set("ed2k", hash)
+	return c.file(ctx, "FileByHash", v)
+}
+
+// FileByID calls the FILE command by file ID.
+// The returned error wraps a [ReturnCode] if applicable.
+func (c *Client) FileByID(ctx context.Context, fid uint32) (File, error) {
+	v := make(url.Values)
+	v.Set("fid", strconv.FormatUint(uint64(fid), 10))
+	return c.file(ctx, "FileByID", v)
+}
+
+// FileByEpisode calls the FILE command by anime ID, group ID and
+// episode number, such as "1" or "S1".
+// The returned error wraps a [ReturnCode] if applicable, or is a
+// [*MultipleFilesError] if the lookup is ambiguous.
+func (c *Client) FileByEpisode(ctx context.Context, aid, gid uint32, epno string) (File, error) {
+	v := make(url.Values)
+	v.Set("aid", strconv.FormatUint(uint64(aid), 10))
+	v.Set("gid", strconv.FormatUint(uint64(gid), 10))
+	v.Set("epno", epno)
+	return c.file(ctx, "FileByEpisode", v)
+}
+
+// file calls the FILE command with the given lookup arguments.
+// name is the name of the calling method, for errors.
+func (c *Client) file(ctx context.Context, name string, v url.Values) (File, error) {
+	fmask, amask := c.fileFmask, c.fileAmask
+	data, err := c.fileRequest(ctx, v, fmask, amask)
+	if err != nil {
+		return File{}, fmt.Errorf("udpapi %s: %w", name, err)
+	}
+	file, err := decodeFile(data, fmask, amask)
+	if err != nil {
+		return File{}, fmt.Errorf("udpapi %s: %w", name, err)
+	}
+	return file, nil
+}
+
+// decodeFile decodes a FILE response row for the given masks.
+// The file ID comes first, then the fmask fields and the amask fields,
+// each in mask bit order.
+func decodeFile(row []string, fmask FileFmask, amask FileAmask) (File, error) {
+	nf := len(maskFields(fmask[:], FileFmaskFields))
+	na := len(maskFields(amask[:], FileAmaskFields))
+	if len(row) != 1+nf+na {
+		return File{}, fmt.Errorf("expected %d fields, got %d, raw: %v", 1+nf+na, len(row), row)
+	}
+	fid, err := strconv.ParseUint(row[0], 10, 32)
+	if err != nil {
+		return File{}, fmt.Errorf("invalid file ID %q: %w", row[0], err)
+	}
+	fv, err := decodeMaskFields(row[1:1+nf], fmask[:], FileFmaskFields)
+	if err != nil {
+		return File{}, err
+	}
+	av, err := decodeMaskFields(row[1+nf:], amask[:], FileAmaskFields)
+	if err != nil {
+		return File{}, err
+	}
+	for k, v := range av {
+		fv[k] = v
+	}
+	file := newFile(fieldValues(fv))
+	file.FileID = uint32(fid)
+	return file, nil
+}
+
+// newFile builds a File from decoded FILE fields.
+func newFile(v fieldValues) File {
+	f := File{
+		AnimeID:         uint32(v.int("aid")),
+		EpisodeID:       uint32(v.int("eid")),
+		GroupID:         uint32(v.int("gid")),
+		MyListID:        uint32(v.int("mylist id")),
+		Deprecated:      v.bool("deprecated"),
+		State:           uint16(v.int("state")),
+		Size:            int(v.int("size")),
+		Ed2K:            v.str("ed2k"),
+		MD5:             v.str("md5"),
+		SHA1:            v.str("sha1"),
+		CRC:             v.str("crc"),
+		ColourDepth:     v.str("video colour depth"),
+		Quality:         v.str("quality"),
+		Source:          v.str("source"),
+		VideoCodec:      v.str("video codec"),
+		VideoBitrate:    uint32(v.int("video bitrate")),
+		VideoResolution: v.str("video res"),
+		Extension:       v.str("video extension"),
+		LengthInSeconds: int(v.int("length in seconds")),
+		Description:     v.str("description"),
+		AiredDate:       v.date("aired date"),
+		AniDBFileName:   v.str("anidb file name"),
+
+		MyListState:     int(v.int("mylist state")),
+		MyListFileState: int(v.int("mylist filestate")),
+		MyListViewed:    v.bool("mylist viewed"),
+		MyListViewDate:  v.date("mylist viewdate"),
+		MyListStorage:   v.str("mylist storage"),
+		MyListSource:    v.str("mylist source"),
+		MyListOther:     v.str("mylist other"),
+
+		TotalEpisodes:      int(v.int("anime total episodes")),
+		HighestEpisode:     int(v.int("highest episode number")),
+		Year:               v.str("year"),
+		Type:               v.str("type"),
+		Categories:         v.strs("category list"),
+		RomajiName:         v.str("romaji name"),
+		KanjiName:          v.str("kanji name"),
+		EnglishName:        v.str("english name"),
+		OtherName:          v.str("other name"),
+		ShortNames:         v.strs("short name list"),
+		Synonyms:           v.strs("synonym list"),
+		EpNum:              v.str("epno"),
+		EpName:             v.str("ep name"),
+		EpRomajiName:       v.str("ep romaji name"),
+		EpKanjiName:        v.str("ep kanji name"),
+		EpRating:           int(v.int("episode rating")),
+		EpVoteCount:        int(v.int("episode vote count")),
+		GroupName:          v.str("group name"),
+		GroupShortName:     v.str("group short name"),
+		AnimeRecordUpdated: v.date("date aid record updated"),
+	}
+	f.AudioTracks = audioTracks(v)
+	for _, l := range v.strs("sub language") {
+		f.SubtitleTracks = append(f.SubtitleTracks, SubtitleTrack{Language: l})
+	}
+	for _, e := range v.strs("other episodes") {
+		eid, pct, _ := strings.Cut(e, ",")
+		n, err := strconv.ParseUint(eid, 10, 32)
+		if err != nil {
+			continue
+		}
+		p, _ := strconv.Atoi(pct)
+		f.OtherEpisodes = append(f.OtherEpisodes, OtherEpisode{EpisodeID: uint32(n), Percentage: p})
+	}
+	f.Related = relatedAnime(v)
+	return f
+}
+
+// audioTracks decodes the audio codec, bitrate and dub language lists,
+// which have one entry per audio track.
+func audioTracks(v fieldValues) []AudioTrack {
+	codecs := v.strs("audio codec")
+	bitrates := v.ints("audio bitrate")
+	langs := v.strs("dub language")
+	n := max(len(codecs), len(bitrates), len(langs))
+	if n == 0 {
+		return nil
+	}
+	tracks := make([]AudioTrack, n)
+	for i := range tracks {
+		if i < len(codecs) {
+			tracks[i].Codec = codecs[i]
+		}
+		if i < len(bitrates) {
+			tracks[i].Bitrate = uint32(bitrates[i])
+		}
+		if i < len(langs) {
+			tracks[i].Language = langs[i]
+		}
+	}
+	return tracks
+}
+
+// fileRequest calls the FILE command and returns the response fields.
+// v holds the lookup arguments.
+// The returned error wraps a [ReturnCode] if applicable.
+// It is a [*MultipleFilesError] if the lookup is ambiguous.
+func (c *Client) fileRequest(ctx context.Context, v url.Values, fmask FileFmask, amask FileAmask) ([]string, error) {
+	v.Set("fmask", formatMask(fmask[:]))
+	v.Set("amask", formatMask(amask[:]))
+	resp, err := c.sessionRequest(ctx, "FILE", v)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Code == MULTIPLE_FILES_FOUND {
+		multiErr, err := parseMultipleFiles(resp.Rows)
+		if err != nil {
+			return nil, err
+		}
+		return nil, multiErr
+	}
+	if resp.Code != FILE {
+		return nil, fmt.Errorf("got bad return code %w", resp.Code)
+	}
+	if n := len(resp.Rows); n != 1 {
+		return nil, fmt.Errorf("got unexpected number of rows %d", n)
+	}
+	return resp.Rows[0], nil
 }
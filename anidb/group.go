@@ -0,0 +1,136 @@
+package anidb
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Group is the data returned by the GROUP command.
+type Group struct {
+	GroupID uint32
+	// Rating is multiplied by 100, so 853 is a rating of 8.53.
+	Rating           int
+	Votes            int
+	AnimeCount       int
+	FileCount        int
+	Name             string
+	ShortName        string
+	IRCChannel       string
+	IRCServer        string
+	URL              string
+	Picname          string
+	FoundedDate      time.Time
+	DisbandedDate    time.Time
+	DateFlags        int
+	LastReleaseDate  time.Time
+	LastActivityDate time.Time
+	Relations        []GroupRelation
+}
+
+// A GroupRelation is a release group related to another group.
+type GroupRelation struct {
+	GroupID uint32
+	// Type is the AniDB relation type, such as 1 for "participant in"
+	// or 2 for "parent of".
+	Type int
+}
+
+// Group calls the GROUP command by group ID.
+// The returned error wraps a [ReturnCode] if applicable, such as
+// [NO_SUCH_GROUP].
+func (c *Client) Group(ctx context.Context, gid uint32) (Group, error) {
+	v := make(url.Values)
+	v.Set("gid", strconv.FormatUint(uint64(gid), 10))
+	resp, err := c.sessionRequest(ctx, "GROUP", v)
+	if err != nil {
+		return Group{}, fmt.Errorf("udpapi Group: %w", err)
+	}
+	if resp.Code != GROUP {
+		return Group{}, fmt.Errorf("udpapi Group: got bad return code %w", resp.Code)
+	}
+	if n := len(resp.Rows); n != 1 {
+		return Group{}, fmt.Errorf("udpapi Group: got unexpected number of rows %d", n)
+	}
+	g, err := parseGroup(resp.Rows[0])
+	if err != nil {
+		return Group{}, fmt.Errorf("udpapi Group: %s", err)
+	}
+	return g, nil
+}
+
+// groupFields describes the fields of a GROUP response, in order.
+var groupFields = []struct {
+	name string
+	typ  string
+}{
+	{"gid", "int4"},
+	{"rating", "int4"},
+	{"votes", "int4"},
+	{"acount", "int4"},
+	{"fcount", "int4"},
+	{"name", "str"},
+	{"short", "str"},
+	{"irc channel", "str"},
+	{"irc server", "str"},
+	{"url", "str"},
+	{"picname", "str"},
+	{"foundeddate", "date"},
+	{"disbandeddate", "date"},
+	{"dateflags", "int2"},
+	{"lastreleasedate", "date"},
+	{"lastactivitydate", "date"},
+	{"grouprelations", "strlist"},
+}
+
+func parseGroup(row []string) (Group, error) {
+	if len(row) != len(groupFields) {
+		return Group{}, fmt.Errorf("expected %d fields, got %d, raw: %v", len(groupFields), len(row), row)
+	}
+	v := make(fieldValues, len(row))
+	for i, raw := range row {
+		f := groupFields[i]
+		val, err := decodeField(f.typ, raw)
+		if err != nil {
+			return Group{}, fmt.Errorf("invalid %s %q: %w", f.name, raw, err)
+		}
+		v[f.name] = val
+	}
+	g := Group{
+		GroupID:          uint32(v.int("gid")),
+		Rating:           int(v.int("rating")),
+		Votes:            int(v.int("votes")),
+		AnimeCount:       int(v.int("acount")),
+		FileCount:        int(v.int("fcount")),
+		Name:             v.str("name"),
+		ShortName:        v.str("short"),
+		IRCChannel:       v.str("irc channel"),
+		IRCServer:        v.str("irc server"),
+		URL:              v.str("url"),
+		Picname:          v.str("picname"),
+		FoundedDate:      v.date("foundeddate"),
+		DisbandedDate:    v.date("disbandeddate"),
+		DateFlags:        int(v.int("dateflags")),
+		LastReleaseDate:  v.date("lastreleasedate"),
+		LastActivityDate: v.date("lastactivitydate"),
+	}
+	for _, rel := range v.strs("grouprelations") {
+		gid, typ, ok := strings.Cut(rel, ",")
+		if !ok {
+			return Group{}, fmt.Errorf("invalid group relation %q", rel)
+		}
+		id, err := strconv.ParseUint(gid, 10, 32)
+		if err != nil {
+			return Group{}, fmt.Errorf("invalid group relation %q: %w", rel, err)
+		}
+		t, err := strconv.Atoi(typ)
+		if err != nil {
+			return Group{}, fmt.Errorf("invalid group relation %q: %w", rel, err)
+		}
+		g.Relations = append(g.Relations, GroupRelation{GroupID: uint32(id), Type: t})
+	}
+	return g, nil
+}
@@ -2,35 +2,327 @@ package anidb
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
 
 	"golang.org/x/time/rate"
 )
 
+// A Priority is the scheduling class of a request.
+// Requests with a lower value are served first.
+type Priority int
+
+const (
+	// PriorityInteractive is for requests a user is waiting for.
+	PriorityInteractive Priority = iota
+	// PriorityRescan is for background work such as retries.
+	PriorityRescan
+	// PriorityBulk is for bulk work such as scanning a library.
+	// Bulk requests may only use part of the rate budget.
+	PriorityBulk
+
+	numPriorities
+)
+
+type priorityKey struct{}
+
+// WithPriority returns a context for requests with the given priority.
+// Requests default to [PriorityInteractive].
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+func priorityFrom(ctx context.Context) Priority {
+	p, ok := ctx.Value(priorityKey{}).(Priority)
+	if !ok || p < 0 || p >= numPriorities {
+		return PriorityInteractive
+	}
+	return p
+}
+
+// String returns the name of the priority.
+func (p Priority) String() string {
+	switch p {
+	case PriorityInteractive:
+		return "interactive"
+	case PriorityRescan:
+		return "rescan"
+	case PriorityBulk:
+		return "bulk"
+	default:
+		return fmt.Sprintf("Priority(%d)", int(p))
+	}
+}
+
 // A Limiter is a rate limiter that complies with AniDB UDP API flood
 // prevention recommendations.
 //
 // It functions similarly to [golang.org/x/time/rate.Limiter], except
 // with both short and long term limits.
+//
+// Requests wait while requests with a higher [Priority] are waiting,
+// and bulk requests are further limited to a share of the long term
+// rate.
+//
+// The times of recent requests can be saved to a [StateStore], so that
+// a restarted client resumes at the right rate instead of bursting.
 type limiter struct {
 	short *rate.Limiter
 	long  *rate.Limiter
+	bulk  *rate.Limiter
+
+	// window is how long recent requests affect the limits.
+	window time.Duration
+	logger *slog.Logger
+
+	mu      sync.Mutex
+	waiting [numPriorities]int
+	// changed is closed and replaced whenever waiting changes.
+	changed chan struct{}
+	stats   [numPriorities]PriorityStats
+	// recent are the times of requests within window.
+	recent []time.Time
+	store  StateStore // may be nil
+	// seq counts the changes of recent, so that saves are not
+	// reordered.
+	seq uint64
+
+	saveMu   sync.Mutex
+	savedSeq uint64
+}
+
+// defaultBulkShare is the default share of the long term rate that
+// bulk requests may use.
+const defaultBulkShare = 0.5
+
+// limiterStateKey is the [StateStore] key of the limiter state.
+const limiterStateKey = "anidb.limiter"
+
+// DefaultRateLimit is the rate limit recommended by AniDB: one request
+// every 2 seconds, and one every 4 seconds after a burst of 30.
+var DefaultRateLimit = RateLimitConfig{
+	ShortInterval: 2 * time.Second,
+	LongInterval:  4 * time.Second,
+	LongBurst:     60 / 2,
 }
 
-func newLimiter() *limiter {
-	return &limiter{
-		// Every 2 sec short term
-		short: rate.NewLimiter(0.5, 1),
-		// Every 4 sec long term after 60 seconds
-		long: rate.NewLimiter(0.25, 60/2),
+func newLimiter(cfg RateLimitConfig, l *slog.Logger) *limiter {
+	cfg = cfg.withDefaults()
+	lim := &limiter{
+		short:   rate.NewLimiter(rate.Every(cfg.ShortInterval), 1),
+		long:    rate.NewLimiter(rate.Every(cfg.LongInterval), cfg.LongBurst),
+		window:  max(cfg.LongInterval*time.Duration(cfg.LongBurst), cfg.ShortInterval),
+		logger:  l,
+		changed: make(chan struct{}),
 	}
+	lim.setBulkShare(defaultBulkShare)
+	return lim
+}
+
+// setBulkShare sets the share of the long term rate, between 0 and 1,
+// that bulk requests may use.
+func (l *limiter) setBulkShare(share float64) {
+	share = min(max(share, 0), 1)
+	l.bulk = rate.NewLimiter(l.long.Limit()*rate.Limit(share), 1)
 }
 
-func (l limiter) Wait(ctx context.Context) error {
+// bulkDelay returns how long a bulk request would currently wait for
+// its share of the rate.
+func (l *limiter) bulkDelay() time.Duration {
+	r := l.bulk.Reserve()
+	defer r.Cancel()
+	return r.Delay()
+}
+
+// A limiterState is the saved state of a limiter.
+type limiterState struct {
+	Recent []time.Time `json:"recent"`
+}
+
+// load restores the recent requests saved in store, and saves future
+// requests to it.
+// It must be called before any requests.
+func (l *limiter) load(store StateStore) error {
+	data, err := store.LoadState(limiterStateKey)
+	if err != nil {
+		return fmt.Errorf("load limiter state: %w", err)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.store = store
+	if data == nil {
+		return nil
+	}
+	var state limiterState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("load limiter state: %w", err)
+	}
+	now := time.Now()
+	for _, t := range state.Recent {
+		if t.After(now) || now.Sub(t) > l.window {
+			continue
+		}
+		// Replaying the requests takes their tokens as of the time
+		// they were sent.
+		l.short.ReserveN(t, 1)
+		l.long.ReserveN(t, 1)
+		l.recent = append(l.recent, t)
+	}
+	return nil
+}
+
+// sent records a request sent at t.
+// The recent requests are saved after l.mu is released, so that
+// waiting requests are not held up by the store.
+func (l *limiter) sent(t time.Time) {
+	l.mu.Lock()
+	i := 0
+	for i < len(l.recent) && t.Sub(l.recent[i]) > l.window {
+		i++
+	}
+	l.recent = append(l.recent[i:], t)
+	if l.store == nil {
+		l.mu.Unlock()
+		return
+	}
+	data, err := json.Marshal(limiterState{Recent: l.recent})
+	l.seq++
+	seq := l.seq
+	l.mu.Unlock()
+
+	if err == nil {
+		err = l.save(seq, data)
+	}
+	if err != nil {
+		l.logger.Error("failed to save limiter state", "error", err)
+	}
+}
+
+// save saves the state data, unless a newer state was saved
+// meanwhile.
+func (l *limiter) save(seq uint64, data []byte) error {
+	l.saveMu.Lock()
+	defer l.saveMu.Unlock()
+	if seq < l.savedSeq {
+		return nil
+	}
+	l.savedSeq = seq
+	return l.store.SaveState(limiterStateKey, data)
+}
+
+func (l *limiter) Wait(ctx context.Context) error {
+	p := priorityFrom(ctx)
+	start := time.Now()
+	if p == PriorityBulk {
+		if err := l.bulk.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	if err := l.waitTurn(ctx, p); err != nil {
+		return err
+	}
+	defer l.done(p)
 	if err := l.long.Wait(ctx); err != nil {
 		return err
 	}
 	if err := l.short.Wait(ctx); err != nil {
 		return err
 	}
+	now := time.Now()
+	l.observe(p, now.Sub(start))
+	l.sent(now)
 	return nil
 }
+
+// observe records how long a request with priority p waited.
+func (l *limiter) observe(p Priority, wait time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := &l.stats[p]
+	s.Requests++
+	s.TotalWait += wait
+	s.LastWait = wait
+}
+
+// A LimiterStats is a snapshot of the rate limiter state.
+type LimiterStats struct {
+	// ShortTokens, LongTokens and BulkTokens are the requests that
+	// the short term, long term and bulk limits currently allow
+	// without waiting.
+	ShortTokens float64
+	LongTokens  float64
+	BulkTokens  float64
+	// Priorities are the statistics of each priority.
+	Priorities map[Priority]PriorityStats
+}
+
+// PriorityStats are rate limiter statistics for one [Priority].
+type PriorityStats struct {
+	// Waiting is the number of requests currently waiting.
+	Waiting int
+	// Requests is the number of requests that were let through.
+	Requests int64
+	// TotalWait is the total time requests waited.
+	TotalWait time.Duration
+	// LastWait is how long the last request waited.
+	LastWait time.Duration
+}
+
+// snapshot returns a snapshot of the limiter state.
+func (l *limiter) snapshot() LimiterStats {
+	s := LimiterStats{
+		ShortTokens: l.short.Tokens(),
+		LongTokens:  l.long.Tokens(),
+		BulkTokens:  l.bulk.Tokens(),
+		Priorities:  make(map[Priority]PriorityStats, numPriorities),
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for p := Priority(0); p < numPriorities; p++ {
+		ps := l.stats[p]
+		ps.Waiting = l.waiting[p]
+		s.Priorities[p] = ps
+	}
+	return s
+}
+
+// waitTurn registers a waiting request with priority p, and waits
+// until no request with a higher priority is waiting.
+// If it returns nil, the caller must call [limiter.done].
+func (l *limiter) waitTurn(ctx context.Context, p Priority) error {
+	l.mu.Lock()
+	l.waiting[p]++
+	l.mu.Unlock()
+	for {
+		l.mu.Lock()
+		blocked := false
+		for q := Priority(0); q < p; q++ {
+			if l.waiting[q] > 0 {
+				blocked = true
+			}
+		}
+		changed := l.changed
+		l.mu.Unlock()
+		if !blocked {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			l.done(p)
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// done unregisters a waiting request with priority p.
+func (l *limiter) done(p Priority) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.waiting[p]--
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
@@ -0,0 +1,113 @@
+package anidb
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLimiter_priority(t *testing.T) {
+	t.Parallel()
+	l := newLimiter(DefaultRateLimit, nullLogger)
+	ctx := testContext(t, time.Second)
+	if err := l.waitTurn(ctx, PriorityInteractive); err != nil {
+		t.Fatal(err)
+	}
+
+	bulkCtx, cf := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cf()
+	if err := l.waitTurn(bulkCtx, PriorityBulk); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Got %v; want bulk request blocked by interactive request", err)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- l.waitTurn(ctx, PriorityRescan)
+	}()
+	l.done(PriorityInteractive)
+	if err := <-errc; err != nil {
+		t.Fatalf("Got %v; want rescan request unblocked", err)
+	}
+	l.done(PriorityRescan)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.waiting != [numPriorities]int{} {
+		t.Errorf("Got waiting %v; want none", l.waiting)
+	}
+}
+
+func TestWithPriority(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	if got := priorityFrom(ctx); got != PriorityInteractive {
+		t.Errorf("Got default priority %d; want %d", got, PriorityInteractive)
+	}
+	if got := priorityFrom(WithPriority(ctx, PriorityBulk)); got != PriorityBulk {
+		t.Errorf("Got priority %d; want %d", got, PriorityBulk)
+	}
+}
+
+func TestLimiter_load(t *testing.T) {
+	t.Parallel()
+	cfg := RateLimitConfig{
+		ShortInterval: time.Second,
+		LongInterval:  time.Minute,
+		LongBurst:     5,
+	}
+	store := mapStore{}
+	l := newLimiter(cfg, nullLogger)
+	if err := l.load(store); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i := range 4 {
+		l.sent(now.Add(time.Duration(i-4) * time.Millisecond))
+	}
+	// Outside of the window, so it is dropped.
+	l.sent(now.Add(-time.Hour))
+
+	l = newLimiter(cfg, nullLogger)
+	if err := l.load(store); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(l.recent); got != 4 {
+		t.Errorf("Got %d recent requests; want 4", got)
+	}
+	if got := l.long.Tokens(); got > 1.1 {
+		t.Errorf("Got %v long tokens; want about 1", got)
+	}
+	if got := l.short.Tokens(); got > 0.1 {
+		t.Errorf("Got %v short tokens; want about 0", got)
+	}
+}
+
+func TestLimiter_stats(t *testing.T) {
+	t.Parallel()
+	l := newLimiter(RateLimitConfig{
+		ShortInterval: time.Millisecond,
+		LongInterval:  time.Millisecond,
+		LongBurst:     2,
+	}, nullLogger)
+	ctx := testContext(t, time.Second)
+	for range 2 {
+		if err := l.Wait(WithPriority(ctx, PriorityRescan)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := l.snapshot()
+	ps := s.Priorities[PriorityRescan]
+	if ps.Requests != 2 {
+		t.Errorf("Got %d rescan requests; want 2", ps.Requests)
+	}
+	if ps.Waiting != 0 {
+		t.Errorf("Got %d waiting rescan requests; want 0", ps.Waiting)
+	}
+	if got := s.Priorities[PriorityInteractive].Requests; got != 0 {
+		t.Errorf("Got %d interactive requests; want 0", got)
+	}
+	if s.LongTokens > 2 {
+		t.Errorf("Got %v long tokens; want at most 2", s.LongTokens)
+	}
+}
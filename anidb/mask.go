@@ -18,27 +18,48 @@ type FileFmask [5]byte
 // FileFmaskFields describes the bit fields in a FILE fmask.
 var FileFmaskFields = map[string]bitSpec{
 	// byte 0
-	"aid":   {0, 6, "int4"},
-	"eid":   {0, 5, "int4"},
-	"gid":   {0, 4, "int4"},
-	"state": {0, 0, "int2"},
+	"aid":            {0, 6, "int4"},
+	"eid":            {0, 5, "int4"},
+	"gid":            {0, 4, "int4"},
+	"mylist id":      {0, 3, "int4"},
+	"other episodes": {0, 2, "strlist"},
+	"deprecated":     {0, 1, "bool"},
+	"state":          {0, 0, "int2"},
 
 	// byte 1
-	"size": {1, 3, "int8"},
-	"ed2k": {1, 2, "str"},
-	"md5":  {1, 1, "str"},
-	"sha1": {1, 0, "str"},
-	"crc":  {1, 7, "str"},
+	"size":               {1, 7, "int8"},
+	"ed2k":               {1, 6, "str"},
+	"md5":                {1, 5, "str"},
+	"sha1":               {1, 4, "str"},
+	"crc":                {1, 3, "str"},
+	"video colour depth": {1, 1, "str"},
 
 	// byte 2
 	"quality":         {2, 7, "str"},
 	"source":          {2, 6, "str"},
-	"audio codec":     {2, 5, "str"},
-	"audio bitrate":   {2, 4, "int4"},
+	"audio codec":     {2, 5, "strlist"},
+	"audio bitrate":   {2, 4, "intlist"},
 	"video codec":     {2, 3, "str"},
 	"video bitrate":   {2, 2, "int4"},
 	"video res":       {2, 1, "str"},
 	"video extension": {2, 0, "str"},
+
+	// byte 3
+	"dub language":      {3, 7, "strlist"},
+	"sub language":      {3, 6, "strlist"},
+	"length in seconds": {3, 5, "int4"},
+	"description":       {3, 4, "str"},
+	"aired date":        {3, 3, "date"},
+	"anidb file name":   {3, 0, "str"},
+
+	// byte 4
+	"mylist state":     {4, 7, "int4"},
+	"mylist filestate": {4, 6, "int4"},
+	"mylist viewed":    {4, 5, "bool"},
+	"mylist viewdate":  {4, 4, "date"},
+	"mylist storage":   {4, 3, "str"},
+	"mylist source":    {4, 2, "str"},
+	"mylist other":     {4, 1, "str"},
 }
 
 // Set sets a bit in the mask.
@@ -49,26 +70,46 @@ func (m *FileFmask) Set(f ...string) {
 	}
 }
 
+// Fields returns the names of the fields set in the mask, in the order
+// they appear in a response.
+func (m FileFmask) Fields() []string {
+	return maskFields(m[:], FileFmaskFields)
+}
+
 // A FileAmask is a mask for the FILE command amask field.
 type FileAmask [4]byte
 
 // FileAmaskFields describes the bit fields in a FILE amask.
 var FileAmaskFields = map[string]bitSpec{
 	// byte 0
-	"year": {0, 5, "str"},
-	"type": {0, 4, "str"},
+	"anime total episodes":   {0, 7, "int4"},
+	"highest episode number": {0, 6, "int4"},
+	"year":                   {0, 5, "str"},
+	"type":                   {0, 4, "str"},
+	"related aid list":       {0, 3, "intlist"},
+	"related aid type":       {0, 2, "intlist"},
+	"category list":          {0, 1, "strlist"},
 
 	// byte 1
-	"romaji name":  {1, 7, "str"},
-	"english name": {1, 5, "str"},
+	"romaji name":     {1, 7, "str"},
+	"kanji name":      {1, 6, "str"},
+	"english name":    {1, 5, "str"},
+	"other name":      {1, 4, "str"},
+	"short name list": {1, 3, "strlist"},
+	"synonym list":    {1, 2, "strlist"},
 
 	// byte 2
-	"epno":           {2, 7, "str"},
-	"ep name":        {2, 6, "str"},
-	"ep romaji name": {2, 5, "str"},
+	"epno":               {2, 7, "str"},
+	"ep name":            {2, 6, "str"},
+	"ep romaji name":     {2, 5, "str"},
+	"ep kanji name":      {2, 4, "str"},
+	"episode rating":     {2, 3, "int4"},
+	"episode vote count": {2, 2, "int4"},
 
 	// byte 3
-	"group name": {3, 7, "str"},
+	"group name":              {3, 7, "str"},
+	"group short name":        {3, 6, "str"},
+	"date aid record updated": {3, 0, "date"},
 }
 
 // Set sets a bit in the mask.
@@ -79,6 +120,104 @@ func (m *FileAmask) Set(f ...string) {
 	}
 }
 
+// Fields returns the names of the fields set in the mask, in the order
+// they appear in a response.
+func (m FileAmask) Fields() []string {
+	return maskFields(m[:], FileAmaskFields)
+}
+
+// FileMasks returns the FILE masks requesting the named fields.
+// Each name is looked up in [FileFmaskFields] and [FileAmaskFields].
+func FileMasks(fields ...string) (FileFmask, FileAmask, error) {
+	var fmask FileFmask
+	var amask FileAmask
+	for _, f := range fields {
+		switch {
+		case hasField(FileFmaskFields, f):
+			fmask.Set(f)
+		case hasField(FileAmaskFields, f):
+			amask.Set(f)
+		default:
+			return FileFmask{}, FileAmask{}, fmt.Errorf("unknown FILE field %q", f)
+		}
+	}
+	return fmask, amask, nil
+}
+
+// An AnimeAmask is a mask for the ANIME command amask field.
+type AnimeAmask [7]byte
+
+// AnimeAmaskFields describes the bit fields in an ANIME amask.
+var AnimeAmaskFields = map[string]bitSpec{
+	// byte 0
+	"aid":              {0, 7, "int4"},
+	"dateflags":        {0, 6, "int4"},
+	"year":             {0, 5, "str"},
+	"type":             {0, 4, "str"},
+	"related aid list": {0, 3, "intlist"},
+	"related aid type": {0, 2, "intlist"},
+
+	// byte 1
+	"romaji name":     {1, 7, "str"},
+	"kanji name":      {1, 6, "str"},
+	"english name":    {1, 5, "str"},
+	"other name":      {1, 4, "str"},
+	"short name list": {1, 3, "strlist"},
+	"synonym list":    {1, 2, "strlist"},
+
+	// byte 2
+	"episodes":               {2, 7, "int4"},
+	"highest episode number": {2, 6, "int4"},
+	"special ep count":       {2, 5, "int4"},
+	"air date":               {2, 4, "date"},
+	"end date":               {2, 3, "date"},
+	"url":                    {2, 2, "str"},
+	"picname":                {2, 1, "str"},
+
+	// byte 3
+	"rating":                {3, 7, "int4"},
+	"vote count":            {3, 6, "int4"},
+	"temp rating":           {3, 5, "int4"},
+	"temp vote count":       {3, 4, "int4"},
+	"average review rating": {3, 3, "int4"},
+	"review count":          {3, 2, "int4"},
+	"award list":            {3, 1, "strlist"},
+	"is 18+ restricted":     {3, 0, "bool"},
+
+	// byte 4
+	"ann id":              {4, 6, "int4"},
+	"allcinema id":        {4, 5, "int4"},
+	"animenfo id":         {4, 4, "str"},
+	"tag name list":       {4, 3, "strlist"},
+	"tag id list":         {4, 2, "intlist"},
+	"tag weight list":     {4, 1, "intlist"},
+	"date record updated": {4, 0, "date"},
+
+	// byte 5
+	"character id list": {5, 7, "intlist"},
+
+	// byte 6
+	"specials count": {6, 7, "int4"},
+	"credits count":  {6, 6, "int4"},
+	"other count":    {6, 5, "int4"},
+	"trailer count":  {6, 4, "int4"},
+	"parody count":   {6, 3, "int4"},
+}
+
+// Set sets a bit in the mask.
+// See [AnimeAmaskFields] for the field names.
+func (m *AnimeAmask) Set(f ...string) {
+	for _, f := range f {
+		setMaskBit(m[:], AnimeAmaskFields, f)
+	}
+}
+
+// Fields returns the names of the fields set in the mask, in the order
+// they appear in a response.
+func (m AnimeAmask) Fields() []string {
+	return maskFields(m[:], AnimeAmaskFields)
+}
+
 func setMaskBit(b []byte, m map[string]bitSpec, name string) {
 	s, ok := m[name]
 	if !ok {
@@ -87,6 +226,11 @@ func setMaskBit(b []byte, m map[string]bitSpec, name string) {
 	b[s.byte] |= 1 << s.bit
 }
 
+func hasField(m map[string]bitSpec, name string) bool {
+	_, ok := m[name]
+	return ok
+}
+
 func formatMask(m []byte) string {
 	var sb strings.Builder
 	for _, b := range m {
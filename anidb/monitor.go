@@ -0,0 +1,108 @@
+package anidb
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// DefaultKeepaliveInterval is the interval of the session monitor
+// started by [NewAuthenticatedClient].
+// NAT mappings for UDP commonly expire after a few minutes of
+// inactivity.
+const DefaultKeepaliveInterval = 5 * time.Minute
+
+// A SessionStatus describes the health of the client's AniDB session.
+type SessionStatus struct {
+	LoggedIn bool
+	// Port is the port of the client as seen by AniDB, which differs
+	// from [Client.LocalPort] behind NAT.
+	Port string
+	// LastResponse is when a response was last received from AniDB.
+	LastResponse time.Time
+	// Uptime is the AniDB server uptime at UptimeCheckedAt.
+	Uptime          time.Duration
+	UptimeCheckedAt time.Time
+	// LastError is the error of the last keepalive, if it failed.
+	LastError string
+}
+
+// SessionStatus returns the status of the client's AniDB session.
+func (c *Client) SessionStatus() SessionStatus {
+	s := c.monitorStatus.get()
+	s.LoggedIn = c.sessionKey.get() != ""
+	s.Port = c.natPort.get()
+	s.LastResponse = c.lastResponse.get()
+	return s
+}
+
+// StartMonitor starts a session monitor, which pings AniDB every
+// interval to keep the NAT mapping of the connection alive.
+// If the port seen by AniDB changes, the session is bound to the old
+// port, so the client logs in again.
+// The monitor also checks that the session is still valid, logging in
+// again if needed, and records the AniDB uptime; see
+// [Client.SessionStatus].
+// The monitor does nothing while the client is banned.
+// It returns a function that stops the monitor.
+func (c *Client) StartMonitor(interval time.Duration) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+			err := c.keepalive(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			s := c.monitorStatus.get()
+			s.LastError = ""
+			if err != nil {
+				c.logger.Warn("anidb keepalive failed", "error", err)
+				s.LastError = err.Error()
+			}
+			c.monitorStatus.set(s)
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// keepalive pings AniDB and checks the session.
+func (c *Client) keepalive(ctx context.Context) error {
+	if c.breaker.get().Tripped(time.Now()) {
+		return nil
+	}
+	ctx = WithPriority(ctx, PriorityRescan)
+	port, err := c.Ping(ctx)
+	if err != nil {
+		return err
+	}
+	if old := c.natPort.get(); old != port {
+		c.natPort.set(port)
+		if old != "" {
+			c.logger.Warn("anidb port changed, logging in again", "old", old, "new", port)
+			if err := c.relogin(ctx, c.sessionKey.get()); err != nil {
+				return fmt.Errorf("relogin after port change: %w", err)
+			}
+		}
+	}
+	ms, err := c.Uptime(ctx)
+	if err != nil {
+		return err
+	}
+	s := c.monitorStatus.get()
+	s.Uptime = time.Duration(ms) * time.Millisecond
+	s.UptimeCheckedAt = time.Now()
+	c.monitorStatus.set(s)
+	return nil
+}
@@ -15,6 +15,8 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"golang.org/x/text/encoding"
 )
 
 // A Mux multiplexes AniDB UDP API requests and responses on a single
@@ -31,6 +33,9 @@ type Mux struct {
 	wg         sync.WaitGroup
 	tagCounter tagCounter
 	block      syncVar[cipher.Block]
+	timeout    syncVar[time.Duration]
+	recorder   syncVar[*Recorder]
+	encoding   syncVar[encoding.Encoding]
 
 	// Set on init
 	conn      net.Conn
@@ -52,6 +57,7 @@ func NewMux(conn net.Conn, l *slog.Logger) *Mux {
 			logger: l.With("package", "go.felesatra.moe/anidb/udpapi", "component", "mux"),
 		},
 	}
+	m.timeout.set(defaultRequestTimeout)
 	m.wg.Add(1)
 	go func() {
 		defer m.wg.Done()
@@ -68,8 +74,8 @@ func NewMux(conn net.Conn, l *slog.Logger) *Mux {
 // This method handles decompression and decryption, as they are
 // necessary to parse response tags.
 //
-// Callers must set a deadline; otherwise the request may block
-// indefinitely due to dropped UDP packets.
+// The request times out after the duration set with
+// [Mux.SetTimeout], as UDP packets may be dropped.
 //
 // See the AniDB UDP API documentation for more information.
 //
@@ -78,11 +84,18 @@ func NewMux(conn net.Conn, l *slog.Logger) *Mux {
 //	context.DeadlineExceeded
 //	net.Error
 func (m *Mux) Request(ctx context.Context, cmd string, args url.Values) (Response, error) {
-	ctx, cf := context.WithTimeout(ctx, 5*time.Second)
+	ctx, cf := context.WithTimeout(ctx, m.timeout.get())
 	defer cf()
 	t := m.tagCounter.next()
 	args.Set("tag", string(t))
 	req := []byte(cmd + " " + args.Encode())
+	e := m.encoding.get()
+	if e != nil {
+		var err error
+		if req, err = e.NewEncoder().Bytes(req); err != nil {
+			return Response{}, fmt.Errorf("mux request: %w", err)
+		}
+	}
 	if b := m.block.get(); b != nil {
 		req = encrypt(b, req)
 	}
@@ -94,8 +107,16 @@ func (m *Mux) Request(ctx context.Context, cmd string, args url.Values) (Respons
 	}
 	select {
 	case <-ctx.Done():
+		m.record(cmd, args, nil, ctx.Err())
 		return Response{}, ctx.Err()
 	case d := <-c:
+		if e != nil {
+			var err error
+			if d, err = e.NewDecoder().Bytes(d); err != nil {
+				return Response{}, fmt.Errorf("mux request: %w", err)
+			}
+		}
+		m.record(cmd, args, d, nil)
 		resp, err := parseResponse(d)
 		if err != nil {
 			return Response{}, fmt.Errorf("mux request: %s", err)
@@ -112,6 +133,37 @@ func (m *Mux) SetBlock(b cipher.Block) {
 	m.block.set(b)
 }
 
+// SetEncoding sets the text encoding of future requests and
+// responses.
+// Set to nil for UTF-8, the default.
+// The encoding must be ASCII compatible.
+func (m *Mux) SetEncoding(e encoding.Encoding) {
+	m.encoding.set(e)
+}
+
+// SetRecorder sets a recorder for future requests and responses.
+// Set to nil to stop recording.
+func (m *Mux) SetRecorder(r *Recorder) {
+	m.recorder.set(r)
+}
+
+// record records an exchange if a recorder is set.
+func (m *Mux) record(cmd string, args url.Values, resp []byte, err error) {
+	r := m.recorder.get()
+	if r == nil {
+		return
+	}
+	if err := r.record(cmd, args, resp, err); err != nil {
+		m.logger.Error("Error recording exchange", "error", err)
+	}
+}
+
+// SetTimeout sets how long future requests wait for a response.
+// The default is 5 seconds.
+func (m *Mux) SetTimeout(d time.Duration) {
+	m.timeout.set(d)
+}
+
 // Close immediately closes the Mux.
 // The underlying connection is closed.
 // No new requests will be accepted (as the connection is closed).
@@ -130,7 +182,8 @@ func (m *Mux) handleResponses() {
 	for {
 		n, readErr := m.conn.Read(buf)
 		if n > 0 {
-			m.handleResponseData(buf[:n])
+			// The data is delivered to the requester, so buf can't be reused.
+			m.handleResponseData(bytes.Clone(buf[:n]))
 		}
 		if readErr != nil {
 			if errors.Is(readErr, net.ErrClosed) {
@@ -145,26 +198,41 @@ func (m *Mux) handleResponses() {
 // Does decryption and decompression, as it is needed to match the response tag.
 func (m *Mux) handleResponseData(data []byte) {
 	if b := m.block.get(); b != nil {
-		var err error
-		data, err = decrypt(b, data)
-		if err != nil {
-			m.logger.Error("Error decrypting response data",
-				"error", err,
-				"data", data)
-			return
+		// Decryption is in place, and data may be plain text.
+		plain, err := decrypt(b, bytes.Clone(data))
+		if err == nil {
+			if plain, ok := m.decompress(plain); ok {
+				t, resp := splitTag(plain)
+				if m.responses.pending(t) {
+					m.responses.deliver(t, resp)
+					return
+				}
+			}
 		}
+		// The server answers in plain text when it no longer knows
+		// the encryption key, such as after the session expired.
+		m.logger.Debug("Response not encrypted, trying plain text", "error", err)
+	}
+	data, ok := m.decompress(data)
+	if !ok {
+		return
 	}
+	m.responses.deliver(splitTag(data))
+}
+
+// decompress decompresses response data if it is compressed.
+func (m *Mux) decompress(data []byte) ([]byte, bool) {
 	if len(data) > 2 && data[0] == 0 && data[1] == 0 {
-		var err error
-		data, err = decompress(data[2:])
+		d, err := decompress(data[2:])
 		if err != nil {
 			m.logger.Error("Error decompressing response data",
 				"error", err,
 				"data", data)
-			return
+			return nil, false
 		}
+		return d, true
 	}
-	m.responses.deliver(splitTag(data))
+	return data, true
 }
 
 // A responseMap tracks pending UDP responses by tag, so they can be
@@ -187,6 +255,12 @@ func (m *responseMap) waitFor(t responseTag) <-chan []byte {
 	return c
 }
 
+// pending reports whether a response tag is being waited for.
+func (m *responseMap) pending(t responseTag) bool {
+	_, ok := m.m.Load(t)
+	return ok
+}
+
 func (m *responseMap) deliver(t responseTag, b []byte) {
 	v, loaded := m.m.LoadAndDelete(t)
 	if !loaded {
@@ -311,15 +385,18 @@ func encrypt(c cipher.Block, b []byte) []byte {
 // in place
 func decrypt(c cipher.Block, b []byte) ([]byte, error) {
 	bs := c.BlockSize()
-	if len(b)%bs != 0 {
+	if len(b) == 0 || len(b)%bs != 0 {
 		return nil, fmt.Errorf("decrypt blocks: incomplete blocks")
 	}
 	for i := 0; i < len(b); i += bs {
 		c.Decrypt(b[i:], b[i:])
 	}
 	// PKCS#5 padding
-	pad := b[len(b)-1]
-	return b[:len(b)-int(pad)], nil
+	pad := int(b[len(b)-1])
+	if pad == 0 || pad > bs {
+		return nil, fmt.Errorf("decrypt blocks: invalid padding")
+	}
+	return b[:len(b)-pad], nil
 }
 
 // unescape UDP field
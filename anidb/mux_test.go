@@ -288,7 +288,7 @@ func TestEncryptDecrypt(t *testing.T) {
 				t.Fatalf("data not encrypted")
 			}
 			t.Logf("encrypted data is %d bytes", len(data))
-			data, err = decrypt(cb, data)
+			data, err := decrypt(cb, data)
 			if err != nil {
 				t.Fatal(err)
 			}
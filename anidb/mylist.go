@@ -0,0 +1,391 @@
+package anidb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// A MyListState is the storage state of a MyList entry.
+type MyListState int
+
+const (
+	MyListStateUnknown  MyListState = 0
+	MyListStateInternal MyListState = 1 // on HDD
+	MyListStateExternal MyListState = 2 // on CD/DVD/...
+	MyListStateDeleted  MyListState = 3
+	MyListStateRemote   MyListState = 4 // on NAS, cloud, ...
+)
+
+var myListStateNames = []string{"unknown", "internal", "external", "deleted", "remote"}
+
+func (s MyListState) String() string {
+	if s < 0 || int(s) >= len(myListStateNames) {
+		return fmt.Sprintf("MyListState(%d)", int(s))
+	}
+	return myListStateNames[s]
+}
+
+// ParseMyListState parses the name of a MyList state, as returned by
+// [MyListState.String].
+func ParseMyListState(name string) (MyListState, error) {
+	for i, n := range myListStateNames {
+		if n == name {
+			return MyListState(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown MyList state %q", name)
+}
+
+// A MyListEntry is an entry in the MyList of the logged in user.
+type MyListEntry struct {
+	ListID    uint32
+	FileID    uint32
+	EpisodeID uint32
+	AnimeID   uint32
+	GroupID   uint32
+	Added     time.Time
+	State     MyListState
+	// ViewDate is when the file was watched, zero if it wasn't.
+	ViewDate  time.Time
+	Storage   string
+	Source    string
+	Other     string
+	FileState int
+}
+
+// Viewed reports whether the file was watched.
+func (e MyListEntry) Viewed() bool {
+	return !e.ViewDate.IsZero()
+}
+
+// myListFields describes the fields of a MyList entry in MYLIST and
+// MYLISTADD responses, in order.
+var myListFields = []struct {
+	name string
+	typ  string
+}{
+	{"lid", "int4"},
+	{"fid", "int4"},
+	{"eid", "int4"},
+	{"aid", "int4"},
+	{"gid", "int4"},
+	{"date", "date"},
+	{"state", "int2"},
+	{"viewdate", "date"},
+	{"storage", "str"},
+	{"source", "str"},
+	{"other", "str"},
+	{"filestate", "int2"},
+}
+
+func parseMyListEntry(row []string) (MyListEntry, error) {
+	if len(row) != len(myListFields) {
+		return MyListEntry{}, fmt.Errorf("expected %d fields, got %d, raw: %v", len(myListFields), len(row), row)
+	}
+	v := make(fieldValues, len(row))
+	for i, raw := range row {
+		f := myListFields[i]
+		val, err := decodeField(f.typ, raw)
+		if err != nil {
+			return MyListEntry{}, fmt.Errorf("invalid %s %q: %w", f.name, raw, err)
+		}
+		v[f.name] = val
+	}
+	return MyListEntry{
+		ListID:    uint32(v.int("lid")),
+		FileID:    uint32(v.int("fid")),
+		EpisodeID: uint32(v.int("eid")),
+		AnimeID:   uint32(v.int("aid")),
+		GroupID:   uint32(v.int("gid")),
+		Added:     v.date("date"),
+		State:     MyListState(v.int("state")),
+		ViewDate:  v.date("viewdate"),
+		Storage:   v.str("storage"),
+		Source:    v.str("source"),
+		Other:     v.str("other"),
+		FileState: int(v.int("filestate")),
+	}, nil
+}
+
+// A MyListKey selects MyList entries, by MyList ID, by file ID, or by
+// file size and ed2k hash, in that order of preference.
+type MyListKey struct {
+	ListID uint32
+	FileID uint32
+	Size   int64
+	Ed2K   string
+}
+
+// values returns the request arguments selecting the entries.
+func (k MyListKey) values() (url.Values, error) {
+	v := make(url.Values)
+	switch {
+	case k.ListID != 0:
+		v.Set("lid", strconv.FormatUint(uint64(k.ListID), 10))
+	case k.FileID != 0:
+		v.Set("fid", strconv.FormatUint(uint64(k.FileID), 10))
+	case k.Size != 0 && k.Ed2K != "":
+		v.Set("size", strconv.FormatInt(k.Size, 10))
+		v.Set("ed2k", k.Ed2K)
+	default:
+		return nil, errors.New("empty MyList key")
+	}
+	return v, nil
+}
+
+// MyListFields are the fields of a MyList entry to set.
+// Empty fields are left unchanged when editing, and set to the AniDB
+// defaults when adding.
+type MyListFields struct {
+	State MyListState
+	// Viewed sets whether the file was watched, if not nil.
+	Viewed *bool
+	// ViewDate is when the file was watched, if Viewed is true.
+	// AniDB uses the current time if it is zero.
+	ViewDate time.Time
+	Source   string
+	Storage  string
+	Other    string
+}
+
+// set sets the request arguments for the fields.
+func (f MyListFields) set(v url.Values) {
+	if f.State != MyListStateUnknown {
+		v.Set("state", strconv.Itoa(int(f.State)))
+	}
+	if f.Viewed != nil {
+		if *f.Viewed {
+			v.Set("viewed", "1")
+			if !f.ViewDate.IsZero() {
+				v.Set("viewdate", strconv.FormatInt(f.ViewDate.Unix(), 10))
+			}
+		} else {
+			v.Set("viewed", "0")
+		}
+	}
+	if f.Source != "" {
+		v.Set("source", f.Source)
+	}
+	if f.Storage != "" {
+		v.Set("storage", f.Storage)
+	}
+	if f.Other != "" {
+		v.Set("other", f.Other)
+	}
+}
+
+// A MyListExistsError is returned by [Client.MyListAdd] if the file is
+// already in MyList.
+// It wraps [FILE_ALREADY_IN_MYLIST].
+type MyListExistsError struct {
+	// Entry is the existing entry.
+	Entry MyListEntry
+}
+
+func (e *MyListExistsError) Error() string {
+	return fmt.Sprintf("%s: MyList entry %d", FILE_ALREADY_IN_MYLIST, e.Entry.ListID)
+}
+
+func (e *MyListExistsError) Unwrap() error {
+	return FILE_ALREADY_IN_MYLIST
+}
+
+// MyListAdd calls the MYLISTADD command to add a file, selected by file
+// ID or by size and ed2k hash, to MyList.
+// It returns the MyList ID of the new entry.
+// The returned error wraps a [ReturnCode] if applicable, such as
+// [NO_SUCH_FILE], or is a [*MyListExistsError] if the file is already
+// in MyList.
+func (c *Client) MyListAdd(ctx context.Context, k MyListKey, f MyListFields) (lid uint32, _ error) {
+	if k.ListID != 0 {
+		return 0, errors.New("udpapi MyListAdd: files can't be added by MyList ID")
+	}
+	v, err := k.values()
+	if err != nil {
+		return 0, fmt.Errorf("udpapi MyListAdd: %s", err)
+	}
+	f.set(v)
+	resp, err := c.sessionRequest(ctx, "MYLISTADD", v)
+	if err != nil {
+		return 0, fmt.Errorf("udpapi MyListAdd: %w", err)
+	}
+	switch resp.Code {
+	case MYLIST_ENTRY_ADDED:
+		n, err := singleInt(resp)
+		if err != nil {
+			return 0, fmt.Errorf("udpapi MyListAdd: %s", err)
+		}
+		return uint32(n), nil
+	case FILE_ALREADY_IN_MYLIST:
+		if n := len(resp.Rows); n != 1 {
+			return 0, fmt.Errorf("udpapi MyListAdd: got unexpected number of rows %d", n)
+		}
+		e, err := parseMyListEntry(resp.Rows[0])
+		if err != nil {
+			return 0, fmt.Errorf("udpapi MyListAdd: %s", err)
+		}
+		return 0, fmt.Errorf("udpapi MyListAdd: %w", &MyListExistsError{Entry: e})
+	default:
+		return 0, fmt.Errorf("udpapi MyListAdd: got bad return code %w", resp.Code)
+	}
+}
+
+// MyListEdit calls the MYLISTADD command with edit=1 to change MyList
+// entries.
+// It returns the number of edited entries.
+// The returned error wraps a [ReturnCode] if applicable, such as
+// [NO_SUCH_MYLIST_ENTRY].
+func (c *Client) MyListEdit(ctx context.Context, k MyListKey, f MyListFields) (edited int, _ error) {
+	v, err := k.values()
+	if err != nil {
+		return 0, fmt.Errorf("udpapi MyListEdit: %s", err)
+	}
+	f.set(v)
+	v.Set("edit", "1")
+	resp, err := c.sessionRequest(ctx, "MYLISTADD", v)
+	if err != nil {
+		return 0, fmt.Errorf("udpapi MyListEdit: %w", err)
+	}
+	if resp.Code != MYLIST_ENTRY_EDITED {
+		return 0, fmt.Errorf("udpapi MyListEdit: got bad return code %w", resp.Code)
+	}
+	// Only edits of several entries return their number.
+	if len(resp.Rows) == 0 {
+		return 1, nil
+	}
+	n, err := singleInt(resp)
+	if err != nil {
+		return 0, fmt.Errorf("udpapi MyListEdit: %s", err)
+	}
+	return int(n), nil
+}
+
+// MyListDel calls the MYLISTDEL command to remove MyList entries.
+// It returns the number of removed entries.
+// The returned error wraps a [ReturnCode] if applicable, such as
+// [NO_SUCH_MYLIST_ENTRY].
+func (c *Client) MyListDel(ctx context.Context, k MyListKey) (deleted int, _ error) {
+	v, err := k.values()
+	if err != nil {
+		return 0, fmt.Errorf("udpapi MyListDel: %s", err)
+	}
+	resp, err := c.sessionRequest(ctx, "MYLISTDEL", v)
+	if err != nil {
+		return 0, fmt.Errorf("udpapi MyListDel: %w", err)
+	}
+	if resp.Code != MYLIST_ENTRY_DELETED {
+		return 0, fmt.Errorf("udpapi MyListDel: got bad return code %w", resp.Code)
+	}
+	n, err := singleInt(resp)
+	if err != nil {
+		return 0, fmt.Errorf("udpapi MyListDel: %s", err)
+	}
+	return int(n), nil
+}
+
+// MyList calls the MYLIST command to get a MyList entry by MyList ID,
+// file ID, or file size and ed2k hash.
+// The returned error wraps a [ReturnCode] if applicable, such as
+// [NO_SUCH_ENTRY].
+func (c *Client) MyList(ctx context.Context, k MyListKey) (MyListEntry, error) {
+	v, err := k.values()
+	if err != nil {
+		return MyListEntry{}, fmt.Errorf("udpapi MyList: %s", err)
+	}
+	resp, err := c.sessionRequest(ctx, "MYLIST", v)
+	if err != nil {
+		return MyListEntry{}, fmt.Errorf("udpapi MyList: %w", err)
+	}
+	if resp.Code != MYLIST {
+		return MyListEntry{}, fmt.Errorf("udpapi MyList: got bad return code %w", resp.Code)
+	}
+	if n := len(resp.Rows); n != 1 {
+		return MyListEntry{}, fmt.Errorf("udpapi MyList: got unexpected number of rows %d", n)
+	}
+	e, err := parseMyListEntry(resp.Rows[0])
+	if err != nil {
+		return MyListEntry{}, fmt.Errorf("udpapi MyList: %s", err)
+	}
+	return e, nil
+}
+
+// MyListStats is the data returned by the MYLISTSTATS command.
+// Percentages are whole numbers, so 50 is 50%.
+type MyListStats struct {
+	Anime                 int
+	Episodes              int
+	Files                 int
+	SizeMB                int64
+	AddedAnime            int
+	AddedEpisodes         int
+	AddedFiles            int
+	AddedGroups           int
+	LeechPercent          int
+	GloryPercent          int
+	ViewedPercentOfDB     int
+	MyListPercentOfDB     int
+	ViewedPercentOfMyList int
+	ViewedEpisodes        int
+	Votes                 int
+	Reviews               int
+	ViewedMinutes         int64
+}
+
+// MyListStats calls the MYLISTSTATS command.
+func (c *Client) MyListStats(ctx context.Context) (MyListStats, error) {
+	resp, err := c.sessionRequest(ctx, "MYLISTSTATS", make(url.Values))
+	if err != nil {
+		return MyListStats{}, fmt.Errorf("udpapi MyListStats: %w", err)
+	}
+	if resp.Code != MYLIST_STATS {
+		return MyListStats{}, fmt.Errorf("udpapi MyListStats: got bad return code %w", resp.Code)
+	}
+	if n := len(resp.Rows); n != 1 {
+		return MyListStats{}, fmt.Errorf("udpapi MyListStats: got unexpected number of rows %d", n)
+	}
+	row := resp.Rows[0]
+	const fields = 17
+	if len(row) != fields {
+		return MyListStats{}, fmt.Errorf("udpapi MyListStats: expected %d fields, got %d, raw: %v", fields, len(row), row)
+	}
+	n := make([]int64, fields)
+	for i, raw := range row {
+		if n[i], err = strconv.ParseInt(raw, 10, 64); err != nil {
+			return MyListStats{}, fmt.Errorf("udpapi MyListStats: invalid field %d %q: %s", i, raw, err)
+		}
+	}
+	return MyListStats{
+		Anime:                 int(n[0]),
+		Episodes:              int(n[1]),
+		Files:                 int(n[2]),
+		SizeMB:                n[3],
+		AddedAnime:            int(n[4]),
+		AddedEpisodes:         int(n[5]),
+		AddedFiles:            int(n[6]),
+		AddedGroups:           int(n[7]),
+		LeechPercent:          int(n[8]),
+		GloryPercent:          int(n[9]),
+		ViewedPercentOfDB:     int(n[10]),
+		MyListPercentOfDB:     int(n[11]),
+		ViewedPercentOfMyList: int(n[12]),
+		ViewedEpisodes:        int(n[13]),
+		Votes:                 int(n[14]),
+		Reviews:               int(n[15]),
+		ViewedMinutes:         n[16],
+	}, nil
+}
+
+// singleInt parses a response with a single integer field.
+func singleInt(resp Response) (int64, error) {
+	if n := len(resp.Rows); n != 1 {
+		return 0, fmt.Errorf("got unexpected number of rows %d", n)
+	}
+	if n := len(resp.Rows[0]); n != 1 {
+		return 0, fmt.Errorf("got unexpected number of fields %d", n)
+	}
+	return strconv.ParseInt(resp.Rows[0][0], 10, 64)
+}
@@ -0,0 +1,187 @@
+package anidb
+
+import (
+	"errors"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClient_myList(t *testing.T) {
+	t.Parallel()
+	ctx := testContext(t, 5*time.Second)
+	var mu sync.Mutex
+	var requests []url.Values
+	c := newTestClient(t, func(cmd string, v url.Values) string {
+		mu.Lock()
+		defer mu.Unlock()
+		args := url.Values{}
+		for k := range v {
+			if k != "tag" && k != "s" {
+				args.Set(k, v.Get(k))
+			}
+		}
+		requests = append(requests, args)
+		switch {
+		case cmd == "MYLISTADD" && v.Get("edit") == "1":
+			return "311 MYLIST ENTRY EDITED"
+		case cmd == "MYLISTADD" && v.Get("fid") == "12":
+			return "310 FILE ALREADY IN MYLIST\n" +
+				"99|12|34|56|78|1700000000|1|1700000100|shelf|web|note|1"
+		case cmd == "MYLISTADD":
+			return "210 MYLIST ENTRY ADDED\n100"
+		case cmd == "MYLISTDEL" && v.Get("lid") == "99":
+			return "211 MYLIST ENTRY DELETED\n1"
+		case cmd == "MYLISTDEL":
+			return "411 NO SUCH MYLIST ENTRY"
+		default:
+			return "598 UNKNOWN COMMAND"
+		}
+	})
+	c.sessionKey.set("sess")
+
+	viewed := true
+	lid, err := c.MyListAdd(ctx, MyListKey{Size: 1234, Ed2K: "abcd"}, MyListFields{
+		State:  MyListStateInternal,
+		Viewed: &viewed,
+		Source: "bd",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lid != 100 {
+		t.Errorf("Got lid %d; want 100", lid)
+	}
+
+	_, err = c.MyListAdd(ctx, MyListKey{FileID: 12}, MyListFields{})
+	var exists *MyListExistsError
+	if !errors.As(err, &exists) {
+		t.Fatalf("Got error %v; want MyListExistsError", err)
+	}
+	if !errors.Is(err, FILE_ALREADY_IN_MYLIST) {
+		t.Errorf("Got error %v; want %v", err, FILE_ALREADY_IN_MYLIST)
+	}
+	want := MyListEntry{
+		ListID:    99,
+		FileID:    12,
+		EpisodeID: 34,
+		AnimeID:   56,
+		GroupID:   78,
+		Added:     time.Unix(1700000000, 0).UTC(),
+		State:     MyListStateInternal,
+		ViewDate:  time.Unix(1700000100, 0).UTC(),
+		Storage:   "shelf",
+		Source:    "web",
+		Other:     "note",
+		FileState: 1,
+	}
+	if exists.Entry != want {
+		t.Errorf("Got entry %+v; want %+v", exists.Entry, want)
+	}
+
+	edited, err := c.MyListEdit(ctx, MyListKey{ListID: 99}, MyListFields{Storage: "box"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if edited != 1 {
+		t.Errorf("Got %d edited; want 1", edited)
+	}
+
+	if _, err := c.MyListDel(ctx, MyListKey{ListID: 99}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.MyListDel(ctx, MyListKey{FileID: 1}); !errors.Is(err, NO_SUCH_MYLIST_ENTRY) {
+		t.Errorf("Got error %v; want %v", err, NO_SUCH_MYLIST_ENTRY)
+	}
+	if _, err := c.MyListDel(ctx, MyListKey{}); err == nil {
+		t.Errorf("Got no error for empty key")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	wantArgs := []string{
+		"ed2k=abcd&size=1234&source=bd&state=1&viewed=1",
+		"fid=12",
+		"edit=1&lid=99&storage=box",
+		"lid=99",
+		"fid=1",
+	}
+	if len(requests) != len(wantArgs) {
+		t.Fatalf("Got %d requests; want %d", len(requests), len(wantArgs))
+	}
+	for i, v := range requests {
+		if got := v.Encode(); got != wantArgs[i] {
+			t.Errorf("Got request %d args %q; want %q", i, got, wantArgs[i])
+		}
+	}
+}
+
+func TestMyListState(t *testing.T) {
+	t.Parallel()
+	for s := MyListStateUnknown; s <= MyListStateRemote; s++ {
+		got, err := ParseMyListState(s.String())
+		if err != nil || got != s {
+			t.Errorf("ParseMyListState(%q) = %v, %v; want %v", s.String(), got, err, s)
+		}
+	}
+	if _, err := ParseMyListState("hdd"); err == nil {
+		t.Errorf("ParseMyListState(hdd) returned no error")
+	}
+}
+
+func TestClient_myListQuery(t *testing.T) {
+	t.Parallel()
+	ctx := testContext(t, 5*time.Second)
+	c := newTestClient(t, func(cmd string, v url.Values) string {
+		switch {
+		case cmd == "MYLIST" && v.Get("fid") == "12":
+			return "221 MYLIST\n99|12|34|56|78|1700000000|3|0|||old copy|2"
+		case cmd == "MYLIST":
+			return "321 NO SUCH ENTRY"
+		case cmd == "MYLISTSTATS":
+			return "222 MYLIST STATS\n10|120|130|250000|2|20|25|3|0|5|1|2|70|84|4|1|2016"
+		default:
+			return "598 UNKNOWN COMMAND"
+		}
+	})
+	c.sessionKey.set("sess")
+
+	e, err := c.MyList(ctx, MyListKey{FileID: 12})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.ListID != 99 || e.State != MyListStateDeleted || e.Viewed() || e.Other != "old copy" {
+		t.Errorf("Got entry %+v", e)
+	}
+	if _, err := c.MyList(ctx, MyListKey{ListID: 1}); !errors.Is(err, NO_SUCH_ENTRY) {
+		t.Errorf("Got error %v; want %v", err, NO_SUCH_ENTRY)
+	}
+
+	got, err := c.MyListStats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := MyListStats{
+		Anime:                 10,
+		Episodes:              120,
+		Files:                 130,
+		SizeMB:                250000,
+		AddedAnime:            2,
+		AddedEpisodes:         20,
+		AddedFiles:            25,
+		AddedGroups:           3,
+		LeechPercent:          0,
+		GloryPercent:          5,
+		ViewedPercentOfDB:     1,
+		MyListPercentOfDB:     2,
+		ViewedPercentOfMyList: 70,
+		ViewedEpisodes:        84,
+		Votes:                 4,
+		Reviews:               1,
+		ViewedMinutes:         2016,
+	}
+	if got != want {
+		t.Errorf("Got stats %+v; want %+v", got, want)
+	}
+}
@@ -0,0 +1,257 @@
+package anidb
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/text/encoding"
+)
+
+// redacted replaces secrets in recorded traffic.
+const redacted = "REDACTED"
+
+// An Exchange is a request and its response, as recorded by a
+// [Recorder].
+type Exchange struct {
+	Time    time.Time `json:"time"`
+	Command string    `json:"command"`
+	// Args are the request arguments without the tag, with the
+	// session key and password redacted.
+	Args map[string]string `json:"args"`
+	// Response is the decrypted, decompressed and decoded response
+	// without the tag, empty if there was none.
+	Response string `json:"response,omitempty"`
+	// Error is the error of the request, such as a timeout.
+	Error string `json:"error,omitempty"`
+}
+
+// A Recorder writes AniDB traffic as JSON lines of [Exchange], for
+// debugging.
+// The session key and password are redacted.
+// See [Mux.SetRecorder].
+type Recorder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewRecorder returns a Recorder writing to w.
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{enc: json.NewEncoder(w)}
+}
+
+// record writes a request and its raw response or error.
+func (r *Recorder) record(cmd string, args url.Values, resp []byte, err error) error {
+	e := Exchange{
+		Time:     time.Now().UTC(),
+		Command:  cmd,
+		Args:     redactArgs(args),
+		Response: redactResponse(cmd, string(resp)),
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.enc.Encode(e)
+}
+
+// redactArgs returns the request arguments to record or match.
+func redactArgs(args url.Values) map[string]string {
+	m := make(map[string]string, len(args))
+	for k := range args {
+		switch k {
+		case "tag":
+		case "s", "pass":
+			m[k] = redacted
+		default:
+			m[k] = args.Get(k)
+		}
+	}
+	return m
+}
+
+// redactResponse redacts the session key of a login response.
+func redactResponse(cmd, resp string) string {
+	if cmd != "AUTH" {
+		return resp
+	}
+	code, rest, ok := strings.Cut(resp, " ")
+	if !ok || (code != "200" && code != "201") {
+		return resp
+	}
+	_, rest, _ = strings.Cut(rest, " ")
+	return code + " " + redacted + " " + rest
+}
+
+// ReadExchanges reads exchanges written by a [Recorder].
+func ReadExchanges(r io.Reader) ([]Exchange, error) {
+	var exchanges []Exchange
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+		var e Exchange
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("read exchanges: %w", err)
+		}
+		exchanges = append(exchanges, e)
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("read exchanges: %w", err)
+	}
+	return exchanges, nil
+}
+
+// DialReplay returns a Client that answers requests with recorded
+// responses instead of contacting AniDB, to reproduce a recorded
+// session offline.
+// Each request is answered with the first unused recorded response to
+// the same command and arguments, ignoring the session key and
+// password. Requests that timed out when recorded time out again.
+// Requests that were not recorded are answered with
+// [UNKNOWN_COMMAND].
+//
+// Encryption is not replayed, as recordings are decrypted; don't call
+// [Client.Encrypt] on the returned Client.
+func DialReplay(exchanges []Exchange, l *slog.Logger, name string, version int32) *Client {
+	conn := &replayConn{
+		exchanges: exchanges,
+		used:      make([]bool, len(exchanges)),
+		responses: make(chan []byte, 16),
+		closed:    make(chan struct{}),
+		logger:    l,
+	}
+	return newClient(conn, l, name, version)
+}
+
+// A replayConn is a connection that answers requests with recorded
+// responses.
+type replayConn struct {
+	mu        sync.Mutex
+	exchanges []Exchange
+	used      []bool
+	responses chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+	logger    *slog.Logger
+	// encoding is the session encoding, as the responses are
+	// recorded decoded.
+	encoding syncVar[encoding.Encoding]
+}
+
+func (c *replayConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	cmd, query, _ := strings.Cut(string(b), " ")
+	args, err := url.ParseQuery(query)
+	if err != nil {
+		return 0, fmt.Errorf("replay: invalid request: %w", err)
+	}
+	resp, ok := c.find(cmd, redactArgs(args))
+	if !ok {
+		c.logger.Warn("no recorded response", "cmd", cmd)
+		resp = fmt.Sprintf("%d UNKNOWN COMMAND", UNKNOWN_COMMAND)
+	}
+	if resp != "" {
+		data, err := c.encode(cmd, args, resp)
+		if err != nil {
+			return 0, fmt.Errorf("replay: %w", err)
+		}
+		select {
+		case c.responses <- append([]byte(args.Get("tag")+" "), data...):
+		case <-c.closed:
+			return 0, net.ErrClosed
+		}
+	}
+	return len(b), nil
+}
+
+// encode encodes a response in the session encoding, following the
+// encoding changes of the replayed session.
+func (c *replayConn) encode(cmd string, args url.Values, resp string) ([]byte, error) {
+	code, _, _ := strings.Cut(resp, " ")
+	switch {
+	case cmd == "AUTH" && (code == "200" || code == "201") && args.Has("enc"):
+		e, err := lookupEncoding(args.Get("enc"))
+		if err != nil {
+			return nil, err
+		}
+		c.encoding.set(e)
+	case cmd == "ENCODING" && code == "219":
+		e, err := lookupEncoding(args.Get("name"))
+		if err != nil {
+			return nil, err
+		}
+		c.encoding.set(e)
+	case cmd == "LOGOUT":
+		c.encoding.set(nil)
+	}
+	e := c.encoding.get()
+	if e == nil {
+		return []byte(resp), nil
+	}
+	return e.NewEncoder().Bytes([]byte(resp))
+}
+
+// find returns the first unused recorded response to a request.
+func (c *replayConn) find(cmd string, args map[string]string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, e := range c.exchanges {
+		if c.used[i] || e.Command != cmd || !equalArgs(e.Args, args) {
+			continue
+		}
+		c.used[i] = true
+		return e.Response, true
+	}
+	return "", false
+}
+
+func equalArgs(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	select {
+	case resp := <-c.responses:
+		return copy(b, resp), nil
+	case <-c.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+func (c *replayConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+var replayAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+func (c *replayConn) LocalAddr() net.Addr  { return replayAddr }
+func (c *replayConn) RemoteAddr() net.Addr { return replayAddr }
+
+func (c *replayConn) SetDeadline(t time.Time) error      { return errors.ErrUnsupported }
+func (c *replayConn) SetReadDeadline(t time.Time) error  { return errors.ErrUnsupported }
+func (c *replayConn) SetWriteDeadline(t time.Time) error { return errors.ErrUnsupported }
@@ -0,0 +1,62 @@
+package anidb
+
+import (
+	"bytes"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordReplay(t *testing.T) {
+	t.Parallel()
+	ctx := testContext(t, 5*time.Second)
+	c := newTestClient(t, func(cmd string, v url.Values) string {
+		switch cmd {
+		case "AUTH":
+			return "200 sess1 1.2.3.4:5678 LOGIN ACCEPTED"
+		case "UPTIME":
+			return "208 UPTIME\n1234"
+		default:
+			return "598 UNKNOWN COMMAND"
+		}
+	})
+	var buf bytes.Buffer
+	c.m.SetRecorder(NewRecorder(&buf))
+	u := UserInfo{UserName: "user", UserPassword: "secret"}
+	if _, err := c.Auth(ctx, u); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Uptime(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if s := buf.String(); strings.Contains(s, "secret") || strings.Contains(s, "sess1") {
+		t.Errorf("Recording not redacted: %s", s)
+	}
+
+	exchanges, err := ReadExchanges(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exchanges) != 2 {
+		t.Fatalf("Got %d exchanges; want 2", len(exchanges))
+	}
+	r := DialReplay(exchanges, nullLogger, clientName, clientVersion)
+	unlimit(r)
+	t.Cleanup(r.Close)
+	if _, err := r.Auth(ctx, UserInfo{UserName: "user", UserPassword: "other"}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := r.Uptime(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 1234 {
+		t.Errorf("Got uptime %d; want 1234", got)
+	}
+	// Each response is replayed once.
+	if _, err := r.Uptime(ctx); !errors.Is(err, UNKNOWN_COMMAND) {
+		t.Errorf("Got error %v; want %v", err, UNKNOWN_COMMAND)
+	}
+}
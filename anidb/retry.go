@@ -0,0 +1,101 @@
+package anidb
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"time"
+)
+
+const (
+	defaultRequestTimeout = 5 * time.Second
+	defaultRetries        = 3
+	defaultRetryBackoff   = 2 * time.Second
+	maxRetryBackoff       = 2 * time.Minute
+)
+
+// A RetryPolicy controls how a [Client] retries requests that failed
+// with a transient error, such as a dropped UDP packet or a
+// [ReturnCode] for which [ReturnCode.Temporary] is true.
+//
+// Every attempt waits for the client rate limiter.
+// Requests that change state on AniDB, such as AUTH and MYLISTADD, are
+// not resent when their response is lost, as the request may have
+// been carried out.
+type RetryPolicy struct {
+	// MaxRetries is the number of times a request is retried.
+	// Zero disables retries.
+	MaxRetries int
+	// Backoff is the delay before the first retry.
+	// The delay doubles on every following retry.
+	Backoff time.Duration
+}
+
+// DefaultRetryPolicy is the retry policy used by [Dial].
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries: defaultRetries,
+	Backoff:    defaultRetryBackoff,
+}
+
+// delay returns the delay before the given retry, starting at 0.
+func (p RetryPolicy) delay(retry int) time.Duration {
+	d := p.Backoff
+	for i := 0; i < retry && d < maxRetryBackoff; i++ {
+		d *= 2
+	}
+	return min(d, maxRetryBackoff)
+}
+
+// unsafeCommands change state on AniDB. Sending them again after a
+// lost response fails with MYLIST_ENTRY_ADDED or NO_SUCH_MYLIST_ENTRY,
+// or opens another session.
+var unsafeCommands = map[string]bool{
+	"AUTH":      true,
+	"LOGOUT":    true,
+	"MYLISTADD": true,
+	"MYLISTDEL": true,
+}
+
+// idempotent reports whether a request can be sent again when its
+// response was lost.
+func idempotent(cmd string, args url.Values) bool {
+	if cmd == "MYLISTADD" && args.Get("edit") == "1" {
+		return true
+	}
+	return !unsafeCommands[cmd]
+}
+
+// shouldRetry reports whether a request that returned resp and err
+// should be retried.
+// ctx is the context of the request; if it is done, retrying is
+// pointless.
+func shouldRetry(ctx context.Context, cmd string, args url.Values, resp Response, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		if !idempotent(cmd, args) {
+			return false
+		}
+		// The Mux request timed out, most likely a dropped packet.
+		if errors.Is(err, context.DeadlineExceeded) {
+			return true
+		}
+		var ne net.Error
+		return errors.As(err, &ne) && ne.Timeout()
+	}
+	return resp.Code.Temporary()
+}
+
+// sleepContext sleeps for d or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
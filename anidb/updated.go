@@ -0,0 +1,76 @@
+package anidb
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Updated is the data returned by the UPDATED command.
+type Updated struct {
+	// Count is the total number of updated anime, which may be more
+	// than the number of listed anime.
+	Count int
+	// LastUpdate is the time of the latest listed update.
+	LastUpdate time.Time
+	AnimeIDs   []uint32
+}
+
+// Updated calls the UPDATED command to list the anime whose records
+// were updated since the given time.
+// AniDB only keeps a limited history of updates, so since should not
+// be more than a few days ago.
+// No updates are returned as an empty result rather than
+// [NO_SUCH_UPDATES].
+func (c *Client) Updated(ctx context.Context, since time.Time) (Updated, error) {
+	v := make(url.Values)
+	v.Set("entity", "1")
+	v.Set("time", strconv.FormatInt(since.Unix(), 10))
+	resp, err := c.sessionRequest(ctx, "UPDATED", v)
+	if err != nil {
+		return Updated{}, fmt.Errorf("udpapi Updated: %w", err)
+	}
+	switch resp.Code {
+	case UPDATED:
+	case NO_SUCH_UPDATES:
+		return Updated{}, nil
+	default:
+		return Updated{}, fmt.Errorf("udpapi Updated: got bad return code %w", resp.Code)
+	}
+	if n := len(resp.Rows); n != 1 {
+		return Updated{}, fmt.Errorf("udpapi Updated: got unexpected number of rows %d", n)
+	}
+	u, err := parseUpdated(resp.Rows[0])
+	if err != nil {
+		return Updated{}, fmt.Errorf("udpapi Updated: %s", err)
+	}
+	return u, nil
+}
+
+func parseUpdated(row []string) (Updated, error) {
+	if n := len(row); n != 4 {
+		return Updated{}, fmt.Errorf("expected 4 fields, got %d, raw: %v", n, row)
+	}
+	count, err := strconv.Atoi(row[1])
+	if err != nil {
+		return Updated{}, fmt.Errorf("invalid count %q: %s", row[1], err)
+	}
+	last, err := decodeField("date", row[2])
+	if err != nil {
+		return Updated{}, fmt.Errorf("invalid last update date %q: %s", row[2], err)
+	}
+	u := Updated{
+		Count:      count,
+		LastUpdate: last.(time.Time),
+	}
+	for _, s := range splitList(row[3], ",") {
+		aid, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return Updated{}, fmt.Errorf("invalid aid %q: %s", s, err)
+		}
+		u.AnimeIDs = append(u.AnimeIDs, uint32(aid))
+	}
+	return u, nil
+}
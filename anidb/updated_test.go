@@ -0,0 +1,45 @@
+package anidb
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestClient_updated(t *testing.T) {
+	t.Parallel()
+	ctx := testContext(t, 5*time.Second)
+	c := newTestClient(t, func(cmd string, v url.Values) string {
+		switch {
+		case cmd != "UPDATED" || v.Get("entity") != "1":
+			return "598 UNKNOWN COMMAND"
+		case v.Get("time") == "1700000000":
+			return "243 UPDATED\n1|250|1700086400|17,4,1234"
+		default:
+			return "343 NO UPDATES"
+		}
+	})
+	c.sessionKey.set("sess")
+
+	got, err := c.Updated(ctx, time.Unix(1700000000, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Updated{
+		Count:      250,
+		LastUpdate: time.Unix(1700086400, 0).UTC(),
+		AnimeIDs:   []uint32{17, 4, 1234},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+	}
+
+	got, err = c.Updated(ctx, time.Unix(1800000000, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, Updated{}) {
+		t.Errorf("Got %+v; want no updates", got)
+	}
+}
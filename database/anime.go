@@ -0,0 +1,127 @@
+package database
+
+import (
+	"time"
+
+	"github.com/yureien/anihash/anidb"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type Anime struct {
+	gorm.Model
+
+	AnimeID uint32 `gorm:"uniqueIndex:idx_anime_id"`
+	Year    string
+	Type    string
+
+	RomajiName  string
+	KanjiName   string
+	EnglishName string
+	OtherName   string
+	ShortNames  []string `gorm:"serializer:json"`
+	Synonyms    []string `gorm:"serializer:json"`
+
+	Episodes        int
+	HighestEpisode  int
+	SpecialEpisodes int
+	AirDate         *time.Time
+	EndDate         *time.Time
+	URL             string
+	Picname         string
+
+	// Ratings are multiplied by 100, so 853 is a rating of 8.53.
+	Rating        int
+	VoteCount     int
+	TempRating    int
+	TempVoteCount int
+	ReviewRating  int
+	ReviewCount   int
+	Restricted    bool
+	RecordUpdated *time.Time
+
+	Related []AnimeRelation `gorm:"serializer:json"`
+	// Categories are only known from FILE responses.
+	Categories []string `gorm:"serializer:json"`
+
+	// Partial marks an anime only known from FILE responses, which
+	// carry a subset of its data.
+	Partial bool
+
+	// Files declares the foreign key of the files of the anime.
+	Files []File `gorm:"foreignKey:AnimeID;references:AnimeID" json:"-"`
+}
+
+type AnimeRelation struct {
+	AnimeID  uint32
+	Relation string
+}
+
+// AnimeFromAniDB converts an AniDB ANIME response to a database record.
+func AnimeFromAniDB(a anidb.Anime) Anime {
+	anime := Anime{
+		AnimeID:         a.AnimeID,
+		Year:            a.Year,
+		Type:            a.Type,
+		RomajiName:      a.RomajiName,
+		KanjiName:       a.KanjiName,
+		EnglishName:     a.EnglishName,
+		OtherName:       a.OtherName,
+		ShortNames:      a.ShortNames,
+		Synonyms:        a.Synonyms,
+		Episodes:        a.Episodes,
+		HighestEpisode:  a.HighestEpisode,
+		SpecialEpisodes: a.SpecialEpisodes,
+		AirDate:         OptionalTime(a.AirDate),
+		EndDate:         OptionalTime(a.EndDate),
+		URL:             a.URL,
+		Picname:         a.Picname,
+		Rating:          a.Rating,
+		VoteCount:       a.VoteCount,
+		TempRating:      a.TempRating,
+		TempVoteCount:   a.TempVoteCount,
+		ReviewRating:    a.ReviewRating,
+		ReviewCount:     a.ReviewCount,
+		Restricted:      a.Restricted,
+		RecordUpdated:   OptionalTime(a.RecordUpdated),
+	}
+	for _, r := range a.Related {
+		anime.Related = append(anime.Related, AnimeRelation{
+			AnimeID:  r.AnimeID,
+			Relation: r.Relation.String(),
+		})
+	}
+	return anime
+}
+
+// OptionalTime returns nil for the zero time, which AniDB uses for
+// unknown dates, so that it is stored as NULL and encoded as null.
+func OptionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// QueryAnimeByID returns an anime fetched with the ANIME command.
+// Partial anime are not returned.
+func QueryAnimeByID(db *gorm.DB, animeID uint32) (Anime, error) {
+	var anime Anime
+	if err := db.Where("anime_id = ? AND NOT partial", animeID).First(&anime).Error; err != nil {
+		return Anime{}, err
+	}
+	return anime, nil
+}
+
+// SaveAnime creates or updates an anime by its AniDB ID.
+// The categories stored from FILE responses are kept.
+func SaveAnime(db *gorm.DB, anime Anime) (Anime, error) {
+	err := db.Omit("Categories").Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "anime_id"}},
+		UpdateAll: true,
+	}).Create(&anime).Error
+	if err != nil {
+		return Anime{}, err
+	}
+	return anime, nil
+}
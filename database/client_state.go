@@ -0,0 +1,48 @@
+package database
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ClientState stores state that the AniDB client persists across
+// restarts, such as the ban circuit breaker.
+type ClientState struct {
+	Key       string `gorm:"primaryKey"`
+	Value     []byte
+	UpdatedAt int64 `gorm:"autoUpdateTime"`
+}
+
+func QueryClientState(db *gorm.DB, key string) ([]byte, error) {
+	var state ClientState
+	err := db.Where(&ClientState{Key: key}).First(&state).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return state.Value, nil
+}
+
+func SaveClientState(db *gorm.DB, key string, value []byte) error {
+	return db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&ClientState{
+		Key:   key,
+		Value: value,
+	}).Error
+}
+
+// A ClientStateStore implements anidb.StateStore with the database.
+type ClientStateStore struct {
+	DB *gorm.DB
+}
+
+func (s ClientStateStore) LoadState(key string) ([]byte, error) {
+	return QueryClientState(s.DB, key)
+}
+
+func (s ClientStateStore) SaveState(key string, value []byte) error {
+	return SaveClientState(s.DB, key, value)
+}
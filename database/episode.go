@@ -0,0 +1,101 @@
+package database
+
+import (
+	"time"
+
+	"github.com/yureien/anihash/anidb"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type Episode struct {
+	gorm.Model
+
+	EpisodeID uint32 `gorm:"uniqueIndex:idx_episode_id"`
+	AnimeID   uint32 `gorm:"index:idx_episode_anime_epno"`
+	EpNum     string `gorm:"index:idx_episode_anime_epno"`
+	// Type is one of regular, special, credit, trailer, parody or
+	// other.
+	Type string
+	// Length is the length in minutes.
+	Length int
+	// Rating is multiplied by 100, so 853 is a rating of 8.53.
+	Rating      int
+	Votes       int
+	EnglishName string
+	RomajiName  string
+	KanjiName   string
+	AirDate     *time.Time
+
+	// Partial marks an episode only known from FILE responses, which
+	// carry a subset of its data.
+	Partial bool
+
+	// Files declares the foreign key of the files of the episode.
+	Files []File `gorm:"foreignKey:EpisodeID;references:EpisodeID" json:"-"`
+}
+
+// EpisodeFromAniDB converts an AniDB EPISODE response to a database
+// record.
+func EpisodeFromAniDB(e anidb.Episode) Episode {
+	return Episode{
+		EpisodeID:   e.EpisodeID,
+		AnimeID:     e.AnimeID,
+		EpNum:       e.EpNum,
+		Type:        e.Type.String(),
+		Length:      e.Length,
+		Rating:      e.Rating,
+		Votes:       e.Votes,
+		EnglishName: e.EnglishName,
+		RomajiName:  e.RomajiName,
+		KanjiName:   e.KanjiName,
+		AirDate:     OptionalTime(e.AirDate),
+	}
+}
+
+// QueryEpisodeByID returns an episode fetched with the EPISODE
+// command.
+// Partial episodes are not returned.
+func QueryEpisodeByID(db *gorm.DB, episodeID uint32) (Episode, error) {
+	var episode Episode
+	if err := db.Where("episode_id = ? AND NOT partial", episodeID).First(&episode).Error; err != nil {
+		return Episode{}, err
+	}
+	return episode, nil
+}
+
+func QueryEpisodeByNumber(db *gorm.DB, animeID uint32, epNum string) (Episode, error) {
+	var episode Episode
+	if err := db.Where("anime_id = ? AND ep_num = ? AND NOT partial", animeID, epNum).First(&episode).Error; err != nil {
+		return Episode{}, err
+	}
+	return episode, nil
+}
+
+// QueryEpisodesByAnimeID returns the cached episodes of an anime,
+// ordered by type and episode number.
+// Partial episodes are not returned.
+func QueryEpisodesByAnimeID(db *gorm.DB, animeID uint32) ([]Episode, error) {
+	var episodes []Episode
+	// Regular episode numbers are plain numbers, other types have a
+	// one letter prefix.
+	err := db.Where("anime_id = ? AND NOT partial", animeID).
+		Order("type <> 'regular', type, length(ep_num), ep_num").
+		Find(&episodes).Error
+	if err != nil {
+		return nil, err
+	}
+	return episodes, nil
+}
+
+// SaveEpisode creates or updates an episode by its AniDB ID.
+func SaveEpisode(db *gorm.DB, episode Episode) (Episode, error) {
+	err := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "episode_id"}},
+		UpdateAll: true,
+	}).Create(&episode).Error
+	if err != nil {
+		return Episode{}, err
+	}
+	return episode, nil
+}
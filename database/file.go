@@ -1,42 +1,231 @@
 package database
 
-import "gorm.io/gorm"
+import (
+	"errors"
+	"reflect"
+	"time"
 
+	"github.com/yureien/anihash/anidb"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// An AniDBFile is a file with the data of its anime, episode and group,
+// in the shape served by the API.
+//
+// It is read from the ani_db_files view, which joins the files table
+// with the anime, episodes and groups tables; files are written with
+// [CreateFile] and [SaveFile].
 type AniDBFile struct {
 	gorm.Model
 
-	FileID          uint32 `gorm:"uniqueIndex:idx_file_id"`
-	AnimeID         uint32 `gorm:"index"`
-	EpisodeID       uint32 `gorm:"index"`
-	GroupID         uint32 `gorm:"index"`
+	FileID          uint32
+	AnimeID         uint32
+	EpisodeID       uint32
+	GroupID         uint32
+	OtherEpisodes   []FileEpisode `gorm:"serializer:json"`
+	Deprecated      bool
+	State           uint16
+	Size            int
+	Ed2K            string
+	MD5             string
+	SHA1            string
+	CRC             string
+	ColourDepth     string
+	Quality         string
+	Source          string
+	AudioTracks     []AudioTrack    `gorm:"foreignKey:FileID;references:FileID;constraint:-"`
+	SubtitleTracks  []SubtitleTrack `gorm:"foreignKey:FileID;references:FileID;constraint:-"`
+	VideoCodec      string
+	VideoBitrate    uint32
+	VideoResolution string
+	Extension       string
+	LengthInSeconds int
+	Description     string
+	AiredDate       *time.Time
+	// AniDBFileName is the canonical file name assigned by AniDB.
+	AniDBFileName string
+
+	TotalEpisodes      int
+	HighestEpisode     int
+	Year               string
+	Type               string
+	Related            []AnimeRelation `gorm:"serializer:json"`
+	Categories         []string        `gorm:"serializer:json"`
+	RomajiName         string
+	KanjiName          string
+	EnglishName        string
+	OtherName          string
+	ShortNames         []string `gorm:"serializer:json"`
+	Synonyms           []string `gorm:"serializer:json"`
+	EpNum              string
+	EpName             string
+	EpRomajiName       string
+	EpKanjiName        string
+	EpRating           int
+	EpVoteCount        int
+	GroupName          string
+	GroupShortName     string
+	AnimeRecordUpdated *time.Time
+
+	// Stale marks the file to be fetched from AniDB again before
+	// other files, because AniDB reported an update of its anime.
+	Stale bool
+}
+
+// The fields of an [AniDBFile] that are stored with its anime, episode
+// and group, and so are shared by all files of the same anime, episode
+// or group.
+var (
+	animeFileFields = []string{
+		"TotalEpisodes", "HighestEpisode", "Year", "Type", "Related", "Categories",
+		"RomajiName", "KanjiName", "EnglishName", "OtherName", "ShortNames", "Synonyms",
+		"AnimeRecordUpdated",
+	}
+	episodeFileFields = []string{"EpNum", "EpName", "EpRomajiName", "EpKanjiName", "EpRating", "EpVoteCount"}
+	groupFileFields   = []string{"GroupName", "GroupShortName"}
+)
+
+// A File is a row of the files table.
+// It references its anime, episode and group, which may be unknown for
+// files fetched with custom file fields.
+// The foreign keys are declared by the Files fields of [Anime],
+// [Episode] and [Group].
+type File struct {
+	gorm.Model
+
+	FileID          uint32        `gorm:"uniqueIndex:idx_file_id"`
+	AnimeID         *uint32       `gorm:"index"`
+	EpisodeID       *uint32       `gorm:"index"`
+	GroupID         *uint32       `gorm:"index"`
+	OtherEpisodes   []FileEpisode `gorm:"serializer:json"`
+	Deprecated      bool
 	State           uint16
 	Size            int    `gorm:"index"`
 	Ed2K            string `gorm:"uniqueIndex:idx_ed2k"`
 	MD5             string `gorm:"index"`
 	SHA1            string `gorm:"index"`
 	CRC             string `gorm:"index"`
+	ColourDepth     string
 	Quality         string
 	Source          string
-	AudioCodec      string
-	AudioBitrate    uint32
+	AudioTracks     []AudioTrack    `gorm:"foreignKey:FileID;references:FileID;constraint:OnDelete:CASCADE"`
+	SubtitleTracks  []SubtitleTrack `gorm:"foreignKey:FileID;references:FileID;constraint:OnDelete:CASCADE"`
 	VideoCodec      string
 	VideoBitrate    uint32
 	VideoResolution string
 	Extension       string
+	LengthInSeconds int
+	Description     string
+	AiredDate       *time.Time
+	AniDBFileName   string
+	Stale           bool `gorm:"index"`
+}
 
-	Year         string
-	Type         string
-	RomajiName   string
-	EnglishName  string
-	EpNum        string
-	EpName       string
-	EpRomajiName string
-	GroupName    string
+// A FileEpisode is another episode covered by a file.
+type FileEpisode struct {
+	EpisodeID  uint32
+	Percentage int
+}
+
+// FileFromAniDB converts an AniDB FILE response to a database record.
+// The MyList fields are not stored, as they belong to the user rather
+// than the file.
+func FileFromAniDB(f anidb.File) AniDBFile {
+	file := AniDBFile{
+		FileID:             f.FileID,
+		AnimeID:            f.AnimeID,
+		EpisodeID:          f.EpisodeID,
+		GroupID:            f.GroupID,
+		Deprecated:         f.Deprecated,
+		State:              f.State,
+		Size:               f.Size,
+		Ed2K:               f.Ed2K,
+		MD5:                f.MD5,
+		SHA1:               f.SHA1,
+		CRC:                f.CRC,
+		ColourDepth:        f.ColourDepth,
+		Quality:            f.Quality,
+		Source:             f.Source,
+		VideoCodec:         f.VideoCodec,
+		VideoBitrate:       f.VideoBitrate,
+		VideoResolution:    f.VideoResolution,
+		Extension:          f.Extension,
+		LengthInSeconds:    f.LengthInSeconds,
+		Description:        f.Description,
+		AiredDate:          OptionalTime(f.AiredDate),
+		AniDBFileName:      f.AniDBFileName,
+		TotalEpisodes:      f.TotalEpisodes,
+		HighestEpisode:     f.HighestEpisode,
+		Year:               f.Year,
+		Type:               f.Type,
+		Categories:         f.Categories,
+		RomajiName:         f.RomajiName,
+		KanjiName:          f.KanjiName,
+		EnglishName:        f.EnglishName,
+		OtherName:          f.OtherName,
+		ShortNames:         f.ShortNames,
+		Synonyms:           f.Synonyms,
+		EpNum:              f.EpNum,
+		EpName:             f.EpName,
+		EpRomajiName:       f.EpRomajiName,
+		EpKanjiName:        f.EpKanjiName,
+		EpRating:           f.EpRating,
+		EpVoteCount:        f.EpVoteCount,
+		GroupName:          f.GroupName,
+		GroupShortName:     f.GroupShortName,
+		AnimeRecordUpdated: OptionalTime(f.AnimeRecordUpdated),
+	}
+	for i, t := range f.AudioTracks {
+		file.AudioTracks = append(file.AudioTracks, AudioTrack{
+			FileID:      f.FileID,
+			TrackNumber: i + 1,
+			Codec:       t.Codec,
+			Bitrate:     t.Bitrate,
+			Language:    t.Language,
+		})
+	}
+	for i, t := range f.SubtitleTracks {
+		file.SubtitleTracks = append(file.SubtitleTracks, SubtitleTrack{
+			FileID:      f.FileID,
+			TrackNumber: i + 1,
+			Language:    t.Language,
+		})
+	}
+	for _, e := range f.OtherEpisodes {
+		file.OtherEpisodes = append(file.OtherEpisodes, FileEpisode{
+			EpisodeID:  e.EpisodeID,
+			Percentage: e.Percentage,
+		})
+	}
+	for _, r := range f.Related {
+		file.Related = append(file.Related, AnimeRelation{
+			AnimeID:  r.AnimeID,
+			Relation: r.Relation.String(),
+		})
+	}
+	return file
+}
+
+func QueryFileByID(db *gorm.DB, fileID uint32) (AniDBFile, error) {
+	var file AniDBFile
+	if err := withTracks(db).Where("file_id = ?", fileID).First(&file).Error; err != nil {
+		return AniDBFile{}, err
+	}
+	return file, nil
+}
+
+func QueryFilesByEpisode(db *gorm.DB, animeID, groupID uint32, epNum string) ([]AniDBFile, error) {
+	var files []AniDBFile
+	if err := withTracks(db).Where("anime_id = ? AND group_id = ? AND ep_num = ?", animeID, groupID, epNum).Order("file_id").Find(&files).Error; err != nil {
+		return nil, err
+	}
+	return files, nil
 }
 
 func QueryFileByED2KSize(db *gorm.DB, ed2k string, size int) (AniDBFile, error) {
 	var file AniDBFile
-	if err := db.Where("ed2_k = ? AND size = ?", ed2k, size).First(&file).Error; err != nil {
+	if err := withTracks(db).Where("ed2_k = ? AND size = ?", ed2k, size).First(&file).Error; err != nil {
 		return AniDBFile{}, err
 	}
 	return file, nil
@@ -44,15 +233,286 @@ func QueryFileByED2KSize(db *gorm.DB, ed2k string, size int) (AniDBFile, error)
 
 func QueryFileByHash(db *gorm.DB, hash string) (AniDBFile, error) {
 	var file AniDBFile
-	if err := db.Where("sha1 = ?", hash).Or("md5 = ?", hash).First(&file).Error; err != nil {
+	if err := withTracks(db).Where("sha1 = ?", hash).Or("md5 = ?", hash).First(&file).Error; err != nil {
 		return AniDBFile{}, err
 	}
 	return file, nil
 }
 
+func QueryFilesByGroupID(db *gorm.DB, groupID uint32) ([]AniDBFile, error) {
+	var files []AniDBFile
+	if err := withTracks(db).Where("group_id = ?", groupID).Order("anime_id, ep_num").Find(&files).Error; err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// withTracks loads the tracks of queried files.
+func withTracks(db *gorm.DB) *gorm.DB {
+	return db.
+		Preload("AudioTracks", func(db *gorm.DB) *gorm.DB { return db.Order("track_number") }).
+		Preload("SubtitleTracks", func(db *gorm.DB) *gorm.DB { return db.Order("track_number") })
+}
+
+// CreateFile creates a file along with its tracks, and creates or
+// updates its anime, episode and group.
+// It returns the ID of the created file.
 func CreateFile(db *gorm.DB, file AniDBFile) (uint, error) {
-	if err := db.Create(&file).Error; err != nil {
+	saved, _, err := saveFile(db, file, true)
+	if err != nil {
 		return 0, err
 	}
-	return file.ID, nil
+	return saved.ID, nil
+}
+
+// SaveFile creates or replaces a file along with its tracks by its
+// AniDB ID, and creates or updates its anime, episode and group.
+func SaveFile(db *gorm.DB, file AniDBFile) (AniDBFile, error) {
+	saved, _, err := saveFile(db, file, false)
+	return saved, err
+}
+
+// A fileRelation is a table that files reference and share rows of.
+type fileRelation struct {
+	column string
+	id     uint32
+	fields []string
+}
+
+// saveFile writes a file and the anime, episode and group data it
+// carries, and records the changes of the written file and of other
+// files that share its anime, episode or group.
+// Unless create is set, a stored file with the same AniDB ID is
+// replaced.
+func saveFile(db *gorm.DB, file AniDBFile, create bool) (AniDBFile, []FileChange, error) {
+	var saved AniDBFile
+	var changes []FileChange
+	err := db.Transaction(func(tx *gorm.DB) error {
+		old, err := QueryFileByID(tx, file.FileID)
+		exists := err == nil
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		// All files of an anime, episode or group see the same data, so
+		// one of them shows what the others looked like before.
+		relations := []fileRelation{
+			{"anime_id", file.AnimeID, animeFileFields},
+			{"episode_id", file.EpisodeID, episodeFileFields},
+			{"group_id", file.GroupID, groupFileFields},
+		}
+		samples := make([]*AniDBFile, len(relations))
+		for i, r := range relations {
+			if r.id == 0 {
+				continue
+			}
+			var sample AniDBFile
+			err := tx.Where(r.column+" = ?", r.id).First(&sample).Error
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			samples[i] = &sample
+		}
+
+		if err := saveFileRelations(tx, file); err != nil {
+			return err
+		}
+		record := fileRecord(file)
+		if create {
+			err = tx.Create(&record).Error
+		} else {
+			err = replaceFile(tx, record)
+		}
+		if err != nil {
+			return err
+		}
+
+		saved, err = QueryFileByID(tx, file.FileID)
+		if err != nil {
+			return err
+		}
+		if exists {
+			if changes, err = fileChanges(old, saved); err != nil {
+				return err
+			}
+		}
+		for i, r := range relations {
+			if samples[i] == nil {
+				continue
+			}
+			shared, err := fileChanges(*samples[i], saved, r.fields...)
+			if err != nil {
+				return err
+			}
+			if len(shared) == 0 {
+				continue
+			}
+			var fileIDs []uint32
+			err = tx.Model(&File{}).Where(r.column+" = ? AND file_id <> ?", r.id, file.FileID).Pluck("file_id", &fileIDs).Error
+			if err != nil {
+				return err
+			}
+			for _, fid := range fileIDs {
+				for _, c := range shared {
+					c.FileID = fid
+					changes = append(changes, c)
+				}
+			}
+		}
+		if len(changes) == 0 {
+			return nil
+		}
+		return tx.CreateInBatches(&changes, 500).Error
+	})
+	if err != nil {
+		return AniDBFile{}, nil, err
+	}
+	return saved, changes, nil
+}
+
+// replaceFile creates or replaces a file record by its AniDB ID.
+func replaceFile(tx *gorm.DB, file File) error {
+	var existing File
+	err := tx.Where("file_id = ?", file.FileID).First(&existing).Error
+	switch {
+	case err == nil:
+		file.ID = existing.ID
+		file.CreatedAt = existing.CreatedAt
+	case !errors.Is(err, gorm.ErrRecordNotFound):
+		return err
+	}
+	if err := tx.Where("file_id = ?", file.FileID).Delete(&AudioTrack{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("file_id = ?", file.FileID).Delete(&SubtitleTrack{}).Error; err != nil {
+		return err
+	}
+	return tx.Save(&file).Error
+}
+
+// fileRecord returns the row of the files table for a file.
+func fileRecord(f AniDBFile) File {
+	return File{
+		FileID:          f.FileID,
+		AnimeID:         optionalID(f.AnimeID),
+		EpisodeID:       optionalID(f.EpisodeID),
+		GroupID:         optionalID(f.GroupID),
+		OtherEpisodes:   f.OtherEpisodes,
+		Deprecated:      f.Deprecated,
+		State:           f.State,
+		Size:            f.Size,
+		Ed2K:            f.Ed2K,
+		MD5:             f.MD5,
+		SHA1:            f.SHA1,
+		CRC:             f.CRC,
+		ColourDepth:     f.ColourDepth,
+		Quality:         f.Quality,
+		Source:          f.Source,
+		AudioTracks:     f.AudioTracks,
+		SubtitleTracks:  f.SubtitleTracks,
+		VideoCodec:      f.VideoCodec,
+		VideoBitrate:    f.VideoBitrate,
+		VideoResolution: f.VideoResolution,
+		Extension:       f.Extension,
+		LengthInSeconds: f.LengthInSeconds,
+		Description:     f.Description,
+		AiredDate:       f.AiredDate,
+		AniDBFileName:   f.AniDBFileName,
+		Stale:           f.Stale,
+	}
+}
+
+// optionalID returns nil for the zero ID, which AniDB uses for unknown
+// or missing entities, such as the group of a raw file.
+func optionalID(id uint32) *uint32 {
+	if id == 0 {
+		return nil
+	}
+	return &id
+}
+
+// saveFileRelations creates or updates the anime, episode and group of
+// a file with the subset of their data in a FILE response.
+func saveFileRelations(tx *gorm.DB, f AniDBFile) error {
+	if f.AnimeID != 0 {
+		err := savePartial(tx, "anime_id", &Anime{
+			AnimeID:        f.AnimeID,
+			Year:           f.Year,
+			Type:           f.Type,
+			RomajiName:     f.RomajiName,
+			KanjiName:      f.KanjiName,
+			EnglishName:    f.EnglishName,
+			OtherName:      f.OtherName,
+			ShortNames:     f.ShortNames,
+			Synonyms:       f.Synonyms,
+			Categories:     f.Categories,
+			Episodes:       f.TotalEpisodes,
+			HighestEpisode: f.HighestEpisode,
+			Related:        f.Related,
+			RecordUpdated:  f.AnimeRecordUpdated,
+			Partial:        true,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if f.EpisodeID != 0 {
+		err := savePartial(tx, "episode_id", &Episode{
+			EpisodeID:   f.EpisodeID,
+			AnimeID:     f.AnimeID,
+			EpNum:       f.EpNum,
+			Rating:      f.EpRating,
+			Votes:       f.EpVoteCount,
+			EnglishName: f.EpName,
+			RomajiName:  f.EpRomajiName,
+			KanjiName:   f.EpKanjiName,
+			Partial:     true,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if f.GroupID != 0 {
+		err := savePartial(tx, "group_id", &Group{
+			GroupID:   f.GroupID,
+			Name:      f.GroupName,
+			ShortName: f.GroupShortName,
+			Partial:   true,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// savePartial creates a partial record, or updates an existing record
+// with the non-empty fields of the partial record.
+// Empty fields are not written, as they may just not have been
+// requested, and existing records stay complete.
+func savePartial(tx *gorm.DB, key string, record any) error {
+	stmt := &gorm.Statement{DB: tx}
+	if err := stmt.Parse(record); err != nil {
+		return err
+	}
+	rv := reflect.ValueOf(record).Elem()
+	columns := []string{"updated_at"}
+	for _, field := range stmt.Schema.Fields {
+		switch {
+		case field.DBName == "", field.PrimaryKey, field.DBName == key, field.DBName == "partial",
+			field.AutoCreateTime != 0, field.AutoUpdateTime != 0:
+			continue
+		}
+		if _, zero := field.ValueOf(tx.Statement.Context, rv); zero {
+			continue
+		}
+		columns = append(columns, field.DBName)
+	}
+	return tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: key}},
+		DoUpdates: clause.AssignmentColumns(columns),
+	}).Create(record).Error
 }
@@ -2,19 +2,61 @@ package database
 
 import (
 	"encoding/json"
+	"errors"
+	"time"
 
+	"github.com/yureien/anihash/anidb"
 	"gorm.io/gorm"
 )
 
 type FileStateEnum uint8
 
 const (
+	// FILE_PENDING means the file is waiting to be fetched from AniDB.
 	FILE_PENDING FileStateEnum = iota
+	// FILE_AVAILABLE means the file is in the database.
 	FILE_AVAILABLE
+	// FILE_ERROR means fetching the file failed permanently, for
+	// example because AniDB rejected the request as invalid.
 	FILE_ERROR
+	// FILE_NOT_FOUND means AniDB does not know the file.
+	// AniDB may add it later, so it is checked again periodically.
 	FILE_NOT_FOUND
+	// FILE_TRANSIENT_ERROR means fetching the file failed, but may
+	// succeed later, for example because AniDB was busy.
+	FILE_TRANSIENT_ERROR
 )
 
+func (e FileStateEnum) String() string {
+	switch e {
+	case FILE_PENDING:
+		return "FILE_PENDING"
+	case FILE_AVAILABLE:
+		return "FILE_AVAILABLE"
+	case FILE_ERROR:
+		return "FILE_ERROR"
+	case FILE_NOT_FOUND:
+		return "FILE_NOT_FOUND"
+	case FILE_TRANSIENT_ERROR:
+		return "FILE_TRANSIENT_ERROR"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// FileStateForError returns the state of a file for which the AniDB
+// FILE request failed with err.
+func FileStateForError(err error) FileStateEnum {
+	switch {
+	case errors.Is(err, anidb.NO_SUCH_FILE):
+		return FILE_NOT_FOUND
+	case anidb.IsTemporary(err):
+		return FILE_TRANSIENT_ERROR
+	default:
+		return FILE_ERROR
+	}
+}
+
 type FileState struct {
 	gorm.Model
 
@@ -23,29 +65,39 @@ type FileState struct {
 	Size   int64   `gorm:"index"`
 	State  uint8
 	Error  string
+
+	// Attempts is the number of consecutive failed attempts to fetch
+	// the file from AniDB.
+	Attempts      int
+	LastAttemptAt *time.Time
+	// NextRetryAt is when a failed file is fetched again, if ever.
+	NextRetryAt *time.Time `gorm:"index"`
+	// Scanned is set for files found by the scanner, which are added
+	// to MyList once they are identified. It is cleared once they are.
+	Scanned bool `gorm:"index"`
+	// MyListAttempts is the number of consecutive failed attempts to
+	// add the file to MyList.
+	MyListAttempts int
+	// MyListRetryAt is when a file that could not be added to MyList
+	// is added again.
+	MyListRetryAt *time.Time
 }
 
 func (fs FileState) MarshalJSON() ([]byte, error) {
-	var stateName string
-	switch FileStateEnum(fs.State) {
-	case FILE_PENDING:
-		stateName = "FILE_PENDING"
-	case FILE_AVAILABLE:
-		stateName = "FILE_AVAILABLE"
-	case FILE_ERROR:
-		stateName = "FILE_ERROR"
-	default:
-		stateName = "UNKNOWN"
-	}
-
 	return json.Marshal(struct {
-		FileID *uint32 `json:"file_id"`
-		State  string  `json:"state"`
-		Error  string  `json:"error"`
+		FileID        *uint32    `json:"file_id"`
+		State         string     `json:"state"`
+		Error         string     `json:"error"`
+		Attempts      int        `json:"attempts"`
+		LastAttemptAt *time.Time `json:"last_attempt_at,omitempty"`
+		NextRetryAt   *time.Time `json:"next_retry_at,omitempty"`
 	}{
-		FileID: fs.FileID,
-		State:  stateName,
-		Error:  fs.Error,
+		FileID:        fs.FileID,
+		State:         FileStateEnum(fs.State).String(),
+		Error:         fs.Error,
+		Attempts:      fs.Attempts,
+		LastAttemptAt: fs.LastAttemptAt,
+		NextRetryAt:   fs.NextRetryAt,
 	})
 }
 
@@ -73,6 +125,82 @@ func QueryPendingFiles(db *gorm.DB) ([]FileState, error) {
 	return fileStates, nil
 }
 
+// RequeueDueFileStates resets failed files whose next retry is due at
+// now back to pending, and returns them.
+// Failed files from before retries were scheduled are always due.
+func RequeueDueFileStates(db *gorm.DB, now time.Time) ([]FileState, error) {
+	var fileStates []FileState
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("state IN ? AND (next_retry_at <= ? OR (next_retry_at IS NULL AND attempts = 0))", []uint8{
+			uint8(FILE_ERROR),
+			uint8(FILE_NOT_FOUND),
+			uint8(FILE_TRANSIENT_ERROR),
+		}, now).Find(&fileStates).Error
+		if err != nil || len(fileStates) == 0 {
+			return err
+		}
+		ids := make([]uint, len(fileStates))
+		for i := range fileStates {
+			ids[i] = fileStates[i].ID
+			fileStates[i].State = uint8(FILE_PENDING)
+			fileStates[i].NextRetryAt = nil
+		}
+		return tx.Model(&FileState{}).Where("id IN ?", ids).Updates(map[string]any{
+			"state":         uint8(FILE_PENDING),
+			"next_retry_at": nil,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fileStates, nil
+}
+
+// MarkFileStateScanned marks a file as found by the scanner.
+func MarkFileStateScanned(db *gorm.DB, ed2k string, size int64) error {
+	return db.Model(&FileState{}).
+		Where("ed2_k = ? AND size = ? AND NOT scanned", ed2k, size).
+		UpdateColumn("scanned", true).Error
+}
+
+// QueryMyListPendingFileStates returns up to limit identified files
+// found by the scanner that are due to be added to MyList at now.
+func QueryMyListPendingFileStates(db *gorm.DB, now time.Time, limit int) ([]FileState, error) {
+	var fileStates []FileState
+	err := db.Where("scanned AND state = ? AND file_id IS NOT NULL AND (my_list_retry_at IS NULL OR my_list_retry_at <= ?)",
+		uint8(FILE_AVAILABLE), now).
+		Order("id").Limit(limit).Find(&fileStates).Error
+	if err != nil {
+		return nil, err
+	}
+	return fileStates, nil
+}
+
+// ClearFileStateScanned marks a file found by the scanner as added to
+// MyList.
+func ClearFileStateScanned(db *gorm.DB, id uint) error {
+	return db.Model(&FileState{}).Where("id = ?", id).Updates(map[string]any{
+		"scanned":          false,
+		"my_list_attempts": 0,
+		"my_list_retry_at": nil,
+	}).Error
+}
+
+// UpdateMyListFailedFileState records a failed attempt to add a file to
+// MyList, and schedules the next attempt according to schedule as if
+// the file had ended up in state.
+// If the schedule does not retry, the file is no longer added.
+func UpdateMyListFailedFileState(db *gorm.DB, fileState FileState, state FileStateEnum, schedule RetrySchedule) error {
+	attempts := fileState.MyListAttempts + 1
+	d, ok := schedule.Delay(state, attempts)
+	retryAt := time.Now().Add(d)
+	return db.Model(&FileState{}).Where("id = ?", fileState.ID).Updates(map[string]any{
+		"scanned":          ok,
+		"my_list_attempts": attempts,
+		"my_list_retry_at": retryAt,
+	}).Error
+}
+
 func CreatePendingFileState(db *gorm.DB, ed2k string, size int64) (FileState, error) {
 	fileState := FileState{
 		Ed2K:  ed2k,
@@ -85,16 +213,53 @@ func CreatePendingFileState(db *gorm.DB, ed2k string, size int64) (FileState, er
 	return fileState, nil
 }
 
-func UpdateErroredFileState(db *gorm.DB, ed2k string, size int64, state FileStateEnum, error string) error {
-	return db.Model(&FileState{}).Where("ed2_k = ? AND size = ?", ed2k, size).Updates(map[string]any{
-		"state": uint8(state),
-		"error": error,
-	}).Error
+// UpdateErroredFileState records a failed attempt to fetch a file,
+// and schedules the next attempt according to schedule.
+func UpdateErroredFileState(db *gorm.DB, ed2k string, size int64, state FileStateEnum, errMsg string, schedule RetrySchedule) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		fileState, err := QueryFileStateByEd2KSize(tx, ed2k, size)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		attempts := fileState.Attempts + 1
+		var nextRetryAt *time.Time
+		if d, ok := schedule.Delay(state, attempts); ok {
+			t := now.Add(d)
+			nextRetryAt = &t
+		}
+		return tx.Model(&fileState).Updates(map[string]any{
+			"state":           uint8(state),
+			"error":           errMsg,
+			"attempts":        attempts,
+			"last_attempt_at": now,
+			"next_retry_at":   nextRetryAt,
+		}).Error
+	})
 }
 
 func UpdateAvailableFileState(db *gorm.DB, fileID uint, ed2k string, size int64) error {
 	return db.Model(&FileState{}).Where("ed2_k = ? AND size = ?", ed2k, size).Updates(map[string]any{
-		"state":   uint8(FILE_AVAILABLE),
-		"file_id": fileID,
+		"state":           uint8(FILE_AVAILABLE),
+		"file_id":         fileID,
+		"error":           "",
+		"attempts":        0,
+		"last_attempt_at": time.Now(),
+		"next_retry_at":   nil,
 	}).Error
 }
+
+// SaveAvailableFileState marks a file fetched from AniDB without a
+// queued lookup as available, creating its state if needed.
+func SaveAvailableFileState(db *gorm.DB, fileID uint32, ed2k string, size int64) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		_, err := QueryFileStateByEd2KSize(tx, ed2k, size)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			_, err = CreatePendingFileState(tx, ed2k, size)
+		}
+		if err != nil {
+			return err
+		}
+		return UpdateAvailableFileState(tx, uint(fileID), ed2k, size)
+	})
+}
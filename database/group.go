@@ -0,0 +1,80 @@
+package database
+
+import (
+	"time"
+
+	"github.com/yureien/anihash/anidb"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type Group struct {
+	gorm.Model
+
+	GroupID uint32 `gorm:"uniqueIndex:idx_group_id"`
+	// Rating is multiplied by 100, so 853 is a rating of 8.53.
+	Rating           int
+	Votes            int
+	AnimeCount       int
+	FileCount        int
+	Name             string `gorm:"index"`
+	ShortName        string `gorm:"index"`
+	Website          string
+	IRCChannel       string
+	IRCServer        string
+	Picname          string
+	FoundedDate      *time.Time
+	DisbandedDate    *time.Time
+	LastReleaseDate  *time.Time
+	LastActivityDate *time.Time
+
+	// Partial marks a group only known from FILE responses, which
+	// carry a subset of its data.
+	Partial bool
+
+	// Files declares the foreign key of the files of the group.
+	Files []File `gorm:"foreignKey:GroupID;references:GroupID" json:"-"`
+}
+
+// GroupFromAniDB converts an AniDB GROUP response to a database record.
+func GroupFromAniDB(g anidb.Group) Group {
+	return Group{
+		GroupID:          g.GroupID,
+		Rating:           g.Rating,
+		Votes:            g.Votes,
+		AnimeCount:       g.AnimeCount,
+		FileCount:        g.FileCount,
+		Name:             g.Name,
+		ShortName:        g.ShortName,
+		Website:          g.URL,
+		IRCChannel:       g.IRCChannel,
+		IRCServer:        g.IRCServer,
+		Picname:          g.Picname,
+		FoundedDate:      OptionalTime(g.FoundedDate),
+		DisbandedDate:    OptionalTime(g.DisbandedDate),
+		LastReleaseDate:  OptionalTime(g.LastReleaseDate),
+		LastActivityDate: OptionalTime(g.LastActivityDate),
+	}
+}
+
+// QueryGroupByID returns a group fetched with the GROUP command.
+// Partial groups are not returned.
+func QueryGroupByID(db *gorm.DB, groupID uint32) (Group, error) {
+	var group Group
+	if err := db.Where("group_id = ? AND NOT partial", groupID).First(&group).Error; err != nil {
+		return Group{}, err
+	}
+	return group, nil
+}
+
+// SaveGroup creates or updates a group by its AniDB ID.
+func SaveGroup(db *gorm.DB, group Group) (Group, error) {
+	err := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "group_id"}},
+		UpdateAll: true,
+	}).Create(&group).Error
+	if err != nil {
+		return Group{}, err
+	}
+	return group, nil
+}
@@ -0,0 +1,82 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// A Job is a queued request to fetch a file from AniDB, either by ed2k
+// and size or by file ID.
+// There is at most one job per ed2k and size, and per file ID.
+type Job struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+
+	Ed2K string `gorm:"uniqueIndex:idx_job_key"`
+	Size int64  `gorm:"uniqueIndex:idx_job_key"`
+	// FileID is set instead of Ed2K and Size for lookups by file ID.
+	FileID uint32 `gorm:"uniqueIndex:idx_job_key"`
+	// Priority is an anidb.Priority; lower values are served first.
+	Priority int `gorm:"index"`
+}
+
+// CreateJob queues a job, unless one for the same ed2k and size is
+// already queued.
+// If one is queued, it is raised to the given priority if that is
+// higher.
+// It reports whether a job was queued or raised.
+func CreateJob(db *gorm.DB, ed2k string, size int64, priority int) (bool, error) {
+	return createJob(db, Job{
+		Ed2K:     ed2k,
+		Size:     size,
+		Priority: priority,
+	})
+}
+
+// CreateFileIDJob queues a job to fetch a file by ID, like [CreateJob].
+func CreateFileIDJob(db *gorm.DB, fid uint32, priority int) (bool, error) {
+	return createJob(db, Job{
+		FileID:   fid,
+		Priority: priority,
+	})
+}
+
+func createJob(db *gorm.DB, job Job) (bool, error) {
+	res := db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "ed2_k"}, {Name: "size"}, {Name: "file_id"}},
+		DoUpdates: clause.Set{{
+			Column: clause.Column{Name: "priority"},
+			Value:  gorm.Expr("excluded.priority"),
+		}},
+		Where: clause.Where{Exprs: []clause.Expression{
+			gorm.Expr("excluded.priority < jobs.priority"),
+		}},
+	}).Create(&job)
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return res.RowsAffected > 0, nil
+}
+
+// QueryNextJob returns the oldest queued job with the highest priority.
+func QueryNextJob(db *gorm.DB) (Job, error) {
+	var job Job
+	if err := db.Order("priority, id").First(&job).Error; err != nil {
+		return Job{}, err
+	}
+	return job, nil
+}
+
+func CountJobs(db *gorm.DB) (int64, error) {
+	var n int64
+	if err := db.Model(&Job{}).Count(&n).Error; err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func DeleteJob(db *gorm.DB, id uint) error {
+	return db.Delete(&Job{}, id).Error
+}
@@ -3,6 +3,7 @@ package database
 import (
 	"errors"
 	"log/slog"
+	"strings"
 
 	slogGorm "github.com/orandin/slog-gorm"
 	"gorm.io/driver/sqlite"
@@ -18,7 +19,21 @@ func LoadDatabase(logger *slog.Logger, cfg *DatabaseConfig) (*gorm.DB, error) {
 		return nil, err
 	}
 
-	err = db.AutoMigrate(&AniDBFile{})
+	// The view reads from the tables that are migrated below.
+	if err := dropFileView(db); err != nil {
+		return nil, err
+	}
+
+	if err := migrate(db, logger); err != nil {
+		return nil, err
+	}
+
+	err = db.AutoMigrate(&Anime{}, &Episode{}, &Group{}, &File{})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.AutoMigrate(&AudioTrack{}, &SubtitleTrack{})
 	if err != nil {
 		return nil, err
 	}
@@ -28,6 +43,30 @@ func LoadDatabase(logger *slog.Logger, cfg *DatabaseConfig) (*gorm.DB, error) {
 		return nil, err
 	}
 
+	err = db.AutoMigrate(&ClientState{})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.AutoMigrate(&Job{})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.AutoMigrate(&MyListEntry{})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.AutoMigrate(&FileChange{})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := createFileView(db); err != nil {
+		return nil, err
+	}
+
 	return db, nil
 }
 
@@ -38,7 +77,19 @@ func loadSQLiteDatabase(cfg *SQLiteConfig, logger *slog.Logger) (*gorm.DB, error
 		slogGorm.SetLogLevel(slogGorm.DefaultLogType, slog.LevelDebug),
 	)
 
-	db, err := gorm.Open(sqlite.Open(cfg.Path), &gorm.Config{
+	// Foreign keys are off by default in SQLite.
+	// Transactions take the write lock when they begin, so that
+	// concurrent transactions that read before they write, such as
+	// two saves of the same file, wait for each other rather than fail
+	// with "database is locked".
+	dsn := cfg.Path
+	if strings.Contains(dsn, "?") {
+		dsn += "&"
+	} else {
+		dsn += "?"
+	}
+	dsn += "_foreign_keys=on&_txlock=immediate"
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{
 		Logger: gormLogger,
 	})
 	if err != nil {
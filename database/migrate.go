@@ -0,0 +1,503 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// A SchemaMigration is a migration applied to the database.
+type SchemaMigration struct {
+	Version   int `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+// A migration converts the data of a database from the previous
+// version in place.
+//
+// Migrations run before the tables are auto-migrated, so they may
+// rename or drop tables but should create the tables they fill
+// themselves. New columns and tables need no migration.
+type migration struct {
+	version int
+	name    string
+	up      func(tx *gorm.DB) error
+}
+
+// migrations are applied in order. Released migrations must not be
+// changed; add a new one instead.
+var migrations = []migration{
+	{1, "split files into anime, episode, group and file tables", splitFiles},
+	{2, "key jobs by file ID too", dropJobIndex},
+}
+
+// migrate applies the migrations that the database is missing.
+// Databases created before versioning are at version 0, and new
+// databases run all migrations, which find nothing to convert.
+func migrate(db *gorm.DB, logger *slog.Logger) error {
+	if err := db.AutoMigrate(&SchemaMigration{}); err != nil {
+		return err
+	}
+	var applied []int
+	if err := db.Model(&SchemaMigration{}).Pluck("version", &applied).Error; err != nil {
+		return err
+	}
+	done := make(map[int]bool, len(applied))
+	for _, v := range applied {
+		done[v] = true
+		if v > migrations[len(migrations)-1].version {
+			return fmt.Errorf("database is at version %d, which is newer than this version of anihash supports", v)
+		}
+	}
+
+	for _, m := range migrations {
+		if done[m.version] {
+			continue
+		}
+		logger.Info("migrating database", "version", m.version, "migration", m.name)
+		if err := applyMigration(db, m); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+	}
+	return nil
+}
+
+// applyMigration applies a migration in a transaction.
+// Foreign keys are off while tables are rebuilt, as SQLite recommends,
+// and are checked before the migration commits.
+func applyMigration(db *gorm.DB, m migration) error {
+	return db.Connection(func(conn *gorm.DB) error {
+		if err := conn.Exec("PRAGMA foreign_keys = OFF").Error; err != nil {
+			return err
+		}
+		defer conn.Exec("PRAGMA foreign_keys = ON")
+
+		return conn.Transaction(func(tx *gorm.DB) error {
+			if err := m.up(tx); err != nil {
+				return err
+			}
+			var violations []struct {
+				Table  string
+				Parent string
+			}
+			if err := tx.Raw("PRAGMA foreign_key_check").Scan(&violations).Error; err != nil {
+				return err
+			}
+			if len(violations) > 0 {
+				return fmt.Errorf("%d rows of %s reference missing rows of %s", len(violations), violations[0].Table, violations[0].Parent)
+			}
+			return tx.Create(&SchemaMigration{
+				Version:   m.version,
+				Name:      m.name,
+				AppliedAt: time.Now(),
+			}).Error
+		})
+	})
+}
+
+// dropJobIndex drops the unique index of jobs by ed2k and size, which
+// is replaced by one that includes the file ID.
+func dropJobIndex(tx *gorm.DB) error {
+	return tx.Exec("DROP INDEX IF EXISTS idx_job_ed2k_size").Error
+}
+
+// isTable reports whether name is a table, rather than a view or
+// nothing.
+func isTable(tx *gorm.DB, name string) (bool, error) {
+	var n int64
+	err := tx.Raw("SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = ?", name).Scan(&n).Error
+	return n > 0, err
+}
+
+// renameTable renames a table and drops its indexes, as index names
+// are unique per database and the new table reuses them.
+func renameTable(tx *gorm.DB, from, to string) error {
+	if err := tx.Exec(fmt.Sprintf("ALTER TABLE `%s` RENAME TO `%s`", from, to)).Error; err != nil {
+		return err
+	}
+	var indexes []string
+	err := tx.Raw("SELECT name FROM sqlite_master WHERE type = 'index' AND tbl_name = ? AND sql IS NOT NULL", to).Scan(&indexes).Error
+	if err != nil {
+		return err
+	}
+	for _, index := range indexes {
+		if err := tx.Exec(fmt.Sprintf("DROP INDEX `%s`", index)).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A copiedColumn is a column filled from a legacy table by expr, which
+// uses the legacy column src.
+// If the legacy table lacks src, as it was created by an older
+// version, the column is left NULL.
+// Columns without src are always filled by expr.
+type copiedColumn struct {
+	dst  string
+	src  string
+	expr string
+}
+
+// copyRows copies rows from a legacy table, aliased as l, with the
+// where and conflict clauses appended to the query.
+func copyRows(tx *gorm.DB, dst, src string, columns []copiedColumn, where, conflict string) error {
+	var existing []string
+	if err := tx.Raw("SELECT name FROM pragma_table_info(?)", src).Scan(&existing).Error; err != nil {
+		return err
+	}
+	if len(existing) == 0 {
+		return fmt.Errorf("no table %s", src)
+	}
+	var dsts, exprs []string
+	for _, c := range columns {
+		if c.src != "" && !containsFold(existing, c.src) {
+			continue
+		}
+		expr := c.expr
+		if expr == "" {
+			expr = "`" + c.src + "`"
+		}
+		dsts = append(dsts, "`"+c.dst+"`")
+		exprs = append(exprs, expr)
+	}
+	query := fmt.Sprintf("INSERT INTO `%s` (%s) SELECT %s FROM `%s` AS l WHERE %s %s",
+		dst, strings.Join(dsts, ", "), strings.Join(exprs, ", "), src, where, conflict)
+	return tx.Exec(query).Error
+}
+
+func containsFold(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitFiles moves the anime, episode and group data out of the
+// ani_db_files table, which repeated it for every file, into the
+// anime, episodes and groups tables, and moves the rest into the files
+// table. The track tables are rebuilt to reference the files table,
+// and files stored before tracks had their own table get their audio
+// tracks from the legacy audio columns.
+//
+// Anime, episodes and groups that were not cached yet are created as
+// partial records from the latest file that references them.
+// ani_db_files is then created as a view by [LoadDatabase].
+func splitFiles(tx *gorm.DB) error {
+	legacy, err := isTable(tx, "ani_db_files")
+	if err != nil || !legacy {
+		return err
+	}
+	renames := [][2]string{
+		{"ani_db_files", "legacy_ani_db_files"},
+		{"audio_tracks", "legacy_audio_tracks"},
+		{"subtitle_tracks", "legacy_subtitle_tracks"},
+	}
+	for _, r := range renames {
+		ok, err := isTable(tx, r[0])
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := renameTable(tx, r[0], r[1]); err != nil {
+			return err
+		}
+	}
+
+	err = tx.AutoMigrate(&Anime{}, &Episode{}, &Group{}, &File{}, &AudioTrack{}, &SubtitleTrack{})
+	if err != nil {
+		return err
+	}
+	for _, table := range []string{"animes", "episodes", "groups"} {
+		if err := tx.Exec(fmt.Sprintf("UPDATE `%s` SET partial = false WHERE partial IS NULL", table)).Error; err != nil {
+			return err
+		}
+	}
+
+	err = copyPartial(tx, "animes", "anime_id", []copiedColumn{
+		{dst: "created_at", src: "created_at"},
+		{dst: "updated_at", src: "updated_at"},
+		{dst: "anime_id", src: "anime_id"},
+		{dst: "year", src: "year"},
+		{dst: "type", src: "type"},
+		{dst: "romaji_name", src: "romaji_name"},
+		{dst: "kanji_name", src: "kanji_name"},
+		{dst: "english_name", src: "english_name"},
+		{dst: "other_name", src: "other_name"},
+		{dst: "short_names", src: "short_names"},
+		{dst: "synonyms", src: "synonyms"},
+		{dst: "episodes", src: "total_episodes"},
+		{dst: "highest_episode", src: "highest_episode"},
+		{dst: "related", src: "related"},
+		{dst: "categories", src: "categories"},
+		{dst: "record_updated", src: "anime_record_updated"},
+	})
+	if err != nil {
+		return err
+	}
+	err = copyPartial(tx, "episodes", "episode_id", []copiedColumn{
+		{dst: "created_at", src: "created_at"},
+		{dst: "updated_at", src: "updated_at"},
+		{dst: "episode_id", src: "episode_id"},
+		{dst: "anime_id", src: "anime_id"},
+		{dst: "ep_num", src: "ep_num"},
+		{dst: "english_name", src: "ep_name"},
+		{dst: "romaji_name", src: "ep_romaji_name"},
+		{dst: "kanji_name", src: "ep_kanji_name"},
+		{dst: "rating", src: "ep_rating"},
+		{dst: "votes", src: "ep_vote_count"},
+	})
+	if err != nil {
+		return err
+	}
+	err = copyPartial(tx, "groups", "group_id", []copiedColumn{
+		{dst: "created_at", src: "created_at"},
+		{dst: "updated_at", src: "updated_at"},
+		{dst: "group_id", src: "group_id"},
+		{dst: "name", src: "group_name"},
+		{dst: "short_name", src: "group_short_name"},
+	})
+	if err != nil {
+		return err
+	}
+
+	err = copyRows(tx, "files", "legacy_ani_db_files", []copiedColumn{
+		{dst: "id", src: "id"},
+		{dst: "created_at", src: "created_at"},
+		{dst: "updated_at", src: "updated_at"},
+		{dst: "deleted_at", src: "deleted_at"},
+		{dst: "file_id", src: "file_id"},
+		{dst: "anime_id", src: "anime_id", expr: "NULLIF(anime_id, 0)"},
+		{dst: "episode_id", src: "episode_id", expr: "NULLIF(episode_id, 0)"},
+		{dst: "group_id", src: "group_id", expr: "NULLIF(group_id, 0)"},
+		{dst: "other_episodes", src: "other_episodes"},
+		{dst: "deprecated", src: "deprecated"},
+		{dst: "state", src: "state"},
+		{dst: "size", src: "size"},
+		{dst: "ed2_k", src: "ed2_k"},
+		{dst: "md5", src: "md5"},
+		{dst: "sha1", src: "sha1"},
+		{dst: "crc", src: "crc"},
+		{dst: "colour_depth", src: "colour_depth"},
+		{dst: "quality", src: "quality"},
+		{dst: "source", src: "source"},
+		{dst: "video_codec", src: "video_codec"},
+		{dst: "video_bitrate", src: "video_bitrate"},
+		{dst: "video_resolution", src: "video_resolution"},
+		{dst: "extension", src: "extension"},
+		{dst: "length_in_seconds", src: "length_in_seconds"},
+		{dst: "description", src: "description"},
+		{dst: "aired_date", src: "aired_date"},
+		{dst: "ani_db_file_name", src: "ani_db_file_name"},
+		{dst: "stale", src: "stale", expr: "coalesce(stale, false)"},
+	}, "true", "")
+	if err != nil {
+		return err
+	}
+
+	// Tracks of files that no longer exist are dropped.
+	ofFiles := "file_id IN (SELECT file_id FROM files)"
+	if ok, err := isTable(tx, "legacy_audio_tracks"); err != nil {
+		return err
+	} else if ok {
+		err := copyRows(tx, "audio_tracks", "legacy_audio_tracks", []copiedColumn{
+			{dst: "id", src: "id"},
+			{dst: "file_id", src: "file_id"},
+			{dst: "track_number", src: "track_number"},
+			{dst: "codec", src: "codec"},
+			{dst: "bitrate", src: "bitrate"},
+			{dst: "language", src: "language"},
+		}, ofFiles, "")
+		if err != nil {
+			return err
+		}
+	}
+	if ok, err := isTable(tx, "legacy_subtitle_tracks"); err != nil {
+		return err
+	} else if ok {
+		err := copyRows(tx, "subtitle_tracks", "legacy_subtitle_tracks", []copiedColumn{
+			{dst: "id", src: "id"},
+			{dst: "file_id", src: "file_id"},
+			{dst: "track_number", src: "track_number"},
+			{dst: "language", src: "language"},
+		}, ofFiles, "")
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := copyLegacyAudio(tx); err != nil {
+		return err
+	}
+
+	for _, r := range renames {
+		if err := tx.Exec(fmt.Sprintf("DROP TABLE IF EXISTS `%s`", r[1])).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyLegacyAudio creates the audio tracks of files stored before
+// tracks had their own table, from the audio_codec and audio_bitrate
+// columns of the legacy files table, which hold apostrophe separated
+// lists with one entry per track.
+// Files that already have audio tracks are left as they are.
+func copyLegacyAudio(tx *gorm.DB) error {
+	var existing []string
+	if err := tx.Raw("SELECT name FROM pragma_table_info('legacy_ani_db_files')").Scan(&existing).Error; err != nil {
+		return err
+	}
+	if !containsFold(existing, "audio_codec") {
+		return nil
+	}
+	bitrate := "''"
+	if containsFold(existing, "audio_bitrate") {
+		bitrate = "CAST(audio_bitrate AS TEXT)"
+	}
+	var rows []struct {
+		FileID  uint32
+		Codec   string
+		Bitrate string
+	}
+	err := tx.Raw("SELECT file_id, coalesce(audio_codec, '') AS codec, coalesce(" + bitrate + ", '') AS bitrate" +
+		" FROM legacy_ani_db_files" +
+		" WHERE file_id IN (SELECT file_id FROM files)" +
+		" AND file_id NOT IN (SELECT file_id FROM audio_tracks)").Scan(&rows).Error
+	if err != nil {
+		return err
+	}
+
+	var tracks []AudioTrack
+	for _, row := range rows {
+		if row.Bitrate == "0" {
+			row.Bitrate = ""
+		}
+		var codecs, bitrates []string
+		if row.Codec != "" {
+			codecs = strings.Split(row.Codec, "'")
+		}
+		if row.Bitrate != "" {
+			bitrates = strings.Split(row.Bitrate, "'")
+		}
+		for i := range max(len(codecs), len(bitrates)) {
+			t := AudioTrack{FileID: row.FileID, TrackNumber: i + 1}
+			if i < len(codecs) {
+				t.Codec = codecs[i]
+			}
+			if i < len(bitrates) {
+				n, err := strconv.ParseUint(bitrates[i], 10, 32)
+				if err != nil {
+					return fmt.Errorf("file %d: invalid audio bitrate %q", row.FileID, row.Bitrate)
+				}
+				t.Bitrate = uint32(n)
+			}
+			tracks = append(tracks, t)
+		}
+	}
+	if len(tracks) == 0 {
+		return nil
+	}
+	return tx.CreateInBatches(&tracks, 500).Error
+}
+
+// copyPartial creates the partial records of table from the latest
+// file that references them by key.
+// Records that already exist keep their data, but their empty columns
+// are filled from the files, as files carry some data, such as the
+// categories of an anime, that other commands do not.
+func copyPartial(tx *gorm.DB, table, key string, columns []copiedColumn) error {
+	var sets []string
+	for _, c := range columns {
+		if c.src == key || c.src == "created_at" || c.src == "updated_at" {
+			continue
+		}
+		sets = append(sets, fmt.Sprintf("`%[1]s` = CASE WHEN %[2]s.`%[1]s` IS NULL OR %[2]s.`%[1]s` IN ('', 0, '[]', 'null')"+
+			" THEN coalesce(excluded.`%[1]s`, %[2]s.`%[1]s`) ELSE %[2]s.`%[1]s` END", c.dst, "`"+table+"`"))
+	}
+	conflict := fmt.Sprintf("ON CONFLICT (`%s`) DO UPDATE SET %s", key, strings.Join(sets, ", "))
+	latest := fmt.Sprintf("id IN (SELECT max(id) FROM legacy_ani_db_files WHERE `%[1]s` <> 0 GROUP BY `%[1]s`)", key)
+	columns = append(latestSet(key, columns), copiedColumn{dst: "partial", expr: "true"})
+	return copyRows(tx, table, "legacy_ani_db_files", columns, latest, conflict)
+}
+
+// latestSet fills the columns copied from the latest file of a partial
+// record with the latest value that any file with the same key set, as
+// files fetched with fewer fields left them empty.
+// The key and timestamps are always taken from the latest file.
+func latestSet(key string, columns []copiedColumn) []copiedColumn {
+	columns = slices.Clone(columns)
+	for i, c := range columns {
+		if c.src == "" || c.expr != "" || c.src == key || c.src == "created_at" || c.src == "updated_at" {
+			continue
+		}
+		columns[i].expr = fmt.Sprintf("coalesce((SELECT p.`%[2]s` FROM legacy_ani_db_files AS p"+
+			" WHERE p.`%[1]s` = l.`%[1]s` AND p.`%[2]s` IS NOT NULL AND p.`%[2]s` NOT IN ('', 0, '[]', 'null')"+
+			" ORDER BY p.id DESC LIMIT 1), l.`%[2]s`)", key, c.src)
+	}
+	return columns
+}
+
+// fileViewSQL selects the rows of the ani_db_files view, in the shape
+// of [AniDBFile].
+const fileViewSQL = `SELECT
+	f.id, f.created_at, f.updated_at, f.deleted_at,
+	f.file_id,
+	coalesce(f.anime_id, 0) AS anime_id,
+	coalesce(f.episode_id, 0) AS episode_id,
+	coalesce(f.group_id, 0) AS group_id,
+	f.other_episodes, f.deprecated, f.state, f.size, f.ed2_k, f.md5, f.sha1, f.crc,
+	f.colour_depth, f.quality, f.source, f.video_codec, f.video_bitrate, f.video_resolution,
+	f.extension, f.length_in_seconds, f.description, f.aired_date, f.ani_db_file_name,
+	a.episodes AS total_episodes,
+	a.highest_episode, a.year, a.type, a.related, a.categories,
+	a.romaji_name, a.kanji_name, a.english_name, a.other_name, a.short_names, a.synonyms,
+	e.ep_num,
+	e.english_name AS ep_name,
+	e.romaji_name AS ep_romaji_name,
+	e.kanji_name AS ep_kanji_name,
+	e.rating AS ep_rating,
+	e.votes AS ep_vote_count,
+	g.name AS group_name,
+	g.short_name AS group_short_name,
+	a.record_updated AS anime_record_updated,
+	f.stale
+FROM files f
+LEFT JOIN animes a ON a.anime_id = f.anime_id
+LEFT JOIN episodes e ON e.episode_id = f.episode_id
+LEFT JOIN ` + "`groups`" + ` g ON g.group_id = f.group_id`
+
+// dropFileView drops the ani_db_files view, so that the tables it
+// reads from can be migrated.
+func dropFileView(db *gorm.DB) error {
+	var n int64
+	err := db.Raw("SELECT count(*) FROM sqlite_master WHERE type = 'view' AND name = 'ani_db_files'").Scan(&n).Error
+	if err != nil || n == 0 {
+		return err
+	}
+	return db.Exec("DROP VIEW ani_db_files").Error
+}
+
+// createFileView creates the ani_db_files view, which serves files in
+// the shape they had before they were split into tables.
+func createFileView(db *gorm.DB) error {
+	legacy, err := isTable(db, "ani_db_files")
+	if err != nil {
+		return err
+	}
+	if legacy {
+		return errors.New("ani_db_files is still a table")
+	}
+	return db.Exec("CREATE VIEW ani_db_files AS " + fileViewSQL).Error
+}
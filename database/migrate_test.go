@@ -0,0 +1,430 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// splitFile is the layout of ani_db_files before files were split into
+// tables.
+type splitFile struct {
+	gorm.Model
+
+	FileID          uint32        `gorm:"uniqueIndex:idx_file_id"`
+	AnimeID         uint32        `gorm:"index"`
+	EpisodeID       uint32        `gorm:"index"`
+	GroupID         uint32        `gorm:"index"`
+	OtherEpisodes   []FileEpisode `gorm:"serializer:json"`
+	Deprecated      bool
+	State           uint16
+	Size            int    `gorm:"index"`
+	Ed2K            string `gorm:"uniqueIndex:idx_ed2k"`
+	MD5             string `gorm:"index"`
+	SHA1            string `gorm:"index"`
+	CRC             string `gorm:"index"`
+	ColourDepth     string
+	Quality         string
+	Source          string
+	AudioTracks     []AudioTrack    `gorm:"foreignKey:FileID;references:FileID;constraint:OnDelete:CASCADE"`
+	SubtitleTracks  []SubtitleTrack `gorm:"foreignKey:FileID;references:FileID;constraint:OnDelete:CASCADE"`
+	VideoCodec      string
+	VideoBitrate    uint32
+	VideoResolution string
+	Extension       string
+	LengthInSeconds int
+	Description     string
+	AiredDate       *time.Time
+	AniDBFileName   string
+
+	TotalEpisodes      int
+	HighestEpisode     int
+	Year               string
+	Type               string
+	Related            []AnimeRelation `gorm:"serializer:json"`
+	Categories         []string        `gorm:"serializer:json"`
+	RomajiName         string
+	KanjiName          string
+	EnglishName        string
+	OtherName          string
+	ShortNames         []string `gorm:"serializer:json"`
+	Synonyms           []string `gorm:"serializer:json"`
+	EpNum              string
+	EpName             string
+	EpRomajiName       string
+	EpKanjiName        string
+	EpRating           int
+	EpVoteCount        int
+	GroupName          string
+	GroupShortName     string
+	AnimeRecordUpdated *time.Time
+
+	Stale bool `gorm:"index"`
+}
+
+func (splitFile) TableName() string { return "ani_db_files" }
+
+// splitAnime is the layout of the anime table before files were split
+// into tables.
+type splitAnime struct {
+	gorm.Model
+
+	AnimeID     uint32 `gorm:"uniqueIndex:idx_anime_id"`
+	Year        string
+	Type        string
+	RomajiName  string
+	EnglishName string
+	Episodes    int
+	Rating      int
+}
+
+func (splitAnime) TableName() string { return "animes" }
+
+// baselineFile is the layout of ani_db_files in the first versions of
+// anihash, with a single audio codec and bitrate column.
+type baselineFile struct {
+	gorm.Model
+
+	FileID          uint32 `gorm:"uniqueIndex:idx_file_id"`
+	AnimeID         uint32 `gorm:"index"`
+	EpisodeID       uint32 `gorm:"index"`
+	GroupID         uint32 `gorm:"index"`
+	State           uint16
+	Size            int    `gorm:"index"`
+	Ed2K            string `gorm:"uniqueIndex:idx_ed2k"`
+	MD5             string `gorm:"index"`
+	SHA1            string `gorm:"index"`
+	CRC             string `gorm:"index"`
+	Quality         string
+	Source          string
+	AudioCodec      string
+	AudioBitrate    uint32
+	VideoCodec      string
+	VideoBitrate    uint32
+	VideoResolution string
+	Extension       string
+
+	Year         string
+	Type         string
+	RomajiName   string
+	EnglishName  string
+	EpNum        string
+	EpName       string
+	EpRomajiName string
+	GroupName    string
+}
+
+func (baselineFile) TableName() string { return "ani_db_files" }
+
+func TestLoadDatabase_splitFiles(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "anihash.db")
+	updated := time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC)
+	anime := splitFile{
+		AnimeID:            1,
+		TotalEpisodes:      13,
+		HighestEpisode:     13,
+		Year:               "1999-1999",
+		Type:               "TV Series",
+		Related:            []AnimeRelation{{AnimeID: 2, Relation: "sequel"}},
+		Categories:         []string{"Space", "Military"},
+		RomajiName:         "Seikai no Monshou",
+		KanjiName:          "星界の紋章",
+		EnglishName:        "Crest of the Stars",
+		ShortNames:         []string{"CotS"},
+		AnimeRecordUpdated: &updated,
+	}
+	files := []splitFile{anime, anime, {
+		FileID:     12347,
+		AnimeID:    2,
+		EpisodeID:  4,
+		Size:       2000,
+		Ed2K:       "22222222222222222222222222222222",
+		RomajiName: "Seikai no Senki",
+		EpNum:      "01",
+		EpName:     "Warriors of the Stars",
+		Stale:      true,
+	}}
+	files[0].FileID, files[0].EpisodeID, files[0].GroupID = 12345, 2, 7
+	files[0].Size, files[0].Ed2K, files[0].CRC = 1000, "00000000000000000000000000000000", "deadbeef"
+	files[0].EpNum, files[0].EpName, files[0].EpRating = "01", "Invasion", 750
+	files[0].GroupName, files[0].GroupShortName = "Frostii", "F"
+	files[0].OtherEpisodes = []FileEpisode{{EpisodeID: 3, Percentage: 50}}
+	files[0].AudioTracks = []AudioTrack{
+		{FileID: 12345, TrackNumber: 1, Codec: "AAC", Bitrate: 128, Language: "japanese"},
+		{FileID: 12345, TrackNumber: 2, Codec: "AC3", Bitrate: 384, Language: "english"},
+	}
+	files[0].SubtitleTracks = []SubtitleTrack{{FileID: 12345, TrackNumber: 1, Language: "english"}}
+	files[1].FileID, files[1].EpisodeID, files[1].GroupID = 12346, 3, 7
+	files[1].Size, files[1].Ed2K = 1001, "11111111111111111111111111111111"
+	files[1].EpNum, files[1].EpName = "02", "Lafiel"
+	// Fetched with fewer fields.
+	files[1].GroupName = "Frostii"
+
+	legacy := openRaw(t, path)
+	if err := legacy.AutoMigrate(&splitFile{}, &AudioTrack{}, &SubtitleTrack{}, &splitAnime{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := legacy.Create(&files).Error; err != nil {
+		t.Fatal(err)
+	}
+	err := legacy.Create(&splitAnime{AnimeID: 1, Year: "1999-1999", Type: "TV Series", RomajiName: "Seikai no Monshou", EnglishName: "Crest of the Stars", Episodes: 13, Rating: 853}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored []splitFile
+	err = legacy.
+		Preload("AudioTracks", func(db *gorm.DB) *gorm.DB { return db.Order("track_number") }).
+		Preload("SubtitleTracks", func(db *gorm.DB) *gorm.DB { return db.Order("track_number") }).
+		Order("file_id").Find(&stored).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeRaw(t, legacy)
+
+	db := newTestDB(t, path)
+	// File 12346 was fetched without the short name of its group,
+	// which the view takes from the group now.
+	stored[1].GroupShortName = "F"
+	for _, want := range stored {
+		got, err := QueryFileByED2KSize(db, want.Ed2K, want.Size)
+		if err != nil {
+			t.Fatalf("file %d: %s", want.FileID, err)
+		}
+		if diff := jsonDiff(t, want, got); diff != "" {
+			t.Errorf("file %d changed: %s", want.FileID, diff)
+		}
+	}
+
+	a, err := QueryAnimeByID(db, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Rating != 853 || a.Partial || !reflect.DeepEqual(a.Categories, anime.Categories) {
+		t.Errorf("Got anime %+v; want the stored anime with categories", a)
+	}
+	if _, err := QueryAnimeByID(db, 2); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("Got error %v for partial anime; want not found", err)
+	}
+	if _, err := QueryEpisodeByID(db, 2); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("Got error %v for partial episode; want not found", err)
+	}
+	var group Group
+	if err := db.Where("group_id = ?", 7).First(&group).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !group.Partial || group.Name != "Frostii" || group.ShortName != "F" {
+		t.Errorf("Got group %+v; want partial Frostii", group)
+	}
+	for _, table := range []string{"legacy_ani_db_files", "legacy_audio_tracks", "legacy_subtitle_tracks"} {
+		if ok, err := isTable(db, table); err != nil || ok {
+			t.Errorf("Table %s is left over (%v)", table, err)
+		}
+	}
+
+	// Starting again finds nothing to migrate.
+	var logs bytes.Buffer
+	db = loadTestDB(t, path, slog.New(slog.NewTextHandler(&logs, nil)))
+	if strings.Contains(logs.String(), "migrating database") {
+		t.Errorf("Migrated again: %s", logs.String())
+	}
+	var versions []int
+	if err := db.Model(&SchemaMigration{}).Pluck("version", &versions).Error; err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{1, 2}; !reflect.DeepEqual(versions, want) {
+		t.Errorf("Got versions %v; want %v", versions, want)
+	}
+	if _, err := QueryFileByID(db, 12345); err != nil {
+		t.Errorf("Got error %v after restart", err)
+	}
+}
+
+func TestLoadDatabase_baseline(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "anihash.db")
+	legacy := openRaw(t, path)
+	if err := legacy.AutoMigrate(&baselineFile{}); err != nil {
+		t.Fatal(err)
+	}
+	files := []baselineFile{{
+		FileID: 12345, AnimeID: 1, EpisodeID: 2, GroupID: 7,
+		Size: 1000, Ed2K: "00000000000000000000000000000000", CRC: "deadbeef",
+		AudioCodec: "AAC", AudioBitrate: 128, VideoCodec: "H264/AVC",
+		Year: "1999-1999", Type: "TV Series", RomajiName: "Seikai no Monshou",
+		EpNum: "01", EpName: "Invasion", GroupName: "Frostii",
+	}, {
+		FileID: 12346, AnimeID: 1, EpisodeID: 3,
+		Size: 1001, Ed2K: "11111111111111111111111111111111",
+		AudioCodec: "AC3'AAC", AudioBitrate: 384,
+		Year: "1999-1999", Type: "TV Series", RomajiName: "Seikai no Monshou",
+		EpNum: "02",
+	}}
+	if err := legacy.Create(&files).Error; err != nil {
+		t.Fatal(err)
+	}
+	closeRaw(t, legacy)
+
+	db := newTestDB(t, path)
+	cases := []struct {
+		fileID uint32
+		group  string
+		tracks []AudioTrack
+	}{
+		{fileID: 12345, group: "Frostii", tracks: []AudioTrack{
+			{FileID: 12345, TrackNumber: 1, Codec: "AAC", Bitrate: 128},
+		}},
+		{fileID: 12346, tracks: []AudioTrack{
+			{FileID: 12346, TrackNumber: 1, Codec: "AC3", Bitrate: 384},
+			{FileID: 12346, TrackNumber: 2, Codec: "AAC"},
+		}},
+	}
+	for _, c := range cases {
+		got, err := QueryFileByID(db, c.fileID)
+		if err != nil {
+			t.Fatalf("file %d: %s", c.fileID, err)
+		}
+		if got.RomajiName != "Seikai no Monshou" || got.Year != "1999-1999" || got.GroupName != c.group {
+			t.Errorf("Got file %+v", got)
+		}
+		for i := range got.AudioTracks {
+			got.AudioTracks[i].ID = 0
+		}
+		if !reflect.DeepEqual(got.AudioTracks, c.tracks) {
+			t.Errorf("file %d: got audio tracks %+v; want %+v", c.fileID, got.AudioTracks, c.tracks)
+		}
+	}
+	var episodes []Episode
+	if err := db.Order("episode_id").Find(&episodes).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(episodes) != 2 || !episodes[0].Partial || episodes[0].EnglishName != "Invasion" || episodes[1].EpNum != "02" {
+		t.Errorf("Got episodes %+v", episodes)
+	}
+}
+
+func TestApplyMigration_foreignKeyViolation(t *testing.T) {
+	t.Parallel()
+	db := newTestDB(t, filepath.Join(t.TempDir(), "anihash.db"))
+	err := applyMigration(db, migration{
+		version: 1000,
+		name:    "reference a missing anime",
+		up: func(tx *gorm.DB) error {
+			return tx.Exec("INSERT INTO files (file_id, anime_id, ed2_k) VALUES (1, 99, 'x')").Error
+		},
+	})
+	if err == nil || !strings.Contains(err.Error(), "reference missing rows of animes") {
+		t.Fatalf("Got error %v; want a foreign key violation", err)
+	}
+	var files, versions int64
+	if err := db.Model(&File{}).Count(&files).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(&SchemaMigration{}).Where("version = ?", 1000).Count(&versions).Error; err != nil {
+		t.Fatal(err)
+	}
+	if files != 0 || versions != 0 {
+		t.Errorf("Got %d files and %d versions after a failed migration; want none", files, versions)
+	}
+}
+
+func TestLoadDatabase_newerVersion(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "anihash.db")
+	db := newTestDB(t, path)
+	if err := db.Create(&SchemaMigration{Version: 1000, Name: "future"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	_, err := LoadDatabase(slog.New(slog.DiscardHandler), &DatabaseConfig{
+		SQLite: &SQLiteConfig{Path: path},
+	})
+	if err == nil {
+		t.Error("Got no error for a database of a newer version")
+	}
+}
+
+// loadTestDB loads the database at path, logging to logger.
+func loadTestDB(t *testing.T, path string, logger *slog.Logger) *gorm.DB {
+	t.Helper()
+	db, err := LoadDatabase(logger, &DatabaseConfig{
+		SQLite: &SQLiteConfig{Path: path},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return db
+}
+
+// openRaw opens the database at path without migrating it, to set up
+// an older layout.
+func openRaw(t *testing.T, path string) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(path+"?_foreign_keys=on"), &gorm.Config{
+		Logger: logger.Discard,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func closeRaw(t *testing.T, db *gorm.DB) {
+	t.Helper()
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlDB.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// jsonDiff returns the JSON fields that differ between a and b.
+func jsonDiff(t *testing.T, a, b any) string {
+	t.Helper()
+	var ma, mb map[string]any
+	for _, c := range []struct {
+		v any
+		m *map[string]any
+	}{{a, &ma}, {b, &mb}} {
+		data, err := json.Marshal(c.v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(data, c.m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var diffs []string
+	for k, va := range ma {
+		if vb, ok := mb[k]; !ok || !reflect.DeepEqual(va, vb) {
+			diffs = append(diffs, k+": "+jsonString(va)+" -> "+jsonString(vb))
+		}
+	}
+	for k, vb := range mb {
+		if _, ok := ma[k]; !ok {
+			diffs = append(diffs, k+": missing -> "+jsonString(vb))
+		}
+	}
+	return strings.Join(diffs, ", ")
+}
+
+func jsonString(v any) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
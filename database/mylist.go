@@ -0,0 +1,95 @@
+package database
+
+import (
+	"time"
+
+	"github.com/yureien/anihash/anidb"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// A MyListEntry is a file in the AniDB MyList of the user.
+type MyListEntry struct {
+	gorm.Model
+
+	ListID    uint32 `gorm:"uniqueIndex:idx_mylist_id"`
+	FileID    uint32 `gorm:"index"`
+	EpisodeID uint32
+	AnimeID   uint32
+	GroupID   uint32
+	Added     *time.Time
+	// State is one of unknown, internal, external, deleted or
+	// remote.
+	State  string
+	Viewed bool
+	// ViewDate is when the file was watched, if known.
+	ViewDate  *time.Time
+	Storage   string
+	Source    string
+	Other     string
+	FileState int
+}
+
+// MyListEntryFromAniDB converts an AniDB MyList entry to a database
+// record.
+func MyListEntryFromAniDB(e anidb.MyListEntry) MyListEntry {
+	return MyListEntry{
+		ListID:    e.ListID,
+		FileID:    e.FileID,
+		EpisodeID: e.EpisodeID,
+		AnimeID:   e.AnimeID,
+		GroupID:   e.GroupID,
+		Added:     OptionalTime(e.Added),
+		State:     e.State.String(),
+		Viewed:    e.Viewed(),
+		ViewDate:  OptionalTime(e.ViewDate),
+		Storage:   e.Storage,
+		Source:    e.Source,
+		Other:     e.Other,
+		FileState: e.FileState,
+	}
+}
+
+func QueryMyListEntryByFileID(db *gorm.DB, fileID uint32) (MyListEntry, error) {
+	var entry MyListEntry
+	if err := db.Where("file_id = ?", fileID).First(&entry).Error; err != nil {
+		return MyListEntry{}, err
+	}
+	return entry, nil
+}
+
+// SaveMyListEntry creates or updates a MyList entry by its AniDB ID.
+// It returns the entry as stored.
+func SaveMyListEntry(db *gorm.DB, entry MyListEntry) (MyListEntry, error) {
+	err := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "list_id"}},
+		UpdateAll: true,
+	}).Create(&entry).Error
+	if err != nil {
+		return MyListEntry{}, err
+	}
+	var saved MyListEntry
+	if err := db.Where("list_id = ?", entry.ListID).First(&saved).Error; err != nil {
+		return MyListEntry{}, err
+	}
+	return saved, nil
+}
+
+// DeleteMyListEntry deletes a MyList entry by its AniDB ID.
+func DeleteMyListEntry(db *gorm.DB, listID uint32) error {
+	return db.Unscoped().Where("list_id = ?", listID).Delete(&MyListEntry{}).Error
+}
+
+// QueryFilesWithoutMyListEntry returns the IDs of the stored files
+// without a MyList entry.
+func QueryFilesWithoutMyListEntry(db *gorm.DB) ([]uint32, error) {
+	var fileIDs []uint32
+	err := db.Model(&AniDBFile{}).
+		Where("file_id NOT IN (?)", db.Model(&MyListEntry{}).Select("file_id")).
+		Order("file_id").
+		Pluck("file_id", &fileIDs).Error
+	if err != nil {
+		return nil, err
+	}
+	return fileIDs, nil
+}
@@ -0,0 +1,212 @@
+package database
+
+import (
+	"encoding/json"
+	"reflect"
+	"slices"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// A RefreshPolicy sets when stored files are fetched from AniDB again,
+// as AniDB fixes names, episode numbers, groups and file states over
+// time.
+type RefreshPolicy struct {
+	// MaxAge is how long a file is kept before it is fetched again.
+	// A negative value disables refreshing by age.
+	MaxAge time.Duration `yaml:"max_age" default:"720h"`
+	// Interval is how often files due for a refresh are looked for.
+	Interval time.Duration `yaml:"interval" default:"1h"`
+	// BatchSize is the maximum number of files fetched per interval.
+	BatchSize int `yaml:"batch_size" default:"50"`
+	// UseUpdated asks AniDB for recently updated anime on every
+	// interval, and refreshes their files before older files.
+	UseUpdated bool `yaml:"use_updated"`
+}
+
+// DefaultRefreshPolicy is the policy used for unset fields.
+var DefaultRefreshPolicy = RefreshPolicy{
+	MaxAge:    30 * 24 * time.Hour,
+	Interval:  time.Hour,
+	BatchSize: 50,
+}
+
+// WithDefaults returns the policy with unset fields set from
+// [DefaultRefreshPolicy].
+// A negative MaxAge is kept as it is, and disables refreshing by age.
+func (p RefreshPolicy) WithDefaults() RefreshPolicy {
+	if p.MaxAge == 0 {
+		p.MaxAge = DefaultRefreshPolicy.MaxAge
+	}
+	if p.Interval <= 0 {
+		p.Interval = DefaultRefreshPolicy.Interval
+	}
+	if p.BatchSize <= 0 {
+		p.BatchSize = DefaultRefreshPolicy.BatchSize
+	}
+	return p
+}
+
+// Enabled reports whether files are refreshed at all.
+func (p RefreshPolicy) Enabled() bool {
+	return p.MaxAge > 0 || p.UseUpdated
+}
+
+// A FileChange is a field of a file that changed when the file was
+// fetched from AniDB again.
+type FileChange struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `gorm:"index" json:"changed_at"`
+	FileID    uint32    `gorm:"index" json:"file_id"`
+	// Field is the name of the field in [AniDBFile], such as EpName.
+	Field string `json:"field"`
+	// OldValue and NewValue are the JSON encoded values of the field.
+	OldValue string `json:"old_value"`
+	NewValue string `json:"new_value"`
+}
+
+// QueryStaleFiles returns up to limit files that were marked stale or
+// last fetched before the given time, the longest waiting first.
+func QueryStaleFiles(db *gorm.DB, before time.Time, limit int) ([]AniDBFile, error) {
+	var files []AniDBFile
+	err := db.
+		Where("stale OR updated_at < ?", before).
+		Order("stale DESC, updated_at").
+		Limit(limit).
+		Find(&files).Error
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// MarkAnimeFilesStale marks the files of the given anime to be fetched
+// again before other files.
+// It returns the number of marked files.
+func MarkAnimeFilesStale(db *gorm.DB, animeIDs []uint32) (int64, error) {
+	if len(animeIDs) == 0 {
+		return 0, nil
+	}
+	res := db.Model(&File{}).
+		Where("anime_id IN ? AND NOT stale", animeIDs).
+		UpdateColumn("stale", true)
+	return res.RowsAffected, res.Error
+}
+
+// TouchFile marks a file as fetched without changing it, such as when
+// AniDB no longer knows the file or fetching it failed.
+func TouchFile(db *gorm.DB, fileID uint32) error {
+	return db.Model(&File{}).
+		Where("file_id = ?", fileID).
+		Updates(map[string]any{"stale": false, "updated_at": time.Now()}).Error
+}
+
+// RefreshFile replaces a stored file with a version fetched from AniDB
+// again, and records the fields that changed, also for other files
+// that share its anime, episode or group.
+// It returns the recorded changes.
+func RefreshFile(db *gorm.DB, file AniDBFile) ([]FileChange, error) {
+	_, changes, err := saveFile(db, file, false)
+	return changes, err
+}
+
+// fileChanges compares the AniDB fields of two versions of a file,
+// or only the given fields if any.
+func fileChanges(old, new AniDBFile, fields ...string) ([]FileChange, error) {
+	old, new = changeComparable(old), changeComparable(new)
+	ov, nv := reflect.ValueOf(old), reflect.ValueOf(new)
+	var changes []FileChange
+	for i := range ov.NumField() {
+		field := ov.Type().Field(i)
+		// Skip gorm.Model and fields managed by anihash.
+		if field.Anonymous || field.Name == "Stale" {
+			continue
+		}
+		if len(fields) > 0 && !slices.Contains(fields, field.Name) {
+			continue
+		}
+		a, err := json.Marshal(ov.Field(i).Interface())
+		if err != nil {
+			return nil, err
+		}
+		b, err := json.Marshal(nv.Field(i).Interface())
+		if err != nil {
+			return nil, err
+		}
+		if string(a) == string(b) {
+			continue
+		}
+		changes = append(changes, FileChange{
+			FileID:   new.FileID,
+			Field:    field.Name,
+			OldValue: string(a),
+			NewValue: string(b),
+		})
+	}
+	return changes, nil
+}
+
+// changeComparable returns a copy of file with the database IDs of its
+// tracks cleared and empty lists set to nil, so that a stored file can
+// be compared with a fetched one.
+func changeComparable(file AniDBFile) AniDBFile {
+	audio := make([]AudioTrack, len(file.AudioTracks))
+	for i, t := range file.AudioTracks {
+		t.ID = 0
+		audio[i] = t
+	}
+	subtitles := make([]SubtitleTrack, len(file.SubtitleTracks))
+	for i, t := range file.SubtitleTracks {
+		t.ID = 0
+		subtitles[i] = t
+	}
+	file.AudioTracks, file.SubtitleTracks = nil, nil
+	if len(audio) > 0 {
+		file.AudioTracks = audio
+	}
+	if len(subtitles) > 0 {
+		file.SubtitleTracks = subtitles
+	}
+	if len(file.OtherEpisodes) == 0 {
+		file.OtherEpisodes = nil
+	}
+	if len(file.Related) == 0 {
+		file.Related = nil
+	}
+	if len(file.Categories) == 0 {
+		file.Categories = nil
+	}
+	if len(file.ShortNames) == 0 {
+		file.ShortNames = nil
+	}
+	if len(file.Synonyms) == 0 {
+		file.Synonyms = nil
+	}
+	return file
+}
+
+// QueryFileChanges returns up to limit file changes with an ID above
+// afterID, the oldest first.
+// IDs increase with every change, while all changes of one refresh
+// share their time, so the ID of the last change seen is the cursor to
+// page through them.
+func QueryFileChanges(db *gorm.DB, afterID uint, limit int) ([]FileChange, error) {
+	var changes []FileChange
+	err := db.Where("id > ?", afterID).Order("id").Limit(limit).Find(&changes).Error
+	if err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// QueryFileChangesByFileID returns the recorded changes of a file, the
+// oldest first.
+func QueryFileChangesByFileID(db *gorm.DB, fileID uint32) ([]FileChange, error) {
+	var changes []FileChange
+	err := db.Where("file_id = ?", fileID).Order("id").Find(&changes).Error
+	if err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
@@ -0,0 +1,60 @@
+package database
+
+import (
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func TestQueryFileChanges_sameTime(t *testing.T) {
+	t.Parallel()
+	db := newTestDB(t, filepath.Join(t.TempDir(), "anihash.db"))
+	now := time.Now()
+	changes := []FileChange{
+		{CreatedAt: now, FileID: 1, Field: "EpName"},
+		{CreatedAt: now, FileID: 2, Field: "EpName"},
+		{CreatedAt: now, FileID: 3, Field: "EpName"},
+	}
+	if err := db.Create(&changes).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	var got []uint32
+	var after uint
+	for {
+		page, err := QueryFileChanges(db, after, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		for _, c := range page {
+			got = append(got, c.FileID)
+		}
+		after = page[len(page)-1].ID
+	}
+	if len(got) != 3 || got[0] != 1 || got[1] != 2 || got[2] != 3 {
+		t.Errorf("Got changes of files %v; want [1 2 3]", got)
+	}
+}
+
+// newTestDB loads the database at path.
+func newTestDB(t *testing.T, path string) *gorm.DB {
+	t.Helper()
+	db, err := LoadDatabase(slog.New(slog.DiscardHandler), &DatabaseConfig{
+		SQLite: &SQLiteConfig{Path: path},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return db
+}
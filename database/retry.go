@@ -0,0 +1,65 @@
+package database
+
+import "time"
+
+// A RetrySchedule sets when files that could not be fetched from AniDB
+// are fetched again.
+//
+// The delay for each state starts at the configured base delay and
+// doubles with every failed attempt, up to Max.
+// A negative base delay means files in that state are never retried.
+type RetrySchedule struct {
+	TransientError time.Duration `yaml:"transient_error" default:"10m"`
+	NotFound       time.Duration `yaml:"not_found" default:"24h"`
+	Error          time.Duration `yaml:"error" default:"168h"`
+	Max            time.Duration `yaml:"max" default:"720h"`
+}
+
+// DefaultRetrySchedule is the schedule used for unset fields.
+var DefaultRetrySchedule = RetrySchedule{
+	TransientError: 10 * time.Minute,
+	NotFound:       24 * time.Hour,
+	Error:          7 * 24 * time.Hour,
+	Max:            30 * 24 * time.Hour,
+}
+
+// WithDefaults returns the schedule with unset fields set from
+// [DefaultRetrySchedule].
+// Negative base delays are kept as they are, and disable retries.
+func (r RetrySchedule) WithDefaults() RetrySchedule {
+	if r.TransientError == 0 {
+		r.TransientError = DefaultRetrySchedule.TransientError
+	}
+	if r.NotFound == 0 {
+		r.NotFound = DefaultRetrySchedule.NotFound
+	}
+	if r.Error == 0 {
+		r.Error = DefaultRetrySchedule.Error
+	}
+	if r.Max <= 0 {
+		r.Max = DefaultRetrySchedule.Max
+	}
+	return r
+}
+
+// Delay returns how long to wait before fetching a file again after
+// it ended up in state for the given number of consecutive attempts.
+// It returns false if the file should not be retried.
+func (r RetrySchedule) Delay(state FileStateEnum, attempts int) (time.Duration, bool) {
+	var d time.Duration
+	switch state {
+	case FILE_TRANSIENT_ERROR:
+		d = r.TransientError
+	case FILE_NOT_FOUND:
+		d = r.NotFound
+	case FILE_ERROR:
+		d = r.Error
+	}
+	if d <= 0 {
+		return 0, false
+	}
+	for i := 1; i < attempts && d < r.Max; i++ {
+		d *= 2
+	}
+	return min(d, r.Max), true
+}
@@ -0,0 +1,169 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/charmap"
+	"gorm.io/gorm"
+)
+
+// ErrInvalidText is returned when saving a record with text that is
+// not valid UTF-8, which happens when AniDB responses are decoded with
+// the wrong encoding.
+var ErrInvalidText = errors.New("text is not valid UTF-8")
+
+// validateText returns an error wrapping [ErrInvalidText] if a text
+// field is not valid UTF-8.
+func validateText(fields []string) error {
+	for _, s := range fields {
+		if !utf8.ValidString(s) {
+			return fmt.Errorf("%w: %q", ErrInvalidText, s)
+		}
+	}
+	return nil
+}
+
+// hasMojibake reports whether a text field looks garbled by a wrong
+// encoding: it is not valid UTF-8, contains the replacement character,
+// or is UTF-8 that was decoded as Latin-1 or Windows-1252, such as
+// "ã‚¢ãƒ‹ãƒ¡" for "アニメ".
+func hasMojibake(fields []string) bool {
+	for _, s := range fields {
+		if isMojibake(s) {
+			return true
+		}
+	}
+	return false
+}
+
+func isMojibake(s string) bool {
+	if !utf8.ValidString(s) {
+		return true
+	}
+	b := make([]byte, 0, len(s))
+	multibyte := false
+	for _, r := range s {
+		switch {
+		case r == utf8.RuneError:
+			return true
+		case r < utf8.RuneSelf:
+			b = append(b, byte(r))
+			continue
+		}
+		c, ok := charmap.Windows1252.EncodeRune(r)
+		if !ok {
+			if r > 0xff {
+				// Not a Latin-1 or Windows-1252 character.
+				return false
+			}
+			c = byte(r)
+		}
+		b = append(b, c)
+		multibyte = true
+	}
+	// Text made of single Latin characters, such as "Pokémon", is
+	// not valid UTF-8 once encoded back.
+	return multibyte && utf8.Valid(b)
+}
+
+// textFields returns the text fields of a file that come from AniDB.
+func (f *AniDBFile) textFields() []string {
+	fields := []string{
+		f.Description, f.AniDBFileName, f.RomajiName, f.KanjiName,
+		f.EnglishName, f.OtherName, f.EpName, f.EpRomajiName,
+		f.EpKanjiName, f.GroupName, f.GroupShortName,
+	}
+	fields = append(fields, f.Categories...)
+	fields = append(fields, f.ShortNames...)
+	return append(fields, f.Synonyms...)
+}
+
+// textFields returns the text fields of a file record that come from
+// AniDB. The others are stored with its anime, episode and group.
+func (f *File) textFields() []string {
+	return []string{f.Description, f.AniDBFileName}
+}
+
+func (f *File) BeforeSave(tx *gorm.DB) error {
+	return validateText(f.textFields())
+}
+
+// textFields returns the text fields of an anime that come from AniDB.
+func (a *Anime) textFields() []string {
+	fields := []string{a.RomajiName, a.KanjiName, a.EnglishName, a.OtherName}
+	fields = append(fields, a.Categories...)
+	fields = append(fields, a.ShortNames...)
+	return append(fields, a.Synonyms...)
+}
+
+func (a *Anime) BeforeSave(tx *gorm.DB) error {
+	return validateText(a.textFields())
+}
+
+// textFields returns the text fields of an episode that come from
+// AniDB.
+func (e *Episode) textFields() []string {
+	return []string{e.EnglishName, e.RomajiName, e.KanjiName}
+}
+
+func (e *Episode) BeforeSave(tx *gorm.DB) error {
+	return validateText(e.textFields())
+}
+
+// textFields returns the text fields of a group that come from AniDB.
+func (g *Group) textFields() []string {
+	return []string{g.Name, g.ShortName, g.IRCChannel}
+}
+
+func (g *Group) BeforeSave(tx *gorm.DB) error {
+	return validateText(g.textFields())
+}
+
+// A textRecord is a record with text fields from AniDB.
+type textRecord interface {
+	AniDBFile | Anime | Episode | Group
+}
+
+// queryMojibake returns the records of a type with garbled text
+// fields.
+func queryMojibake[T textRecord](db *gorm.DB, textFields func(*T) []string) ([]T, error) {
+	var garbled, batch []T
+	err := db.FindInBatches(&batch, 100, func(tx *gorm.DB, _ int) error {
+		for i := range batch {
+			if hasMojibake(textFields(&batch[i])) {
+				garbled = append(garbled, batch[i])
+			}
+		}
+		return nil
+	}).Error
+	if err != nil {
+		return nil, err
+	}
+	return garbled, nil
+}
+
+// QueryMojibakeFiles returns the files with garbled text, which need
+// to be fetched again.
+func QueryMojibakeFiles(db *gorm.DB) ([]AniDBFile, error) {
+	return queryMojibake(db, (*AniDBFile).textFields)
+}
+
+// QueryMojibakeAnime returns the anime with garbled text, which need
+// to be fetched again.
+func QueryMojibakeAnime(db *gorm.DB) ([]Anime, error) {
+	return queryMojibake(db, (*Anime).textFields)
+}
+
+// QueryMojibakeEpisodes returns the episodes with garbled text, which
+// need to be fetched again.
+func QueryMojibakeEpisodes(db *gorm.DB) ([]Episode, error) {
+	return queryMojibake(db, (*Episode).textFields)
+}
+
+// QueryMojibakeGroups returns the groups with garbled text, which need
+// to be fetched again.
+func QueryMojibakeGroups(db *gorm.DB) ([]Group, error) {
+	return queryMojibake(db, (*Group).textFields)
+}
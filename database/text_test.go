@@ -0,0 +1,29 @@
+package database
+
+import "testing"
+
+func TestIsMojibake(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		s    string
+		want bool
+	}{
+		{s: "", want: false},
+		{s: "Seikai no Monshou", want: false},
+		// UTF-8 read as Windows-1252.
+		{s: "ã‚¢ãƒ‹ãƒ¡", want: true},
+		{s: "PokÃ©mon", want: true},
+		{s: "Pokémon", want: false},
+		{s: "Ça va, Señor?", want: false},
+		{s: "星界の紋章", want: false},
+		{s: "Kaitou Kid 怪盗キッド", want: false},
+		{s: "Pok\xe9mon", want: true},
+		{s: "\xff\xfe", want: true},
+		{s: "Pok�mon", want: true},
+	}
+	for _, c := range cases {
+		if got := isMojibake(c.s); got != c.want {
+			t.Errorf("isMojibake(%q) = %t; want %t", c.s, got, c.want)
+		}
+	}
+}
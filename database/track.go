@@ -0,0 +1,23 @@
+package database
+
+// An AudioTrack is an audio track of a file.
+type AudioTrack struct {
+	ID uint `gorm:"primarykey"`
+	// FileID is the AniDB file ID of the file.
+	FileID uint32 `gorm:"index"`
+	// TrackNumber is the position of the track in the file, from 1.
+	TrackNumber int
+	Codec       string
+	Bitrate     uint32
+	Language    string
+}
+
+// A SubtitleTrack is a subtitle track of a file.
+type SubtitleTrack struct {
+	ID uint `gorm:"primarykey"`
+	// FileID is the AniDB file ID of the file.
+	FileID uint32 `gorm:"index"`
+	// TrackNumber is the position of the track in the file, from 1.
+	TrackNumber int
+	Language    string
+}
@@ -7,6 +7,7 @@ require (
 	github.com/orandin/slog-gorm v1.4.0
 	github.com/zorchenhimer/go-ed2k v0.0.0-20221217175820-d0cb88a85fd7
 	goji.io v2.0.2+incompatible
+	golang.org/x/text v0.27.0
 	golang.org/x/time v0.12.0
 	gopkg.in/yaml.v3 v3.0.1
 	gorm.io/driver/sqlite v1.6.0
@@ -19,5 +20,4 @@ require (
 	github.com/mattn/go-sqlite3 v1.14.28 // indirect
 	golang.org/x/crypto v0.40.0 // indirect
 	golang.org/x/sys v0.34.0 // indirect
-	golang.org/x/text v0.27.0 // indirect
 )
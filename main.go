@@ -1,16 +1,27 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log/slog"
 	"os"
 
 	"github.com/yureien/anihash/anidb"
+	"github.com/yureien/anihash/anidb/anidbtest"
 	"github.com/yureien/anihash/database"
+	"github.com/yureien/anihash/queue"
 	"github.com/yureien/anihash/scanner"
 	"github.com/yureien/anihash/server"
 )
 
+var repairText = flag.Bool("repair-text", false, "Fetch records stored with garbled text from AniDB again, then exit")
+
+var importMyList = flag.Bool("import-mylist", false, "Fetch the AniDB MyList entries of stored files, then exit")
+
+var fakeAnidb = flag.String("fake-anidb", "", "Serve AniDB requests from a local fake server with the fixtures in this file")
+
 func main() {
+	flag.Parse()
 	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
 
 	cfg, err := LoadConfig("config.yaml")
@@ -19,28 +30,67 @@ func main() {
 		return
 	}
 
-	anidbClient, closeAnidb, err := anidb.NewAuthenticatedClient(logger, &cfg.Anidb)
+	if *fakeAnidb != "" {
+		fixtures, err := anidbtest.LoadFixtures(*fakeAnidb)
+		if err != nil {
+			logger.Error("failed to load fake anidb fixtures", "error", err)
+			return
+		}
+		fake, err := anidbtest.NewServer("127.0.0.1:0", fixtures, logger)
+		if err != nil {
+			logger.Error("failed to start fake anidb server", "error", err)
+			return
+		}
+		defer fake.Close()
+		logger.Warn("using fake anidb server", "address", fake.Addr(), "fixtures", *fakeAnidb)
+		cfg.Anidb.Address = fake.Addr()
+	}
+
+	db, err := database.LoadDatabase(logger, &cfg.Database)
+	if err != nil {
+		logger.Error("failed to load database", "error", err)
+		return
+	}
+
+	anidbClient, closeAnidb, err := anidb.NewAuthenticatedClient(logger, &cfg.Anidb, database.ClientStateStore{DB: db})
 	if err != nil {
 		logger.Error("failed to create anidb client", "error", err)
 		return
 	}
 	defer closeAnidb()
 
-	db, err := database.LoadDatabase(logger, &cfg.Database)
-	if err != nil {
-		logger.Error("failed to load database", "error", err)
+	q := queue.New(logger, anidbClient, db, cfg.Server.Retry, cfg.Server.Refresh)
+
+	if *repairText {
+		n, err := q.RepairText(context.Background())
+		if err != nil {
+			logger.Error("failed to repair text", "repaired", n, "error", err)
+			return
+		}
+		logger.Info("repaired text", "repaired", n)
 		return
 	}
 
-	server, err := server.New(anidbClient, db)
+	if *importMyList {
+		n, err := q.ImportMyList(context.Background())
+		if err != nil {
+			logger.Error("failed to import mylist", "imported", n, "error", err)
+			return
+		}
+		logger.Info("imported mylist", "imported", n)
+		return
+	}
+
+	scanner.StartScanner(logger, cfg.Scanner, q, db, anidbClient, cfg.Server.Retry)
+	q.Start()
+
+	server, err := server.New(anidbClient, q, db, &cfg.Server)
 	if err != nil {
 		logger.Error("failed to create server", "error", err)
 		return
 	}
 
-	scanner.StartScanner(logger, cfg.Scanner, anidbClient, db)
-
-	if err := server.ListenAndServe(logger, &cfg.Server); err != nil {
+	if err := server.ListenAndServe(logger); err != nil {
 		logger.Error("failed to start server", "error", err)
 	}
 }
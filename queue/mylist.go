@@ -0,0 +1,41 @@
+package queue
+
+import (
+	"context"
+	"errors"
+
+	"github.com/yureien/anihash/anidb"
+	"github.com/yureien/anihash/database"
+)
+
+// ImportMyList fetches the MyList entries of the stored files that
+// don't have one yet, so their watch state is known.
+// AniDB can't list a whole MyList over the UDP API, so only files
+// that are already stored are imported.
+// It returns the number of imported entries.
+func (q *Queue) ImportMyList(ctx context.Context) (int, error) {
+	ctx = anidb.WithPriority(ctx, anidb.PriorityBulk)
+	fileIDs, err := database.QueryFilesWithoutMyListEntry(q.db)
+	if err != nil {
+		return 0, err
+	}
+	imported := 0
+	for _, fid := range fileIDs {
+		e, err := q.anidbClient.MyList(ctx, anidb.MyListKey{FileID: fid})
+		switch {
+		case errors.Is(err, anidb.NO_SUCH_ENTRY):
+			continue
+		case err != nil:
+			if ctx.Err() != nil {
+				return imported, ctx.Err()
+			}
+			q.logger.Error("failed to fetch mylist entry", "fid", fid, "error", err)
+			continue
+		}
+		if _, err := database.SaveMyListEntry(q.db, database.MyListEntryFromAniDB(e)); err != nil {
+			return imported, err
+		}
+		imported++
+	}
+	return imported, nil
+}
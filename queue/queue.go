@@ -0,0 +1,199 @@
+package queue
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/yureien/anihash/anidb"
+	"github.com/yureien/anihash/database"
+	"gorm.io/gorm"
+)
+
+// pollInterval is how often the worker checks for jobs when it was not
+// woken up by Enqueue, for example after a restart.
+const pollInterval = time.Minute
+
+// retrySchedulerInterval is how often failed files are checked for a
+// due retry.
+const retrySchedulerInterval = time.Minute
+
+// A Queue is a durable queue of files to fetch from AniDB.
+//
+// Jobs are stored in the database, so they survive restarts, and are
+// deduplicated by ed2k and size, or by file ID.
+// A single worker processes the jobs, so queued file lookups are
+// fetched one at a time.
+// Other AniDB requests, such as lookups by ID from the HTTP API, the
+// refresh of stale files and MyList updates, do not go through the
+// queue; the rate limiter of the shared [anidb.Client] orders them
+// with the jobs.
+// Jobs are served by [anidb.Priority]; bulk jobs are only served when
+// their share of the rate budget allows it, so that interactive jobs
+// never wait behind them.
+type Queue struct {
+	logger      *slog.Logger
+	anidbClient *anidb.Client
+	db          *gorm.DB
+	retry       database.RetrySchedule
+	refresh     database.RefreshPolicy
+
+	wake chan struct{}
+	// onAvailable are called with files fetched from AniDB.
+	onAvailable []func(database.AniDBFile)
+}
+
+func New(logger *slog.Logger, anidbClient *anidb.Client, db *gorm.DB, retry database.RetrySchedule, refresh database.RefreshPolicy) *Queue {
+	return &Queue{
+		logger:      logger.With("component", "queue"),
+		anidbClient: anidbClient,
+		db:          db,
+		retry:       retry.WithDefaults(),
+		refresh:     refresh.WithDefaults(),
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// Enqueue queues a file to be fetched from AniDB with the given
+// priority.
+// It returns immediately; the caller should create a pending file
+// state first.
+// If the file is already queued, its priority is raised if needed.
+func (q *Queue) Enqueue(ed2k string, size int64, priority anidb.Priority) error {
+	changed, err := database.CreateJob(q.db, ed2k, size, int(priority))
+	if err != nil {
+		return err
+	}
+	if changed {
+		q.wakeUp()
+	}
+	return nil
+}
+
+// EnqueueFileID queues a file to be fetched from AniDB by ID with the
+// given priority, like [Queue.Enqueue].
+// The file has no file state; it is stored once fetched.
+func (q *Queue) EnqueueFileID(fid uint32, priority anidb.Priority) error {
+	changed, err := database.CreateFileIDJob(q.db, fid, int(priority))
+	if err != nil {
+		return err
+	}
+	if changed {
+		q.wakeUp()
+	}
+	return nil
+}
+
+func (q *Queue) wakeUp() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// OnAvailable registers a function to call with every file fetched
+// from AniDB by the queue.
+// The function is called from the worker, so it should not block.
+// It must be called before Start.
+func (q *Queue) OnAvailable(f func(database.AniDBFile)) {
+	q.onAvailable = append(q.onAvailable, f)
+}
+
+// Len returns the number of queued jobs.
+func (q *Queue) Len() (int64, error) {
+	return database.CountJobs(q.db)
+}
+
+// Start starts the worker, the retry scheduler and, if enabled, the
+// refresh of stale files.
+func (q *Queue) Start() {
+	q.enqueuePendingFiles()
+
+	go q.work()
+
+	go func() {
+		for {
+			time.Sleep(retrySchedulerInterval)
+			q.requeueDueFiles()
+		}
+	}()
+
+	if q.refresh.Enabled() {
+		go q.refreshLoop()
+	}
+}
+
+func (q *Queue) work() {
+	for {
+		job, err := database.QueryNextJob(q.db)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			select {
+			case <-q.wake:
+			case <-time.After(pollInterval):
+			}
+			continue
+		}
+		if err != nil {
+			q.logger.Error("failed to query next job", "error", err)
+			time.Sleep(pollInterval)
+			continue
+		}
+		if state := q.anidbClient.BreakerState(); state.Tripped(time.Now()) {
+			// Keep the jobs queued until AniDB requests are allowed again.
+			q.logger.Info("anidb requests paused, waiting", "until", state.Until)
+			time.Sleep(time.Until(state.Until))
+			continue
+		}
+		if anidb.Priority(job.Priority) == anidb.PriorityBulk {
+			// Wait for the bulk budget, unless other work arrives.
+			if d := q.anidbClient.BulkDelay(); d > 0 {
+				select {
+				case <-q.wake:
+				case <-time.After(d):
+				}
+				continue
+			}
+		}
+
+		if !q.processJob(job) {
+			continue
+		}
+
+		if err := database.DeleteJob(q.db, job.ID); err != nil {
+			q.logger.Error("failed to delete job", "job", job.ID, "error", err)
+		}
+	}
+}
+
+// enqueuePendingFiles queues all pending files, in case they were
+// never queued.
+func (q *Queue) enqueuePendingFiles() {
+	files, err := database.QueryPendingFiles(q.db)
+	if err != nil {
+		q.logger.Error("failed to query pending files", "error", err)
+		return
+	}
+
+	for _, file := range files {
+		if err := q.Enqueue(file.Ed2K, file.Size, anidb.PriorityRescan); err != nil {
+			q.logger.Error("failed to enqueue pending file", "ed2k", file.Ed2K, "size", file.Size, "error", err)
+		}
+	}
+}
+
+// requeueDueFiles queues failed files whose next retry is due.
+func (q *Queue) requeueDueFiles() {
+	files, err := database.RequeueDueFileStates(q.db, time.Now())
+	if err != nil {
+		q.logger.Error("failed to requeue files", "error", err)
+		return
+	}
+	if len(files) > 0 {
+		q.logger.Info("requeued failed files", "count", len(files))
+	}
+	for _, file := range files {
+		if err := q.Enqueue(file.Ed2K, file.Size, anidb.PriorityRescan); err != nil {
+			q.logger.Error("failed to enqueue file", "ed2k", file.Ed2K, "size", file.Size, "error", err)
+		}
+	}
+}
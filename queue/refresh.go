@@ -0,0 +1,147 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/yureien/anihash/anidb"
+	"github.com/yureien/anihash/database"
+)
+
+// updatedStateKey is the client state key of the time of the last
+// UPDATED check.
+const updatedStateKey = "queue.refresh.updated"
+
+// refreshLoop refreshes stale files on every interval of the refresh
+// policy.
+func (q *Queue) refreshLoop() {
+	for {
+		time.Sleep(q.refresh.Interval)
+		ctx := anidb.WithPriority(context.Background(), anidb.PriorityBulk)
+		if q.refresh.UseUpdated {
+			q.markUpdatedAnime(ctx)
+		}
+		q.refreshStaleFiles(ctx)
+	}
+}
+
+// markUpdatedAnime asks AniDB which anime were updated since the last
+// check, and marks their files stale.
+func (q *Queue) markUpdatedAnime(ctx context.Context) {
+	now := time.Now()
+	since, err := q.lastUpdatedCheck()
+	if err != nil {
+		q.logger.Error("failed to load last updated check", "error", err)
+		return
+	}
+	if since.IsZero() {
+		since = now.Add(-q.refresh.Interval)
+	}
+
+	updated, err := q.anidbClient.Updated(ctx, since)
+	if err != nil {
+		q.logger.Error("failed to query updated anime", "since", since, "error", err)
+		return
+	}
+	if updated.Count > len(updated.AnimeIDs) {
+		// The rest are still refreshed once they reach the max age.
+		q.logger.Warn("anidb did not list all updated anime", "count", updated.Count, "listed", len(updated.AnimeIDs))
+	}
+	n, err := database.MarkAnimeFilesStale(q.db, updated.AnimeIDs)
+	if err != nil {
+		q.logger.Error("failed to mark files stale", "error", err)
+		return
+	}
+	if n > 0 {
+		q.logger.Info("marked files of updated anime stale", "anime", len(updated.AnimeIDs), "files", n)
+	}
+
+	data, err := json.Marshal(now)
+	if err != nil {
+		q.logger.Error("failed to encode last updated check", "error", err)
+		return
+	}
+	if err := database.SaveClientState(q.db, updatedStateKey, data); err != nil {
+		q.logger.Error("failed to save last updated check", "error", err)
+	}
+}
+
+// lastUpdatedCheck returns the time of the last UPDATED check, or the
+// zero time if there was none.
+func (q *Queue) lastUpdatedCheck() (time.Time, error) {
+	data, err := database.QueryClientState(q.db, updatedStateKey)
+	if err != nil || data == nil {
+		return time.Time{}, err
+	}
+	var t time.Time
+	err = json.Unmarshal(data, &t)
+	return t, err
+}
+
+// refreshStaleFiles fetches a batch of stale files from AniDB again
+// and records what changed.
+func (q *Queue) refreshStaleFiles(ctx context.Context) {
+	// Without a max age, only files marked stale are refreshed.
+	var before time.Time
+	if q.refresh.MaxAge > 0 {
+		before = time.Now().Add(-q.refresh.MaxAge)
+	}
+	files, err := database.QueryStaleFiles(q.db, before, q.refresh.BatchSize)
+	if err != nil {
+		q.logger.Error("failed to query stale files", "error", err)
+		return
+	}
+	for _, file := range files {
+		if !q.refreshFile(ctx, file.FileID) {
+			return
+		}
+	}
+}
+
+// refreshFile fetches a stored file from AniDB again and updates it.
+// It returns false if no more files should be refreshed for now,
+// because requests to AniDB are paused.
+func (q *Queue) refreshFile(ctx context.Context, fid uint32) bool {
+	if state := q.anidbClient.BreakerState(); state.Tripped(time.Now()) {
+		q.logger.Info("anidb requests paused, refreshing files later", "until", state.Until)
+		return false
+	}
+
+	q.logger.Info("refreshing file", "fid", fid)
+	f, err := q.anidbClient.FileByID(ctx, fid)
+	var bannedErr *anidb.BannedError
+	if errors.As(err, &bannedErr) {
+		q.logger.Warn("anidb requests paused, refreshing files later", "error", err)
+		return false
+	}
+	if err != nil {
+		if errors.Is(err, anidb.NO_SUCH_FILE) {
+			// Keep the last known version rather than losing it.
+			q.logger.Warn("file was removed from anidb", "fid", fid)
+		} else {
+			q.logger.Error("failed to refresh file", "fid", fid, "error", err)
+		}
+		// Move the file to the back, so that files that keep failing
+		// do not hold up the others.
+		if err := database.TouchFile(q.db, fid); err != nil {
+			q.logger.Error("failed to update file", "fid", fid, "error", err)
+		}
+		return true
+	}
+
+	changes, err := database.RefreshFile(q.db, database.FileFromAniDB(f))
+	if err != nil {
+		q.logger.Error("failed to update file", "fid", fid, "error", err)
+		return true
+	}
+	if len(changes) > 0 {
+		fields := make([]string, len(changes))
+		for i, c := range changes {
+			fields[i] = c.Field
+		}
+		q.logger.Info("file changed on anidb", "fid", fid, "fields", fields)
+	}
+	return true
+}
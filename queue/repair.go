@@ -0,0 +1,121 @@
+package queue
+
+import (
+	"context"
+
+	"github.com/yureien/anihash/anidb"
+	"github.com/yureien/anihash/database"
+)
+
+// RepairText fetches the files, anime, episodes and groups that were
+// stored with garbled text again, such as those stored before the
+// session encoding was set to UTF-8.
+// It is meant to be run once. Records that can't be fetched are
+// logged and skipped.
+// It returns the number of repaired records.
+func (q *Queue) RepairText(ctx context.Context) (int, error) {
+	ctx = anidb.WithPriority(ctx, anidb.PriorityBulk)
+	repaired := 0
+
+	files, err := database.QueryMojibakeFiles(q.db)
+	if err != nil {
+		return repaired, err
+	}
+	for _, file := range files {
+		ok, err := q.repair(ctx, "fid", file.FileID, func() error {
+			f, err := q.anidbClient.FileByID(ctx, file.FileID)
+			if err != nil {
+				return err
+			}
+			_, err = database.SaveFile(q.db, database.FileFromAniDB(f))
+			return err
+		})
+		if err != nil {
+			return repaired, err
+		}
+		if ok {
+			repaired++
+		}
+	}
+
+	anime, err := database.QueryMojibakeAnime(q.db)
+	if err != nil {
+		return repaired, err
+	}
+	for _, a := range anime {
+		ok, err := q.repair(ctx, "aid", a.AnimeID, func() error {
+			res, err := q.anidbClient.Anime(ctx, a.AnimeID, anidb.DefaultAnimeAmask)
+			if err != nil {
+				return err
+			}
+			_, err = database.SaveAnime(q.db, database.AnimeFromAniDB(res))
+			return err
+		})
+		if err != nil {
+			return repaired, err
+		}
+		if ok {
+			repaired++
+		}
+	}
+
+	episodes, err := database.QueryMojibakeEpisodes(q.db)
+	if err != nil {
+		return repaired, err
+	}
+	for _, e := range episodes {
+		ok, err := q.repair(ctx, "eid", e.EpisodeID, func() error {
+			res, err := q.anidbClient.Episode(ctx, e.EpisodeID)
+			if err != nil {
+				return err
+			}
+			_, err = database.SaveEpisode(q.db, database.EpisodeFromAniDB(res))
+			return err
+		})
+		if err != nil {
+			return repaired, err
+		}
+		if ok {
+			repaired++
+		}
+	}
+
+	groups, err := database.QueryMojibakeGroups(q.db)
+	if err != nil {
+		return repaired, err
+	}
+	for _, g := range groups {
+		ok, err := q.repair(ctx, "gid", g.GroupID, func() error {
+			res, err := q.anidbClient.Group(ctx, g.GroupID)
+			if err != nil {
+				return err
+			}
+			_, err = database.SaveGroup(q.db, database.GroupFromAniDB(res))
+			return err
+		})
+		if err != nil {
+			return repaired, err
+		}
+		if ok {
+			repaired++
+		}
+	}
+
+	return repaired, nil
+}
+
+// repair fetches one record again with fetch and reports whether it
+// was repaired.
+// Errors of fetch are logged; only the context error is returned, as
+// it stops the repair.
+func (q *Queue) repair(ctx context.Context, key string, id uint32, fetch func() error) (bool, error) {
+	q.logger.Info("repairing record", key, id)
+	if err := fetch(); err != nil {
+		if ctx.Err() != nil {
+			return false, ctx.Err()
+		}
+		q.logger.Error("failed to repair record", key, id, "error", err)
+		return false, nil
+	}
+	return true, nil
+}
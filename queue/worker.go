@@ -0,0 +1,133 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/yureien/anihash/anidb"
+	"github.com/yureien/anihash/database"
+)
+
+// processJob fetches the file for a job from AniDB and stores it.
+// It returns false if the job should stay queued, because requests to
+// AniDB are paused.
+func (q *Queue) processJob(job database.Job) bool {
+	if job.FileID != 0 {
+		return q.processFileIDJob(job)
+	}
+
+	fileState, err := database.QueryFileStateByEd2KSize(q.db, job.Ed2K, job.Size)
+	if err != nil {
+		q.logger.Error("failed to query file state", "ed2k", job.Ed2K, "size", job.Size, "error", err)
+		return true
+	}
+
+	// Only process pending files.
+	if fileState.State != uint8(database.FILE_PENDING) {
+		return true
+	}
+
+	q.logger.Info("fetching file from anidb", "ed2k", job.Ed2K, "size", job.Size)
+	ctx := anidb.WithPriority(context.Background(), anidb.Priority(job.Priority))
+	anidbFile, err := q.anidbClient.FileByHash(ctx, job.Size, job.Ed2K)
+	var multiErr *anidb.MultipleFilesError
+	if errors.As(err, &multiErr) {
+		anidbFile, err = q.resolveMultipleFiles(ctx, job, multiErr.FileIDs)
+	}
+	var bannedErr *anidb.BannedError
+	if errors.As(err, &bannedErr) {
+		// Leave the file pending, nothing was sent to AniDB.
+		q.logger.Warn("anidb requests paused, leaving file pending", "ed2k", job.Ed2K, "size", job.Size, "error", err)
+		return false
+	}
+	if err != nil {
+		state := database.FileStateForError(err)
+		q.logger.Warn("failed to fetch file from anidb", "ed2k", job.Ed2K, "size", job.Size, "state", state, "error", err)
+		q.updateErroredFileState(job, state, err.Error())
+		return true
+	}
+
+	// The file may have been stored by a lookup by ID meanwhile.
+	file, err := database.SaveFile(q.db, database.FileFromAniDB(anidbFile))
+	if err != nil {
+		q.logger.Error("failed to save file", "ed2k", job.Ed2K, "size", job.Size, "error", err)
+		q.updateErroredFileState(job, database.FILE_ERROR, "failed to save file")
+		return true
+	}
+
+	err = database.UpdateAvailableFileState(q.db, uint(file.FileID), job.Ed2K, job.Size)
+	if err != nil {
+		q.logger.Error("failed to update file state", "ed2k", job.Ed2K, "size", job.Size, "error", err)
+		q.updateErroredFileState(job, database.FILE_ERROR, "failed to update file state")
+		return true
+	}
+
+	q.logger.Info("successfully added file to database", "ed2k", job.Ed2K, "size", job.Size)
+	for _, f := range q.onAvailable {
+		f(file)
+	}
+	return true
+}
+
+// processFileIDJob fetches a file by ID from AniDB and stores it.
+// Failures are only logged, as there is no file state to record them
+// in; the file is fetched again when it is next requested.
+func (q *Queue) processFileIDJob(job database.Job) bool {
+	if _, err := database.QueryFileByID(q.db, job.FileID); err == nil {
+		return true
+	}
+
+	q.logger.Info("fetching file from anidb", "fid", job.FileID)
+	ctx := anidb.WithPriority(context.Background(), anidb.Priority(job.Priority))
+	anidbFile, err := q.anidbClient.FileByID(ctx, job.FileID)
+	var bannedErr *anidb.BannedError
+	if errors.As(err, &bannedErr) {
+		q.logger.Warn("anidb requests paused, leaving job queued", "fid", job.FileID, "error", err)
+		return false
+	}
+	if err != nil {
+		q.logger.Warn("failed to fetch file from anidb", "fid", job.FileID, "error", err)
+		return true
+	}
+
+	file, err := database.SaveFile(q.db, database.FileFromAniDB(anidbFile))
+	if err != nil {
+		q.logger.Error("failed to save file", "fid", job.FileID, "error", err)
+		return true
+	}
+	err = database.SaveAvailableFileState(q.db, file.FileID, file.Ed2K, int64(file.Size))
+	if err != nil {
+		q.logger.Error("failed to save file state", "fid", job.FileID, "error", err)
+		return true
+	}
+
+	q.logger.Info("successfully added file to database", "fid", job.FileID)
+	for _, f := range q.onAvailable {
+		f(file)
+	}
+	return true
+}
+
+// resolveMultipleFiles fetches the candidates of an ambiguous hash
+// lookup and returns the first one matching the job's hash and size.
+func (q *Queue) resolveMultipleFiles(ctx context.Context, job database.Job, fileIDs []uint32) (anidb.File, error) {
+	q.logger.Info("resolving multiple files", "ed2k", job.Ed2K, "size", job.Size, "fids", fileIDs)
+	for _, fid := range fileIDs {
+		f, err := q.anidbClient.FileByID(ctx, fid)
+		if err != nil {
+			return anidb.File{}, err
+		}
+		if f.Ed2K == job.Ed2K && int64(f.Size) == job.Size {
+			return f, nil
+		}
+	}
+	return anidb.File{}, fmt.Errorf("no candidate of %v matches: %w", fileIDs, anidb.NO_SUCH_FILE)
+}
+
+func (q *Queue) updateErroredFileState(job database.Job, state database.FileStateEnum, errMsg string) {
+	err := database.UpdateErroredFileState(q.db, job.Ed2K, job.Size, state, errMsg, q.retry)
+	if err != nil {
+		q.logger.Error("failed to update file state", "ed2k", job.Ed2K, "size", job.Size, "error", err)
+	}
+}
@@ -3,4 +3,21 @@ package scanner
 type ScannerConfig struct {
 	ScanPath   string `yaml:"scan_path"`
 	NumWorkers int    `yaml:"num_workers,omitempty"`
+	// MyList adds scanned files to the AniDB MyList if set.
+	MyList *MyListConfig `yaml:"mylist,omitempty"`
+}
+
+// A MyListConfig configures how scanned files are added to the AniDB
+// MyList.
+type MyListConfig struct {
+	// State is the storage state of added files: unknown, internal,
+	// external, deleted or remote.
+	State string `yaml:"state" default:"internal"`
+	// Viewed marks added files as watched.
+	Viewed  bool   `yaml:"viewed"`
+	Source  string `yaml:"source"`
+	Storage string `yaml:"storage"`
+	Other   string `yaml:"other"`
+	// Overwrite sets the fields of files that are already in MyList.
+	Overwrite bool `yaml:"overwrite"`
 }
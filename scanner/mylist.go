@@ -0,0 +1,233 @@
+package scanner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/yureien/anihash/anidb"
+	"github.com/yureien/anihash/database"
+	"gorm.io/gorm"
+)
+
+// myListBatchSize is how many files are loaded at once to be added to
+// MyList.
+const myListBatchSize = 100
+
+// myListPollInterval is how often files whose retry is due are added
+// to MyList, when the myLister was not woken up.
+const myListPollInterval = time.Minute
+
+// A myLister adds scanned files to the AniDB MyList once they are
+// identified.
+//
+// The files still to add are marked in their file state, so they
+// survive restarts, and failed attempts are retried on the retry
+// schedule of failed lookups.
+type myLister struct {
+	logger      *slog.Logger
+	anidbClient *anidb.Client
+	db          *gorm.DB
+	retry       database.RetrySchedule
+	fields      anidb.MyListFields
+	overwrite   bool
+
+	wake chan struct{}
+}
+
+func newMyLister(logger *slog.Logger, cfg MyListConfig, anidbClient *anidb.Client, db *gorm.DB, retry database.RetrySchedule) (*myLister, error) {
+	if cfg.State == "" {
+		cfg.State = anidb.MyListStateInternal.String()
+	}
+	state, err := anidb.ParseMyListState(cfg.State)
+	if err != nil {
+		return nil, err
+	}
+	fields := anidb.MyListFields{
+		State:   state,
+		Source:  cfg.Source,
+		Storage: cfg.Storage,
+		Other:   cfg.Other,
+	}
+	if cfg.Viewed {
+		fields.Viewed = &cfg.Viewed
+	}
+	return &myLister{
+		logger:      logger.With("component", "mylist"),
+		anidbClient: anidbClient,
+		db:          db,
+		retry:       retry.WithDefaults(),
+		fields:      fields,
+		overwrite:   cfg.Overwrite,
+		wake:        make(chan struct{}, 1),
+	}, nil
+}
+
+// start starts adding files to MyList.
+func (m *myLister) start() {
+	for {
+		m.addPending()
+		select {
+		case <-m.wake:
+		case <-time.After(myListPollInterval):
+		}
+	}
+}
+
+func (m *myLister) wakeUp() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// addPending adds the files that are due to MyList.
+func (m *myLister) addPending() {
+	for {
+		fileStates, err := database.QueryMyListPendingFileStates(m.db, time.Now(), myListBatchSize)
+		if err != nil {
+			m.logger.Error("failed to query files for mylist", "error", err)
+			return
+		}
+		for _, fileState := range fileStates {
+			if !m.addFileState(fileState) {
+				return
+			}
+		}
+		if len(fileStates) < myListBatchSize {
+			return
+		}
+	}
+}
+
+// addFileState adds a file to MyList and records the outcome in its
+// file state.
+// It returns false if no more files should be added for now.
+func (m *myLister) addFileState(fileState database.FileState) bool {
+	fid := *fileState.FileID
+	err := m.add(fid)
+	var bannedErr *anidb.BannedError
+	if errors.As(err, &bannedErr) {
+		// Nothing was sent, so this is not counted as an attempt.
+		m.logger.Warn("anidb requests paused, adding to mylist later", "error", err)
+		return false
+	}
+	if err != nil {
+		m.logger.Error("failed to add file to mylist", "fid", fid, "attempts", fileState.MyListAttempts+1, "error", err)
+		state := database.FileStateForError(err)
+		if err := database.UpdateMyListFailedFileState(m.db, fileState, state, m.retry); err != nil {
+			m.logger.Error("failed to update file state", "fid", fid, "error", err)
+			return false
+		}
+		return true
+	}
+	if err := database.ClearFileStateScanned(m.db, fileState.ID); err != nil {
+		m.logger.Error("failed to update file state", "fid", fid, "error", err)
+		return false
+	}
+	return true
+}
+
+// scannedAvailable adds a scanned file that is already identified to
+// MyList, unless it was added before.
+func (m *myLister) scannedAvailable(fileState database.FileState) {
+	_, err := database.QueryMyListEntryByFileID(m.db, *fileState.FileID)
+	if err == nil {
+		return
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		m.logger.Error("failed to query mylist entry", "fid", *fileState.FileID, "error", err)
+		return
+	}
+	if !fileState.Scanned {
+		err := database.MarkFileStateScanned(m.db, fileState.Ed2K, fileState.Size)
+		if err != nil {
+			m.logger.Error("failed to mark file scanned", "fid", *fileState.FileID, "error", err)
+			return
+		}
+	}
+	m.wakeUp()
+}
+
+// identified is called by the queue with every identified file, so
+// that files found by the scanner are added to MyList.
+func (m *myLister) identified(database.AniDBFile) {
+	m.wakeUp()
+}
+
+// add adds a file to MyList and stores the entry.
+// Files already in MyList are only stored, or edited if configured.
+func (m *myLister) add(fid uint32) error {
+	if _, err := database.QueryMyListEntryByFileID(m.db, fid); err == nil {
+		return nil
+	}
+	file, err := database.QueryFileByID(m.db, fid)
+	if err != nil {
+		return err
+	}
+
+	ctx := anidb.WithPriority(context.Background(), anidb.PriorityBulk)
+	key := anidb.MyListKey{FileID: file.FileID}
+	lid, err := m.anidbClient.MyListAdd(ctx, key, m.fields)
+	var exists *anidb.MyListExistsError
+	switch {
+	case errors.As(err, &exists):
+		if m.overwrite {
+			return m.edit(ctx, exists.Entry)
+		}
+		m.logger.Info("file already in mylist", "fid", file.FileID, "lid", exists.Entry.ListID)
+		return m.save(exists.Entry)
+	case err != nil:
+		return err
+	default:
+		m.logger.Info("added file to mylist", "fid", file.FileID, "lid", lid)
+		entry := anidb.MyListEntry{
+			ListID:    lid,
+			FileID:    file.FileID,
+			EpisodeID: file.EpisodeID,
+			AnimeID:   file.AnimeID,
+			GroupID:   file.GroupID,
+			Added:     time.Now(),
+			State:     m.fields.State,
+			Storage:   m.fields.Storage,
+			Source:    m.fields.Source,
+			Other:     m.fields.Other,
+		}
+		if m.fields.Viewed != nil {
+			entry.ViewDate = entry.Added
+		}
+		return m.save(entry)
+	}
+}
+
+// edit sets the configured fields of an existing MyList entry.
+func (m *myLister) edit(ctx context.Context, entry anidb.MyListEntry) error {
+	_, err := m.anidbClient.MyListEdit(ctx, anidb.MyListKey{ListID: entry.ListID}, m.fields)
+	if err != nil {
+		return err
+	}
+	m.logger.Info("edited mylist entry", "fid", entry.FileID, "lid", entry.ListID)
+	entry.State = m.fields.State
+	if m.fields.Storage != "" {
+		entry.Storage = m.fields.Storage
+	}
+	if m.fields.Source != "" {
+		entry.Source = m.fields.Source
+	}
+	if m.fields.Other != "" {
+		entry.Other = m.fields.Other
+	}
+	if m.fields.Viewed != nil && entry.ViewDate.IsZero() {
+		entry.ViewDate = time.Now()
+	}
+	return m.save(entry)
+}
+
+func (m *myLister) save(entry anidb.MyListEntry) error {
+	if _, err := database.SaveMyListEntry(m.db, database.MyListEntryFromAniDB(entry)); err != nil {
+		return fmt.Errorf("save mylist entry %d: %w", entry.ListID, err)
+	}
+	return nil
+}
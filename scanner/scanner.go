@@ -1,7 +1,6 @@
 package scanner
 
 import (
-	"context"
 	"encoding/hex"
 	"io"
 	"log/slog"
@@ -14,6 +13,7 @@ import (
 	"github.com/fsnotify/fsnotify"
 	"github.com/yureien/anihash/anidb"
 	"github.com/yureien/anihash/database"
+	"github.com/yureien/anihash/queue"
 	"github.com/zorchenhimer/go-ed2k"
 	"gorm.io/gorm"
 )
@@ -33,16 +33,23 @@ var videoExtensions = map[string]struct{}{
 }
 
 type scanner struct {
-	logger      *slog.Logger
-	cfg         ScannerConfig
-	anidbClient *anidb.Client
-	db          *gorm.DB
+	logger *slog.Logger
+	cfg    ScannerConfig
+	queue  *queue.Queue
+	db     *gorm.DB
+	// myLister is nil unless MyList is configured.
+	myLister *myLister
 
 	processChan chan string
 	wg          sync.WaitGroup
 }
 
-func StartScanner(logger *slog.Logger, cfg ScannerConfig, anidbClient *anidb.Client, db *gorm.DB) {
+// StartScanner starts scanning cfg.ScanPath.
+// If MyList is configured, it registers with q to add identified files
+// to MyList, so it must be called before the queue is started.
+// Files that could not be added to MyList are retried on the retry
+// schedule.
+func StartScanner(logger *slog.Logger, cfg ScannerConfig, q *queue.Queue, db *gorm.DB, anidbClient *anidb.Client, retry database.RetrySchedule) {
 	if cfg.ScanPath == "" {
 		logger.Error("scan path is not set, disabling scanner")
 		return
@@ -51,10 +58,20 @@ func StartScanner(logger *slog.Logger, cfg ScannerConfig, anidbClient *anidb.Cli
 	scanner := scanner{
 		logger:      logger,
 		cfg:         cfg,
-		anidbClient: anidbClient,
+		queue:       q,
 		db:          db,
 		processChan: make(chan string),
 	}
+	if cfg.MyList != nil {
+		m, err := newMyLister(logger, *cfg.MyList, anidbClient, db, retry)
+		if err != nil {
+			logger.Error("invalid mylist config, disabling mylist", "error", err)
+		} else {
+			scanner.myLister = m
+			q.OnAvailable(m.identified)
+			go m.start()
+		}
+	}
 	go scanner.start()
 }
 
@@ -216,63 +233,29 @@ func (s *scanner) processFile(path string) {
 
 	if fileState.State == uint8(database.FILE_AVAILABLE) {
 		s.logger.Info("file already in database", "path", path)
+		if s.myLister != nil && fileState.FileID != nil {
+			s.myLister.scannedAvailable(fileState)
+		}
 		return
 	}
 
-	if fileState.State != uint8(database.FILE_PENDING) {
-		s.logger.Info("file state is not pending", "path", path, "state", fileState.State)
-		return
-	}
-
-	s.logger.Info("fetching file from anidb", "path", path, "ed2k", ed2kHash, "size", size)
-	anidbFile, err := s.anidbClient.FileByHash(context.Background(), size, ed2kHash)
-	if err != nil {
-		database.UpdateErroredFileState(s.db, ed2kHash, size, database.FILE_ERROR, err.Error())
-		s.logger.Error("failed to fetch file from anidb", "path", path, "error", err)
-		return
-	}
-
-	dbFile := database.AniDBFile{
-		FileID:          anidbFile.FileID,
-		AnimeID:         anidbFile.AnimeID,
-		EpisodeID:       anidbFile.EpisodeID,
-		GroupID:         anidbFile.GroupID,
-		State:           anidbFile.State,
-		Size:            anidbFile.Size,
-		Ed2K:            anidbFile.Ed2K,
-		MD5:             anidbFile.MD5,
-		SHA1:            anidbFile.SHA1,
-		CRC:             anidbFile.CRC,
-		Quality:         anidbFile.Quality,
-		Source:          anidbFile.Source,
-		AudioCodec:      anidbFile.AudioCodec,
-		AudioBitrate:    anidbFile.AudioBitrate,
-		VideoCodec:      anidbFile.VideoCodec,
-		VideoBitrate:    anidbFile.VideoBitrate,
-		VideoResolution: anidbFile.VideoResolution,
-		Extension:       anidbFile.Extension,
-		Year:            anidbFile.Year,
-		Type:            anidbFile.Type,
-		RomajiName:      anidbFile.RomajiName,
-		EnglishName:     anidbFile.EnglishName,
-		EpNum:           anidbFile.EpNum,
-		EpName:          anidbFile.EpName,
-		EpRomajiName:    anidbFile.EpRomajiName,
-		GroupName:       anidbFile.GroupName,
+	// Files that fail now may be identified by a later retry, and
+	// are added to MyList then.
+	if !fileState.Scanned {
+		if err := database.MarkFileStateScanned(s.db, ed2kHash, size); err != nil {
+			s.logger.Error("failed to mark file scanned", "path", path, "error", err)
+		}
 	}
 
-	_, err = database.CreateFile(s.db, dbFile)
-	if err != nil {
-		database.UpdateErroredFileState(s.db, ed2kHash, size, database.FILE_ERROR, err.Error())
-		s.logger.Error("failed to create file in database", "path", path, "error", err)
+	if fileState.State != uint8(database.FILE_PENDING) {
+		s.logger.Info("file state is not pending", "path", path, "state", fileState.State)
 		return
 	}
 
-	err = database.UpdateAvailableFileState(s.db, uint(dbFile.FileID), ed2kHash, size)
-	if err != nil {
-		s.logger.Error("failed to update file state", "path", path, "error", err)
+	if err := s.queue.Enqueue(ed2kHash, size, anidb.PriorityBulk); err != nil {
+		s.logger.Error("failed to enqueue file", "path", path, "error", err)
 		return
 	}
 
-	s.logger.Info("successfully added file to database", "path", path)
+	s.logger.Info("queued file for anidb", "path", path, "ed2k", ed2kHash, "size", size)
 }
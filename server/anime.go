@@ -0,0 +1,55 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/yureien/anihash/anidb"
+	"github.com/yureien/anihash/database"
+	"goji.io/pat"
+	"gorm.io/gorm"
+)
+
+func (s server) animeHandler(w http.ResponseWriter, r *http.Request) {
+	aid, err := strconv.ParseUint(pat.Param(r, "aid"), 10, 32)
+	if err != nil || aid == 0 {
+		s.errorResponse(w, http.StatusBadRequest, "invalid aid")
+		return
+	}
+
+	anime, err := s.queryAnime(r, uint32(aid))
+	if err != nil {
+		s.anidbErrorResponse(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"anime": anime,
+	})
+}
+
+// queryAnime returns an anime from the database, fetching it from
+// AniDB if it is not cached yet.
+func (s server) queryAnime(r *http.Request, aid uint32) (database.Anime, error) {
+	anime, err := database.QueryAnimeByID(s.db, aid)
+	if err == nil {
+		return anime, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return database.Anime{}, err
+	}
+
+	slog.Info("fetching anime from anidb", "aid", aid)
+	a, err := directLookup(s, r, func(ctx context.Context) (anidb.Anime, error) {
+		return s.anidbClient.Anime(ctx, aid, anidb.DefaultAnimeAmask)
+	})
+	if err != nil {
+		return database.Anime{}, err
+	}
+	return database.SaveAnime(s.db, database.AnimeFromAniDB(a))
+}
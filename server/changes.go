@@ -0,0 +1,76 @@
+package server
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/yureien/anihash/database"
+	"goji.io/pat"
+)
+
+// defaultChangesLimit and maxChangesLimit bound the number of changes
+// returned by the changes endpoint.
+const (
+	defaultChangesLimit = 100
+	maxChangesLimit     = 1000
+)
+
+// changesHandler returns the file changes recorded after the change
+// with the ID in the after query value, so that clients can follow
+// renames by polling with the ID of the last change they saw.
+func (s server) changesHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var after uint64
+	if v := query.Get("after"); v != "" {
+		var err error
+		after, err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			s.errorResponse(w, http.StatusBadRequest, "invalid after")
+			return
+		}
+	}
+	limit := defaultChangesLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			s.errorResponse(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		limit = min(n, maxChangesLimit)
+	}
+
+	changes, err := database.QueryFileChanges(s.db, uint(after), limit)
+	if err != nil {
+		slog.Error("failed to query file changes", "after", after, "error", err)
+		s.errorResponse(w, http.StatusInternalServerError, "failed to query file changes")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"changes": changes,
+	})
+}
+
+// fileChangesHandler returns the recorded changes of a file.
+func (s server) fileChangesHandler(w http.ResponseWriter, r *http.Request) {
+	fid, err := strconv.ParseUint(pat.Param(r, "fid"), 10, 32)
+	if err != nil || fid == 0 {
+		s.errorResponse(w, http.StatusBadRequest, "invalid fid")
+		return
+	}
+
+	changes, err := database.QueryFileChangesByFileID(s.db, uint32(fid))
+	if err != nil {
+		slog.Error("failed to query file changes", "fid", fid, "error", err)
+		s.errorResponse(w, http.StatusInternalServerError, "failed to query file changes")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"changes": changes,
+	})
+}
@@ -1,6 +1,16 @@
 package server
 
+import "github.com/yureien/anihash/database"
+
 type ServerConfig struct {
 	Host string `yaml:"host"`
 	Port int    `yaml:"port"`
+
+	// Retry sets when files that could not be fetched from AniDB are
+	// fetched again by the queue.
+	Retry database.RetrySchedule `yaml:"retry"`
+
+	// Refresh sets when stored files are fetched from AniDB again to
+	// pick up corrections.
+	Refresh database.RefreshPolicy `yaml:"refresh"`
 }
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/yureien/anihash/anidb"
+	"github.com/yureien/anihash/database"
+	"goji.io/pat"
+	"gorm.io/gorm"
+)
+
+func (s server) episodeHandler(w http.ResponseWriter, r *http.Request) {
+	eid, err := strconv.ParseUint(pat.Param(r, "eid"), 10, 32)
+	if err != nil || eid == 0 {
+		s.errorResponse(w, http.StatusBadRequest, "invalid eid")
+		return
+	}
+
+	episode, err := database.QueryEpisodeByID(s.db, uint32(eid))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		slog.Info("fetching episode from anidb", "eid", eid)
+		e, anidbErr := directLookup(s, r, func(ctx context.Context) (anidb.Episode, error) {
+			return s.anidbClient.Episode(ctx, uint32(eid))
+		})
+		if anidbErr != nil {
+			s.anidbErrorResponse(w, anidbErr)
+			return
+		}
+		episode, err = database.SaveEpisode(s.db, database.EpisodeFromAniDB(e))
+	}
+	if err != nil {
+		slog.Error("failed to query episode", "eid", eid, "error", err)
+		s.errorResponse(w, http.StatusInternalServerError, "failed to query episode")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"episode": episode,
+	})
+}
+
+// animeEpisodesHandler lists the cached episodes of an anime.
+// A single episode can be fetched from AniDB by number with the epno
+// query parameter.
+func (s server) animeEpisodesHandler(w http.ResponseWriter, r *http.Request) {
+	aid, err := strconv.ParseUint(pat.Param(r, "aid"), 10, 32)
+	if err != nil || aid == 0 {
+		s.errorResponse(w, http.StatusBadRequest, "invalid aid")
+		return
+	}
+
+	if epno := r.URL.Query().Get("epno"); epno != "" {
+		s.animeEpisodeByNumber(w, r, uint32(aid), epno)
+		return
+	}
+
+	episodes, err := database.QueryEpisodesByAnimeID(s.db, uint32(aid))
+	if err != nil {
+		slog.Error("failed to query episodes", "aid", aid, "error", err)
+		s.errorResponse(w, http.StatusInternalServerError, "failed to query episodes")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"episodes": episodes,
+	})
+}
+
+func (s server) animeEpisodeByNumber(w http.ResponseWriter, r *http.Request, aid uint32, epno string) {
+	episode, err := database.QueryEpisodeByNumber(s.db, aid, epno)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		slog.Info("fetching episode from anidb", "aid", aid, "epno", epno)
+		e, anidbErr := directLookup(s, r, func(ctx context.Context) (anidb.Episode, error) {
+			return s.anidbClient.EpisodeByNumber(ctx, aid, epno)
+		})
+		if anidbErr != nil {
+			s.anidbErrorResponse(w, anidbErr)
+			return
+		}
+		episode, err = database.SaveEpisode(s.db, database.EpisodeFromAniDB(e))
+	}
+	if err != nil {
+		slog.Error("failed to query episode", "aid", aid, "epno", epno, "error", err)
+		s.errorResponse(w, http.StatusInternalServerError, "failed to query episode")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"episodes": []database.Episode{episode},
+	})
+}
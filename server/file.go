@@ -0,0 +1,213 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/yureien/anihash/anidb"
+	"github.com/yureien/anihash/database"
+	"goji.io/pat"
+	"gorm.io/gorm"
+)
+
+// maxInlineCandidates is how many uncached candidates of an ambiguous
+// lookup are fetched from AniDB while the client waits. The others are
+// queued.
+const maxInlineCandidates = 2
+
+// fileHandler returns a file by AniDB file ID.
+func (s server) fileHandler(w http.ResponseWriter, r *http.Request) {
+	fid, err := strconv.ParseUint(pat.Param(r, "fid"), 10, 32)
+	if err != nil || fid == 0 {
+		s.errorResponse(w, http.StatusBadRequest, "invalid fid")
+		return
+	}
+
+	file, err := s.queryFile(r, uint32(fid))
+	if err != nil {
+		s.anidbErrorResponse(w, err)
+		return
+	}
+
+	s.fileResponse(w, file)
+}
+
+// episodeQueryHandler returns a file by anime ID, group ID and episode
+// number, or the candidate files if there are several.
+func (s server) episodeQueryHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	aid, err := strconv.ParseUint(query.Get("aid"), 10, 32)
+	if err != nil || aid == 0 {
+		s.errorResponse(w, http.StatusBadRequest, "invalid aid")
+		return
+	}
+	gid, err := strconv.ParseUint(query.Get("gid"), 10, 32)
+	if err != nil || gid == 0 {
+		s.errorResponse(w, http.StatusBadRequest, "invalid gid")
+		return
+	}
+	epno := query.Get("epno")
+	if epno == "" {
+		s.errorResponse(w, http.StatusBadRequest, "invalid epno")
+		return
+	}
+
+	files, pending, err := s.queryEpisodeFiles(r, uint32(aid), uint32(gid), epno)
+	if anidb.IsTemporary(err) {
+		// Fall back to the cached files, which may not be all of the
+		// candidates.
+		cached, dbErr := database.QueryFilesByEpisode(s.db, uint32(aid), uint32(gid), epno)
+		if dbErr != nil {
+			slog.Error("failed to query files", "aid", aid, "gid", gid, "epno", epno, "error", dbErr)
+		}
+		if len(cached) > 0 {
+			s.cachedFilesResponse(w, cached)
+			return
+		}
+	}
+	if err != nil {
+		s.anidbErrorResponse(w, err)
+		return
+	}
+	switch {
+	case len(files) == 0 && len(pending) == 0:
+		s.errorResponse(w, http.StatusNotFound, "no such file")
+	case len(files) == 1 && len(pending) == 0:
+		s.fileResponse(w, files[0])
+	default:
+		s.multipleFilesResponse(w, files, pending)
+	}
+}
+
+// queryEpisodeFiles asks AniDB for the files of an episode by a group.
+// The cache is not enough, as it may hold only some of the candidates,
+// but candidates that are cached are not fetched again.
+func (s server) queryEpisodeFiles(r *http.Request, aid, gid uint32, epno string) ([]database.AniDBFile, []uint32, error) {
+	slog.Info("fetching file from anidb", "aid", aid, "gid", gid, "epno", epno)
+	f, err := directLookup(s, r, func(ctx context.Context) (anidb.File, error) {
+		return s.anidbClient.FileByEpisode(ctx, aid, gid, epno)
+	})
+	var multiErr *anidb.MultipleFilesError
+	if errors.As(err, &multiErr) {
+		return s.queryFiles(r, multiErr.FileIDs)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := s.saveFile(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	return []database.AniDBFile{file}, nil, nil
+}
+
+// queryFile returns a file from the database, fetching it from AniDB
+// if it is not cached yet.
+func (s server) queryFile(r *http.Request, fid uint32) (database.AniDBFile, error) {
+	file, err := database.QueryFileByID(s.db, fid)
+	if err == nil {
+		return file, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return database.AniDBFile{}, err
+	}
+
+	slog.Info("fetching file from anidb", "fid", fid)
+	f, err := directLookup(s, r, func(ctx context.Context) (anidb.File, error) {
+		return s.anidbClient.FileByID(ctx, fid)
+	})
+	if err != nil {
+		return database.AniDBFile{}, err
+	}
+	return s.saveFile(f)
+}
+
+// queryFiles resolves the candidates of an ambiguous lookup.
+// At most maxInlineCandidates are fetched from AniDB; the IDs of the
+// others are queued and returned as pending.
+func (s server) queryFiles(r *http.Request, fileIDs []uint32) ([]database.AniDBFile, []uint32, error) {
+	files := make([]database.AniDBFile, 0, len(fileIDs))
+	var pending []uint32
+	fetched := 0
+	for _, fid := range fileIDs {
+		file, err := database.QueryFileByID(s.db, fid)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			if fetched == maxInlineCandidates {
+				if err := s.queue.EnqueueFileID(fid, anidb.PriorityInteractive); err != nil {
+					return nil, nil, err
+				}
+				pending = append(pending, fid)
+				continue
+			}
+			fetched++
+			file, err = s.queryFile(r, fid)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		files = append(files, file)
+	}
+	return files, pending, nil
+}
+
+// cachedFilesResponse writes the cached files of an episode when AniDB
+// could not be asked for all of them.
+func (s server) cachedFilesResponse(w http.ResponseWriter, files []database.AniDBFile) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusMultipleChoices)
+	json.NewEncoder(w).Encode(s.withAnidbStatus(map[string]any{
+		"files":    files,
+		"complete": false,
+	}))
+}
+
+// saveFile stores a file fetched from AniDB and marks it available.
+// If the file is already stored, the stored file is returned.
+func (s server) saveFile(f anidb.File) (database.AniDBFile, error) {
+	if file, err := database.QueryFileByID(s.db, f.FileID); err == nil {
+		return file, nil
+	}
+	// A concurrent request or the queue may store the file meanwhile.
+	file, err := database.SaveFile(s.db, database.FileFromAniDB(f))
+	if err != nil {
+		return database.AniDBFile{}, err
+	}
+	err = database.SaveAvailableFileState(s.db, file.FileID, file.Ed2K, int64(file.Size))
+	if err != nil {
+		return database.AniDBFile{}, err
+	}
+	return file, nil
+}
+
+// fileResponse writes an available file in the same shape as the
+// ed2k query.
+func (s server) fileResponse(w http.ResponseWriter, file database.AniDBFile) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"file": file,
+		"state": database.FileState{
+			FileID: &file.FileID,
+			State:  uint8(database.FILE_AVAILABLE),
+		},
+		"mylist": s.myListEntry(file.FileID),
+	})
+}
+
+// multipleFilesResponse writes the candidates of an ambiguous lookup
+// for the client to choose from, along with the IDs of the candidates
+// that are still being fetched.
+func (s server) multipleFilesResponse(w http.ResponseWriter, files []database.AniDBFile, pending []uint32) {
+	resp := map[string]any{
+		"files": files,
+	}
+	if len(pending) > 0 {
+		resp["pending"] = pending
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusMultipleChoices)
+	json.NewEncoder(w).Encode(resp)
+}
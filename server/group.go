@@ -0,0 +1,56 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/yureien/anihash/anidb"
+	"github.com/yureien/anihash/database"
+	"goji.io/pat"
+	"gorm.io/gorm"
+)
+
+// groupHandler returns a release group, along with the cached files
+// released by it.
+func (s server) groupHandler(w http.ResponseWriter, r *http.Request) {
+	gid, err := strconv.ParseUint(pat.Param(r, "gid"), 10, 32)
+	if err != nil || gid == 0 {
+		s.errorResponse(w, http.StatusBadRequest, "invalid gid")
+		return
+	}
+
+	group, err := database.QueryGroupByID(s.db, uint32(gid))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		slog.Info("fetching group from anidb", "gid", gid)
+		g, anidbErr := directLookup(s, r, func(ctx context.Context) (anidb.Group, error) {
+			return s.anidbClient.Group(ctx, uint32(gid))
+		})
+		if anidbErr != nil {
+			s.anidbErrorResponse(w, anidbErr)
+			return
+		}
+		group, err = database.SaveGroup(s.db, database.GroupFromAniDB(g))
+	}
+	if err != nil {
+		slog.Error("failed to query group", "gid", gid, "error", err)
+		s.errorResponse(w, http.StatusInternalServerError, "failed to query group")
+		return
+	}
+
+	files, err := database.QueryFilesByGroupID(s.db, uint32(gid))
+	if err != nil {
+		slog.Error("failed to query group files", "gid", gid, "error", err)
+		s.errorResponse(w, http.StatusInternalServerError, "failed to query group files")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"group": group,
+		"files": files,
+	})
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/yureien/anihash/database"
+)
+
+// healthHandler reports the status of the AniDB session and the job
+// queue.
+// It responds with 503 Service Unavailable if AniDB lookups are not
+// possible, because the client is logged out or banned.
+func (s server) healthHandler(w http.ResponseWriter, r *http.Request) {
+	session := s.anidbClient.SessionStatus()
+	anidbStatus := map[string]any{
+		"logged_in":     session.LoggedIn,
+		"port":          session.Port,
+		"last_response": database.OptionalTime(session.LastResponse),
+		"uptime":        session.Uptime.String(),
+		"uptime_at":     database.OptionalTime(session.UptimeCheckedAt),
+		"last_error":    session.LastError,
+	}
+	healthy := session.LoggedIn
+	if state := s.anidbClient.BreakerState(); state.Tripped(time.Now()) {
+		healthy = false
+		anidbStatus["paused_until"] = state.Until
+		anidbStatus["code"] = state.Code.String()
+		anidbStatus["reason"] = state.Reason
+	}
+
+	jobs, err := s.queue.Len()
+	if err != nil {
+		slog.Error("failed to count jobs", "error", err)
+		s.errorResponse(w, http.StatusInternalServerError, "failed to count jobs")
+		return
+	}
+
+	status := "ok"
+	statusCode := http.StatusOK
+	if !healthy {
+		status = "unavailable"
+		statusCode = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": status,
+		"anidb":  anidbStatus,
+		"queue": map[string]any{
+			"jobs": jobs,
+		},
+	})
+}
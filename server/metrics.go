@@ -0,0 +1,59 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/yureien/anihash/anidb"
+)
+
+// metricsHandler reports the AniDB rate limiter and job queue in the
+// Prometheus text format.
+func (s server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	jobs, err := s.queue.Len()
+	if err != nil {
+		slog.Error("failed to count jobs", "error", err)
+		s.errorResponse(w, http.StatusInternalServerError, "failed to count jobs")
+		return
+	}
+	stats := s.anidbClient.LimiterStats()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetric(w, "anihash_anidb_limiter_tokens", "gauge",
+		"Requests the AniDB rate limit allows without waiting.")
+	fmt.Fprintf(w, "anihash_anidb_limiter_tokens{limit=\"short\"} %g\n", stats.ShortTokens)
+	fmt.Fprintf(w, "anihash_anidb_limiter_tokens{limit=\"long\"} %g\n", stats.LongTokens)
+	fmt.Fprintf(w, "anihash_anidb_limiter_tokens{limit=\"bulk\"} %g\n", stats.BulkTokens)
+
+	priorities := []anidb.Priority{anidb.PriorityInteractive, anidb.PriorityRescan, anidb.PriorityBulk}
+	writeMetric(w, "anihash_anidb_limiter_waiting", "gauge",
+		"AniDB requests waiting for the rate limiter.")
+	for _, p := range priorities {
+		fmt.Fprintf(w, "anihash_anidb_limiter_waiting{priority=%q} %d\n", p, stats.Priorities[p].Waiting)
+	}
+	writeMetric(w, "anihash_anidb_limiter_requests_total", "counter",
+		"AniDB requests let through by the rate limiter.")
+	for _, p := range priorities {
+		fmt.Fprintf(w, "anihash_anidb_limiter_requests_total{priority=%q} %d\n", p, stats.Priorities[p].Requests)
+	}
+	writeMetric(w, "anihash_anidb_limiter_wait_seconds_total", "counter",
+		"Time AniDB requests waited for the rate limiter.")
+	for _, p := range priorities {
+		fmt.Fprintf(w, "anihash_anidb_limiter_wait_seconds_total{priority=%q} %g\n", p, stats.Priorities[p].TotalWait.Seconds())
+	}
+	writeMetric(w, "anihash_anidb_limiter_last_wait_seconds", "gauge",
+		"Time the last AniDB request waited for the rate limiter.")
+	for _, p := range priorities {
+		fmt.Fprintf(w, "anihash_anidb_limiter_last_wait_seconds{priority=%q} %g\n", p, stats.Priorities[p].LastWait.Seconds())
+	}
+
+	writeMetric(w, "anihash_queue_jobs", "gauge", "Jobs in the queue.")
+	fmt.Fprintf(w, "anihash_queue_jobs %d\n", jobs)
+}
+
+// writeMetric writes the help and type lines of a metric.
+func writeMetric(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/yureien/anihash/anidb"
+	"github.com/yureien/anihash/database"
+	"goji.io/pat"
+	"gorm.io/gorm"
+)
+
+// myListHandler returns the MyList entry of a file, fetching it from
+// AniDB if it is not stored yet.
+func (s server) myListHandler(w http.ResponseWriter, r *http.Request) {
+	fid, err := strconv.ParseUint(pat.Param(r, "fid"), 10, 32)
+	if err != nil || fid == 0 {
+		s.errorResponse(w, http.StatusBadRequest, "invalid fid")
+		return
+	}
+
+	entry, err := database.QueryMyListEntryByFileID(s.db, uint32(fid))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		entry, err = s.fetchMyListEntry(r, uint32(fid))
+	}
+	if err != nil {
+		s.anidbErrorResponse(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"mylist": entry,
+	})
+}
+
+// watchedHandler marks a file watched in MyList, adding it to MyList
+// if needed, so media players can scrobble through anihash.
+// The optional viewdate form value is when the file was watched, in
+// RFC 3339 format; it defaults to now.
+func (s server) watchedHandler(w http.ResponseWriter, r *http.Request) {
+	fid, err := strconv.ParseUint(pat.Param(r, "fid"), 10, 32)
+	if err != nil || fid == 0 {
+		s.errorResponse(w, http.StatusBadRequest, "invalid fid")
+		return
+	}
+	viewDate := time.Now()
+	if v := r.FormValue("viewdate"); v != "" {
+		viewDate, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			s.errorResponse(w, http.StatusBadRequest, "invalid viewdate")
+			return
+		}
+	}
+
+	viewed := true
+	fields := anidb.MyListFields{Viewed: &viewed, ViewDate: viewDate}
+	entry, err := database.QueryMyListEntryByFileID(s.db, uint32(fid))
+	switch {
+	case err == nil:
+		_, err = s.anidbClient.MyListEdit(r.Context(), anidb.MyListKey{ListID: entry.ListID}, fields)
+		if errors.Is(err, anidb.NO_SUCH_MYLIST_ENTRY) {
+			// The entry was deleted on AniDB.
+			if err := database.DeleteMyListEntry(s.db, entry.ListID); err != nil {
+				slog.Error("failed to delete mylist entry", "fid", fid, "lid", entry.ListID, "error", err)
+			}
+			entry, err = s.addWatched(r, uint32(fid), fields)
+		}
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		entry, err = s.addWatched(r, uint32(fid), fields)
+	}
+	if err != nil {
+		s.anidbErrorResponse(w, err)
+		return
+	}
+
+	entry.Viewed = true
+	entry.ViewDate = &viewDate
+	entry, err = database.SaveMyListEntry(s.db, entry)
+	if err != nil {
+		slog.Error("failed to save mylist entry", "fid", fid, "error", err)
+		s.errorResponse(w, http.StatusInternalServerError, "failed to save mylist entry")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"mylist": entry,
+	})
+}
+
+// addWatched adds a watched file to MyList and returns its entry.
+// If the file is already in MyList, such as when the response to an
+// earlier add was lost, the existing entry is marked watched instead.
+func (s server) addWatched(r *http.Request, fid uint32, fields anidb.MyListFields) (database.MyListEntry, error) {
+	slog.Info("adding watched file to mylist", "fid", fid)
+	lid, err := s.anidbClient.MyListAdd(r.Context(), anidb.MyListKey{FileID: fid}, fields)
+	var exists *anidb.MyListExistsError
+	if errors.As(err, &exists) {
+		_, err = s.anidbClient.MyListEdit(r.Context(), anidb.MyListKey{ListID: exists.Entry.ListID}, fields)
+		if err != nil {
+			return database.MyListEntry{}, err
+		}
+		return database.MyListEntryFromAniDB(exists.Entry), nil
+	}
+	if err != nil {
+		return database.MyListEntry{}, err
+	}
+
+	now := time.Now()
+	entry := database.MyListEntry{
+		ListID: lid,
+		FileID: fid,
+		Added:  &now,
+		State:  anidb.MyListStateUnknown.String(),
+	}
+	// The file is usually stored, as players look it up first.
+	if file, err := database.QueryFileByID(s.db, fid); err == nil {
+		entry.EpisodeID = file.EpisodeID
+		entry.AnimeID = file.AnimeID
+		entry.GroupID = file.GroupID
+	}
+	return entry, nil
+}
+
+// myListStatsHandler returns the statistics of the MyList of the user.
+func (s server) myListStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := s.anidbClient.MyListStats(r.Context())
+	if err != nil {
+		s.anidbErrorResponse(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"anime":                    stats.Anime,
+		"episodes":                 stats.Episodes,
+		"files":                    stats.Files,
+		"size_mb":                  stats.SizeMB,
+		"added_anime":              stats.AddedAnime,
+		"added_episodes":           stats.AddedEpisodes,
+		"added_files":              stats.AddedFiles,
+		"added_groups":             stats.AddedGroups,
+		"leech_percent":            stats.LeechPercent,
+		"glory_percent":            stats.GloryPercent,
+		"viewed_percent_of_db":     stats.ViewedPercentOfDB,
+		"mylist_percent_of_db":     stats.MyListPercentOfDB,
+		"viewed_percent_of_mylist": stats.ViewedPercentOfMyList,
+		"viewed_episodes":          stats.ViewedEpisodes,
+		"votes":                    stats.Votes,
+		"reviews":                  stats.Reviews,
+		"viewed_minutes":           stats.ViewedMinutes,
+	})
+}
+
+// fetchMyListEntry fetches the MyList entry of a file from AniDB and
+// stores it.
+func (s server) fetchMyListEntry(r *http.Request, fid uint32) (database.MyListEntry, error) {
+	e, err := s.anidbClient.MyList(r.Context(), anidb.MyListKey{FileID: fid})
+	if err != nil {
+		return database.MyListEntry{}, err
+	}
+	return database.SaveMyListEntry(s.db, database.MyListEntryFromAniDB(e))
+}
+
+// myListEntry returns the stored MyList entry of a file, or nil if
+// there is none, to return the watch state along with the file.
+func (s server) myListEntry(fid uint32) *database.MyListEntry {
+	entry, err := database.QueryMyListEntryByFileID(s.db, fid)
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			slog.Error("failed to query mylist entry", "fid", fid, "error", err)
+		}
+		return nil
+	}
+	return &entry
+}
@@ -42,7 +42,8 @@ func (s server) hashQueryHandler(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]any{
-		"file":  file,
-		"state": fileState,
+		"file":   file,
+		"state":  fileState,
+		"mylist": s.myListEntry(file.FileID),
 	})
 }
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"strconv"
 
+	"github.com/yureien/anihash/anidb"
 	"github.com/yureien/anihash/database"
 	"gorm.io/gorm"
 )
@@ -54,32 +55,50 @@ func (s server) queryHandler(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			s.anidbQueryChan <- request
+			if err := s.queue.Enqueue(request.Ed2K, request.Size, anidb.PriorityInteractive); err != nil {
+				slog.Error("failed to enqueue file", "error", err)
+				s.errorResponse(w, http.StatusInternalServerError, "failed to enqueue file")
+				return
+			}
 
 			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]any{
+			json.NewEncoder(w).Encode(s.withAnidbStatus(map[string]any{
 				"file":  nil,
 				"state": fileState,
-			})
+			}))
 			return
 		}
 
+		// Someone is waiting for the file now, so serve it before
+		// bulk work.
+		if fileState.State == uint8(database.FILE_PENDING) {
+			if err := s.queue.Enqueue(request.Ed2K, request.Size, anidb.PriorityInteractive); err != nil {
+				slog.Error("failed to enqueue file", "error", err)
+			}
+		}
+
 		if fileState.State != uint8(database.FILE_PENDING) && fileState.State != uint8(database.FILE_AVAILABLE) {
-			statusCode := http.StatusBadRequest
-			if fileState.State == uint8(database.FILE_NOT_FOUND) {
-				statusCode = http.StatusNotFound
+			statusCode := fileStateStatusCode(database.FileStateEnum(fileState.State))
+			if fileState.NextRetryAt != nil {
+				w.Header().Set("Retry-After", retryAfter(*fileState.NextRetryAt))
 			}
-			s.errorResponseWithJson(w, statusCode, map[string]any{
+			s.errorResponseWithJson(w, statusCode, s.withAnidbStatus(map[string]any{
 				"file":  nil,
 				"state": fileState,
-			})
+			}))
 			return
 		}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]any{
+	resp := map[string]any{
 		"file":  file,
 		"state": fileState,
-	})
+	}
+	if fileState.State == uint8(database.FILE_PENDING) {
+		resp = s.withAnidbStatus(resp)
+	} else {
+		resp["mylist"] = s.myListEntry(file.FileID)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
 }
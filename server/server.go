@@ -1,22 +1,36 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/yureien/anihash/anidb"
+	"github.com/yureien/anihash/database"
+	"github.com/yureien/anihash/queue"
 	"goji.io"
 	"goji.io/pat"
 	"gorm.io/gorm"
 )
 
+// maxDirectLookups is how many AniDB requests the HTTP handlers may
+// make at once.
+const maxDirectLookups = 4
+
 type server struct {
+	cfg         *ServerConfig
 	db          *gorm.DB
 	anidbClient *anidb.Client
+	queue       *queue.Queue
 
-	anidbQueryChan chan queryByEd2KSizeRequest
+	// directLookups limits the AniDB requests made by the handlers,
+	// see directLookup.
+	directLookups chan struct{}
 }
 
 var _ http.Handler = server{}
@@ -37,27 +51,129 @@ func (s server) errorResponseWithJson(w http.ResponseWriter, errCode int, data a
 	json.NewEncoder(w).Encode(data)
 }
 
-func New(anidbClient *anidb.Client, db *gorm.DB) (*server, error) {
-	anidbQueryChan := make(chan queryByEd2KSizeRequest)
+// anidbErrorResponse writes an error response for a failed lookup of
+// AniDB data, either from the database or from AniDB.
+func (s server) anidbErrorResponse(w http.ResponseWriter, err error) {
+	var code anidb.ReturnCode
+	switch {
+	case errors.As(err, &code) && isNoSuchCode(code):
+		s.errorResponse(w, http.StatusNotFound, err.Error())
+	case anidb.IsTemporary(err):
+		s.errorResponseWithJson(w, http.StatusServiceUnavailable, s.withAnidbStatus(map[string]any{
+			"error": err.Error(),
+		}))
+	case errors.As(err, &code):
+		s.errorResponse(w, http.StatusBadGateway, err.Error())
+	default:
+		slog.Error("failed to query anidb data", "error", err)
+		s.errorResponse(w, http.StatusInternalServerError, "failed to query anidb data")
+	}
+}
+
+// isNoSuchCode reports whether code means that AniDB does not know the
+// requested entity.
+func isNoSuchCode(code anidb.ReturnCode) bool {
+	switch code {
+	case anidb.NO_SUCH_FILE, anidb.NO_SUCH_ANIME, anidb.NO_SUCH_EPISODE, anidb.NO_SUCH_GROUP,
+		anidb.NO_SUCH_ENTRY, anidb.NO_SUCH_MYLIST_ENTRY:
+		return true
+	default:
+		return false
+	}
+}
+
+// fileStateStatusCode returns the HTTP status code for responses about
+// a file in the given state.
+func fileStateStatusCode(state database.FileStateEnum) int {
+	switch state {
+	case database.FILE_NOT_FOUND:
+		return http.StatusNotFound
+	case database.FILE_TRANSIENT_ERROR:
+		return http.StatusServiceUnavailable
+	case database.FILE_ERROR:
+		return http.StatusBadRequest
+	default:
+		return http.StatusOK
+	}
+}
+
+// retryAfter formats a Retry-After header value for t.
+func retryAfter(t time.Time) string {
+	secs := int(time.Until(t).Seconds())
+	return strconv.Itoa(max(secs, 0))
+}
+
+// withAnidbStatus adds the AniDB client status to a response if
+// requests to AniDB are currently paused, so that clients know why
+// pending files are not progressing.
+func (s server) withAnidbStatus(resp map[string]any) map[string]any {
+	state := s.anidbClient.BreakerState()
+	if !state.Tripped(time.Now()) {
+		return resp
+	}
+	resp["anidb"] = map[string]any{
+		"paused_until": state.Until,
+		"code":         state.Code.String(),
+		"reason":       state.Reason,
+	}
+	return resp
+}
 
+// directLookup makes an AniDB request for a handler, waiting while
+// maxDirectLookups are already running.
+//
+// Unlike lookups by hash, lookups by ID need a single request and are
+// answered while the client waits, instead of going through the queue.
+// Limiting them keeps a burst of such requests from filling the rate
+// limiter ahead of the queue.
+func directLookup[T any](s server, r *http.Request, f func(ctx context.Context) (T, error)) (T, error) {
+	ctx := r.Context()
+	select {
+	case s.directLookups <- struct{}{}:
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+	defer func() { <-s.directLookups }()
+	return f(ctx)
+}
+
+func New(anidbClient *anidb.Client, q *queue.Queue, db *gorm.DB, cfg *ServerConfig) (*server, error) {
 	server := server{
-		db:             db,
-		anidbClient:    anidbClient,
-		anidbQueryChan: anidbQueryChan,
+		cfg:           cfg,
+		db:            db,
+		anidbClient:   anidbClient,
+		queue:         q,
+		directLookups: make(chan struct{}, maxDirectLookups),
 	}
-	server.startProcessor()
 
 	return &server, nil
 }
 
-func (s server) ListenAndServe(logger *slog.Logger, cfg *ServerConfig) error {
-	listenAddress := fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)
+func (s server) ListenAndServe(logger *slog.Logger) error {
+	listenAddress := fmt.Sprintf("%s:%d", s.cfg.Host, s.cfg.Port)
+	logger.Info("starting server", "address", listenAddress)
+	return http.ListenAndServe(listenAddress, s.routes())
+}
 
+// routes returns the handler of all API endpoints.
+func (s server) routes() http.Handler {
 	mux := goji.NewMux()
 	mux.HandleFunc(pat.Get("/query/ed2k"), s.queryHandler)
 	mux.HandleFunc(pat.Get("/query/hash"), s.hashQueryHandler)
+	mux.HandleFunc(pat.Get("/query/episode"), s.episodeQueryHandler)
+	mux.HandleFunc(pat.Get("/file/:fid"), s.fileHandler)
+	mux.HandleFunc(pat.Get("/file/:fid/changes"), s.fileChangesHandler)
+	mux.HandleFunc(pat.Get("/changes"), s.changesHandler)
+	mux.HandleFunc(pat.Get("/anime/:aid"), s.animeHandler)
+	mux.HandleFunc(pat.Get("/anime/:aid/episodes"), s.animeEpisodesHandler)
+	mux.HandleFunc(pat.Get("/episode/:eid"), s.episodeHandler)
+	mux.HandleFunc(pat.Get("/group/:gid"), s.groupHandler)
+	mux.HandleFunc(pat.Get("/mylist/stats"), s.myListStatsHandler)
+	mux.HandleFunc(pat.Get("/mylist/:fid"), s.myListHandler)
+	mux.HandleFunc(pat.Post("/mylist/:fid/watched"), s.watchedHandler)
+	mux.HandleFunc(pat.Get("/health"), s.healthHandler)
+	mux.HandleFunc(pat.Get("/metrics"), s.metricsHandler)
 	mux.HandleFunc(pat.Get("/"), s.homePageHandler)
-
-	logger.Info("starting server", "address", listenAddress)
-	return http.ListenAndServe(listenAddress, mux)
+	return mux
 }
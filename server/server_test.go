@@ -0,0 +1,120 @@
+package server
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/yureien/anihash/anidb"
+	"github.com/yureien/anihash/anidb/anidbtest"
+	"github.com/yureien/anihash/database"
+	"github.com/yureien/anihash/queue"
+)
+
+// TestServer_queryEd2K looks up a file through the API, the queue and
+// the fake AniDB server, as a client of anihash would.
+func TestServer_queryEd2K(t *testing.T) {
+	ts := newTestServer(t)
+	url := ts.URL + "/query/ed2k?size=734003200&ed2k=0123456789abcdef0123456789abcdef"
+
+	var got struct {
+		File  *database.AniDBFile `json:"file"`
+		State struct {
+			FileID *uint32 `json:"file_id"`
+			State  string  `json:"state"`
+		} `json:"state"`
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = json.NewDecoder(resp.Body).Decode(&got)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Got status %d with state %s", resp.StatusCode, got.State.State)
+		}
+		if got.State.State != database.FILE_PENDING.String() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("File is still pending")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if got.State.State != database.FILE_AVAILABLE.String() {
+		t.Fatalf("Got state %s; want %s", got.State.State, database.FILE_AVAILABLE)
+	}
+	if got.State.FileID == nil || *got.State.FileID != 12345 {
+		t.Errorf("Got state file ID %v; want 12345", got.State.FileID)
+	}
+	f := got.File
+	if f == nil || f.FileID != 12345 || f.AnimeID != 1 || f.GroupName != "Frostii" || f.EpNum != "01" || f.RomajiName != "Seikai no Monshou" {
+		t.Fatalf("Got file %+v", f)
+	}
+	if len(f.AudioTracks) != 2 || f.AudioTracks[1].Codec != "AC3" || f.AudioTracks[1].Language != "english" {
+		t.Errorf("Got audio tracks %+v", f.AudioTracks)
+	}
+}
+
+// newTestServer returns an HTTP server serving the API, with the queue
+// running against a fake AniDB server and a new database.
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	logger := slog.New(slog.DiscardHandler)
+
+	fixtures, err := anidbtest.LoadFixtures("../anidb/anidbtest/testdata/fixtures.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake, err := anidbtest.NewServer("127.0.0.1:0", fixtures, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(fake.Close)
+
+	db, err := database.LoadDatabase(logger, &database.DatabaseConfig{
+		SQLite: &database.SQLiteConfig{Path: filepath.Join(t.TempDir(), "anihash.db")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := anidb.AniDBConfig{
+		Address:           fake.Addr(),
+		User:              "test",
+		Password:          "test",
+		Timeout:           200 * time.Millisecond,
+		KeepaliveInterval: -1,
+		RateLimit: anidb.RateLimitConfig{
+			ShortInterval: time.Millisecond,
+			LongInterval:  time.Millisecond,
+			LongBurst:     1,
+		},
+	}
+	client, closeClient, err := anidb.NewAuthenticatedClient(logger, &cfg, database.ClientStateStore{DB: db})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { closeClient() })
+
+	serverCfg := &ServerConfig{}
+	q := queue.New(logger, client, db, serverCfg.Retry, serverCfg.Refresh)
+	q.Start()
+	s, err := New(client, q, db, serverCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s.routes())
+	t.Cleanup(ts.Close)
+	return ts
+}